@@ -0,0 +1,409 @@
+package ledger
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/tmilner/monzo-customisation/adapters/monzorestclient"
+	bolt "go.etcd.io/bbolt"
+)
+
+var ErrNotFound = errors.New("transaction not found")
+
+var (
+	metaBucket          = []byte("meta")
+	transactionsBucket  = []byte("transactions")
+	accountIndexBucket  = []byte("account_index")
+	backfillBucket      = []byte("backfill")
+	roundUpsBucket      = []byte("round_ups")
+	budgetAlertsBucket  = []byte("budget_alerts")
+	webhookQueueBucket  = []byte("webhook_queue")
+	deadLettersBucket   = []byte("dead_letters")
+	webhookTokensBucket = []byte("webhook_tokens")
+	actionedBucket      = []byte("actioned")
+	actionsBucket       = []byte("actions")
+	schemaVersionKey    = []byte("schema_version")
+)
+
+// createdKeyFormat sorts lexically in time order, transactions are stored in UTC so the offset is always Z.
+const createdKeyFormat = "2006-01-02T15:04:05.000000000Z"
+
+// migrations upgrade the database one schema version at a time, migrations[0] takes an empty file to version 1.
+// Append new migrations to the end, never edit one that has shipped.
+var migrations = []func(tx *bolt.Tx) error{
+	func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(transactionsBucket)
+		return err
+	},
+	func(tx *bolt.Tx) error {
+		index, err := tx.CreateBucketIfNotExists(accountIndexBucket)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(transactionsBucket).ForEach(func(k, v []byte) error {
+			var transaction monzorestclient.TransactionDetailsResponse
+			if err := json.Unmarshal(v, &transaction); err != nil {
+				return err
+			}
+			return index.Put(accountIndexKey(transaction.AccountId, transaction.Created, transaction.Id), nil)
+		})
+	},
+	func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(backfillBucket)
+		return err
+	},
+	func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(roundUpsBucket)
+		return err
+	},
+	func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(budgetAlertsBucket)
+		return err
+	},
+	func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(webhookQueueBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(deadLettersBucket)
+		return err
+	},
+	func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(webhookTokensBucket)
+		return err
+	},
+	func(tx *bolt.Tx) error {
+		// Until now a transaction was only recorded once it had been actioned.
+		actioned, err := tx.CreateBucketIfNotExists(actionedBucket)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(transactionsBucket).ForEach(func(k, v []byte) error {
+			return actioned.Put(k, nil)
+		})
+	},
+	func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(actionsBucket)
+		return err
+	},
+}
+
+// BackfillState tracks how far through an account's history a backfill has got.
+// Cursor is the ID of the last transaction stored and Before is the fixed upper bound of the walk.
+type BackfillState struct {
+	Cursor   string    `json:"cursor"`
+	Before   time.Time `json:"before"`
+	Complete bool      `json:"complete"`
+	Count    int       `json:"count"`
+	Updated  time.Time `json:"updated"`
+}
+
+// RoundUp is the audit record of a round up taken from a transaction. DepositId is the dedupe ID of the
+// pot deposit that moves the money. It is empty while the round up is waiting for a batched deposit, and is
+// set before Deposited while that batch's deposit is being made, so a retry reuses it.
+type RoundUp struct {
+	TransactionId string    `json:"transaction_id"`
+	AccountId     string    `json:"account_id"`
+	PotId         string    `json:"pot_id"`
+	Amount        int64     `json:"amount"`
+	Created       time.Time `json:"created"`
+	DepositId     string    `json:"deposit_id,omitempty"`
+	Deposited     time.Time `json:"deposited,omitempty"`
+}
+
+// Ledger is an embedded store of every transaction the application has seen.
+type Ledger struct {
+	db *bolt.DB
+}
+
+func CreateLedger(path string) (*Ledger, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	if err = migrate(db); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+
+	return &Ledger{db: db}, nil
+}
+
+func migrate(db *bolt.DB) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		meta, err := tx.CreateBucketIfNotExists(metaBucket)
+		if err != nil {
+			return err
+		}
+
+		version := 0
+		if value := meta.Get(schemaVersionKey); value != nil {
+			if err := json.Unmarshal(value, &version); err != nil {
+				return err
+			}
+		}
+		if version > len(migrations) {
+			return fmt.Errorf("ledger schema version %d is newer than this build supports (%d)", version, len(migrations))
+		}
+
+		for ; version < len(migrations); version++ {
+			if err := migrations[version](tx); err != nil {
+				return fmt.Errorf("migrating ledger to version %d: %v", version+1, err)
+			}
+		}
+
+		value, _ := json.Marshal(version)
+		return meta.Put(schemaVersionKey, value)
+	})
+}
+
+func (l *Ledger) SchemaVersion() (int, error) {
+	version := 0
+	err := l.db.View(func(tx *bolt.Tx) error {
+		return json.Unmarshal(tx.Bucket(metaBucket).Get(schemaVersionKey), &version)
+	})
+	return version, err
+}
+
+func (l *Ledger) Close() error {
+	return l.db.Close()
+}
+
+// Record stores the transaction, returning false if it had already been recorded.
+// Later copies of a known transaction replace the stored one, so settlement and notes updates are kept.
+func (l *Ledger) Record(transaction *monzorestclient.TransactionDetailsResponse) (bool, error) {
+	if transaction.Id == "" {
+		return false, errors.New("transaction has no id")
+	}
+
+	value, err := json.Marshal(transaction)
+	if err != nil {
+		return false, err
+	}
+
+	isNew := false
+	err = l.db.Update(func(tx *bolt.Tx) error {
+		transactions := tx.Bucket(transactionsBucket)
+		index := tx.Bucket(accountIndexBucket)
+
+		if existing := transactions.Get([]byte(transaction.Id)); existing != nil {
+			var previous monzorestclient.TransactionDetailsResponse
+			if err := json.Unmarshal(existing, &previous); err != nil {
+				return err
+			}
+			if err := index.Delete(accountIndexKey(previous.AccountId, previous.Created, previous.Id)); err != nil {
+				return err
+			}
+		} else {
+			isNew = true
+		}
+
+		if err := transactions.Put([]byte(transaction.Id), value); err != nil {
+			return err
+		}
+		return index.Put(accountIndexKey(transaction.AccountId, transaction.Created, transaction.Id), nil)
+	})
+
+	return isNew, err
+}
+
+// MarkActioned records that the rules, round ups and alerts for the transaction have all run.
+func (l *Ledger) MarkActioned(transactionId string) error {
+	return l.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(actionedBucket).Put([]byte(transactionId), nil)
+	})
+}
+
+func (l *Ledger) Actioned(transactionId string) (bool, error) {
+	actioned := false
+	err := l.db.View(func(tx *bolt.Tx) error {
+		actioned = tx.Bucket(actionedBucket).Get([]byte(transactionId)) != nil
+		return nil
+	})
+	return actioned, err
+}
+
+// MarkActionDone records that one of the transaction's actions has succeeded, so a retry of the transaction
+// can skip it.
+func (l *Ledger) MarkActionDone(transactionId string, action string) error {
+	return l.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(actionsBucket).Put([]byte(transactionId+"\x00"+action), nil)
+	})
+}
+
+func (l *Ledger) ActionDone(transactionId string, action string) (bool, error) {
+	done := false
+	err := l.db.View(func(tx *bolt.Tx) error {
+		done = tx.Bucket(actionsBucket).Get([]byte(transactionId+"\x00"+action)) != nil
+		return nil
+	})
+	return done, err
+}
+
+func (l *Ledger) Get(transactionId string) (*monzorestclient.TransactionDetailsResponse, error) {
+	var transaction *monzorestclient.TransactionDetailsResponse
+	err := l.db.View(func(tx *bolt.Tx) error {
+		value := tx.Bucket(transactionsBucket).Get([]byte(transactionId))
+		if value == nil {
+			return ErrNotFound
+		}
+		return json.Unmarshal(value, &transaction)
+	})
+	return transaction, err
+}
+
+// Query returns the account's transactions created in [from, to), oldest first.
+// A zero from or to leaves that end of the range open.
+func (l *Ledger) Query(accountId string, from time.Time, to time.Time) ([]*monzorestclient.TransactionDetailsResponse, error) {
+	prefix := []byte(accountId + "\x00")
+	start := prefix
+	if !from.IsZero() {
+		start = append(append([]byte{}, prefix...), from.UTC().Format(createdKeyFormat)...)
+	}
+	var end []byte
+	if !to.IsZero() {
+		end = append(append([]byte{}, prefix...), to.UTC().Format(createdKeyFormat)...)
+	}
+
+	result := make([]*monzorestclient.TransactionDetailsResponse, 0)
+	err := l.db.View(func(tx *bolt.Tx) error {
+		transactions := tx.Bucket(transactionsBucket)
+		cursor := tx.Bucket(accountIndexBucket).Cursor()
+
+		for k, _ := cursor.Seek(start); k != nil && bytes.HasPrefix(k, prefix); k, _ = cursor.Next() {
+			if end != nil && bytes.Compare(k, end) >= 0 {
+				break
+			}
+
+			id := k[bytes.LastIndexByte(k, 0)+1:]
+			var transaction monzorestclient.TransactionDetailsResponse
+			if err := json.Unmarshal(transactions.Get(id), &transaction); err != nil {
+				return err
+			}
+			result = append(result, &transaction)
+		}
+		return nil
+	})
+
+	return result, err
+}
+
+func accountIndexKey(accountId string, created time.Time, transactionId string) []byte {
+	return []byte(accountId + "\x00" + created.UTC().Format(createdKeyFormat) + "\x00" + transactionId)
+}
+
+// BackfillState returns the saved progress for the account, or nil if a backfill has never started.
+func (l *Ledger) BackfillState(accountId string) (*BackfillState, error) {
+	var state *BackfillState
+	err := l.db.View(func(tx *bolt.Tx) error {
+		value := tx.Bucket(backfillBucket).Get([]byte(accountId))
+		if value == nil {
+			return nil
+		}
+		return json.Unmarshal(value, &state)
+	})
+	return state, err
+}
+
+func (l *Ledger) SaveBackfillState(accountId string, state *BackfillState) error {
+	value, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return l.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(backfillBucket).Put([]byte(accountId), value)
+	})
+}
+
+// WebhookToken returns the token in the account's webhook URL, or an empty string if it has never been given one.
+func (l *Ledger) WebhookToken(accountId string) (string, error) {
+	var token string
+	err := l.db.View(func(tx *bolt.Tx) error {
+		token = string(tx.Bucket(webhookTokensBucket).Get([]byte(accountId)))
+		return nil
+	})
+	return token, err
+}
+
+func (l *Ledger) SaveWebhookToken(accountId string, token string) error {
+	return l.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(webhookTokensBucket).Put([]byte(accountId), []byte(token))
+	})
+}
+
+func (l *Ledger) SaveRoundUp(roundUp *RoundUp) error {
+	return l.SaveRoundUps([]*RoundUp{roundUp})
+}
+
+// SaveRoundUps saves every round up in one transaction, so a batch is never left half updated.
+func (l *Ledger) SaveRoundUps(roundUps []*RoundUp) error {
+	return l.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(roundUpsBucket)
+		for _, roundUp := range roundUps {
+			value, err := json.Marshal(roundUp)
+			if err != nil {
+				return err
+			}
+			if err = bucket.Put([]byte(roundUp.AccountId+"\x00"+roundUp.TransactionId), value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// RoundUp returns the round up taken from the transaction, or nil if there is none.
+func (l *Ledger) RoundUp(accountId string, transactionId string) (*RoundUp, error) {
+	var roundUp *RoundUp
+	err := l.db.View(func(tx *bolt.Tx) error {
+		value := tx.Bucket(roundUpsBucket).Get([]byte(accountId + "\x00" + transactionId))
+		if value == nil {
+			return nil
+		}
+		return json.Unmarshal(value, &roundUp)
+	})
+	return roundUp, err
+}
+
+// RoundUps returns every round up recorded for the account.
+func (l *Ledger) RoundUps(accountId string) ([]*RoundUp, error) {
+	prefix := []byte(accountId + "\x00")
+	result := make([]*RoundUp, 0)
+	err := l.db.View(func(tx *bolt.Tx) error {
+		cursor := tx.Bucket(roundUpsBucket).Cursor()
+		for k, v := cursor.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = cursor.Next() {
+			var roundUp RoundUp
+			if err := json.Unmarshal(v, &roundUp); err != nil {
+				return err
+			}
+			result = append(result, &roundUp)
+		}
+		return nil
+	})
+	return result, err
+}
+
+// ClearBudgetAlert forgets that the alert identified by key was sent, so it can be sent again.
+func (l *Ledger) ClearBudgetAlert(key string) error {
+	return l.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(budgetAlertsBucket).Delete([]byte(key))
+	})
+}
+
+// MarkBudgetAlert records that the alert identified by key was sent at sent, returning false if it already had been.
+func (l *Ledger) MarkBudgetAlert(key string, sent time.Time) (bool, error) {
+	isNew := false
+	err := l.db.Update(func(tx *bolt.Tx) error {
+		alerts := tx.Bucket(budgetAlertsBucket)
+		if alerts.Get([]byte(key)) != nil {
+			return nil
+		}
+		isNew = true
+		value, _ := sent.MarshalText()
+		return alerts.Put([]byte(key), value)
+	})
+	return isNew, err
+}
@@ -0,0 +1,302 @@
+package ledger
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/tmilner/monzo-customisation/adapters/monzorestclient"
+	bolt "go.etcd.io/bbolt"
+)
+
+func createTestLedger(t *testing.T) (*Ledger, string, func()) {
+	dir, err := ioutil.TempDir("", "ledger")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "ledger.db")
+
+	ledger, err := CreateLedger(path)
+	if err != nil {
+		t.Fatalf("CreateLedger() error = %v", err)
+	}
+	return ledger, path, func() {
+		_ = ledger.Close()
+		_ = os.RemoveAll(dir)
+	}
+}
+
+func TestLedger_Record(t *testing.T) {
+	ledger, path, cleanup := createTestLedger(t)
+	defer cleanup()
+
+	transaction := &monzorestclient.TransactionDetailsResponse{
+		Id:        "tx_1",
+		AccountId: "acc_1",
+		Amount:    -350,
+		Created:   time.Date(2019, time.March, 12, 8, 30, 0, 0, time.UTC),
+	}
+
+	isNew, err := ledger.Record(transaction)
+	if err != nil || !isNew {
+		t.Fatalf("Ledger.Record() = %v, %v, want true", isNew, err)
+	}
+
+	transaction.Notes = "#coffee"
+	isNew, err = ledger.Record(transaction)
+	if err != nil || isNew {
+		t.Fatalf("Ledger.Record() for a duplicate = %v, %v, want false", isNew, err)
+	}
+
+	if err = ledger.Close(); err != nil {
+		t.Fatal(err)
+	}
+	reopened, err := CreateLedger(path)
+	if err != nil {
+		t.Fatalf("CreateLedger() error = %v", err)
+	}
+	defer reopened.Close()
+
+	if _, err := reopened.Get("tx_2"); err != ErrNotFound {
+		t.Errorf("Ledger.Get() for an unknown transaction error = %v, want %v", err, ErrNotFound)
+	}
+
+	got, err := reopened.Get("tx_1")
+	if err != nil || got.Notes != "#coffee" {
+		t.Errorf("Ledger.Get() = %+v, %v, want the updated notes", got, err)
+	}
+	if _, err = reopened.Get("tx_2"); err != ErrNotFound {
+		t.Errorf("Ledger.Get() error = %v, want %v", err, ErrNotFound)
+	}
+
+	if version, _ := reopened.SchemaVersion(); version != len(migrations) {
+		t.Errorf("Ledger.SchemaVersion() = %d, want %d", version, len(migrations))
+	}
+}
+
+func TestLedger_Actioned(t *testing.T) {
+	ledger, path, cleanup := createTestLedger(t)
+	defer cleanup()
+
+	for _, id := range []string{"tx_before_upgrade", "tx_after_upgrade"} {
+		if _, err := ledger.Record(&monzorestclient.TransactionDetailsResponse{Id: id, AccountId: "acc_1"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if actioned, err := ledger.Actioned("tx_after_upgrade"); err != nil || actioned {
+		t.Fatalf("Ledger.Actioned() before marking = %v, %v, want false", actioned, err)
+	}
+	if err := ledger.MarkActioned("tx_after_upgrade"); err != nil {
+		t.Fatalf("Ledger.MarkActioned() error = %v", err)
+	}
+
+	// Wind the schema back to before actioned was tracked, when every recorded transaction had been actioned.
+	err := ledger.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket(actionedBucket).Delete([]byte("tx_before_upgrade")); err != nil {
+			return err
+		}
+		return tx.Bucket(metaBucket).Put(schemaVersionKey, []byte("7"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ledger.Close(); err != nil {
+		t.Fatal(err)
+	}
+	reopened, err := CreateLedger(path)
+	if err != nil {
+		t.Fatalf("CreateLedger() error = %v", err)
+	}
+	defer reopened.Close()
+
+	for _, id := range []string{"tx_before_upgrade", "tx_after_upgrade"} {
+		if actioned, err := reopened.Actioned(id); err != nil || !actioned {
+			t.Errorf("Ledger.Actioned(%q) after reopening = %v, %v, want true", id, actioned, err)
+		}
+	}
+	if actioned, _ := reopened.Actioned("tx_unknown"); actioned {
+		t.Error("Ledger.Actioned() = true for an unknown transaction")
+	}
+}
+
+func TestLedger_ActionDone(t *testing.T) {
+	ledger, _, cleanup := createTestLedger(t)
+	defer cleanup()
+
+	if err := ledger.MarkActionDone("tx_1", "rules"); err != nil {
+		t.Fatalf("Ledger.MarkActionDone() error = %v", err)
+	}
+
+	tests := []struct {
+		name          string
+		transactionId string
+		action        string
+		want          bool
+	}{
+		{"Marked action", "tx_1", "rules", true},
+		{"Another action", "tx_1", "roundup", false},
+		{"Another transaction", "tx_2", "rules", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got, err := ledger.ActionDone(tt.transactionId, tt.action); err != nil || got != tt.want {
+				t.Errorf("Ledger.ActionDone() = %v, %v, want %v", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestLedger_Query(t *testing.T) {
+	ledger, _, cleanup := createTestLedger(t)
+	defer cleanup()
+
+	day := time.Date(2019, time.March, 12, 0, 0, 0, 0, time.UTC)
+	for _, transaction := range []*monzorestclient.TransactionDetailsResponse{
+		{Id: "tx_3", AccountId: "acc_1", Created: day.Add(26 * time.Hour)},
+		{Id: "tx_1", AccountId: "acc_1", Created: day.Add(-time.Hour)},
+		{Id: "tx_2", AccountId: "acc_1", Created: day.Add(9 * time.Hour)},
+		{Id: "tx_4", AccountId: "acc_2", Created: day.Add(10 * time.Hour)},
+		{Id: "tx_5", AccountId: "acc_1", Created: day},
+	} {
+		if _, err := ledger.Record(transaction); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name      string
+		accountId string
+		from      time.Time
+		to        time.Time
+		want      []string
+	}{
+		{"Whole history oldest first", "acc_1", time.Time{}, time.Time{}, []string{"tx_1", "tx_5", "tx_2", "tx_3"}},
+		{"Single day includes the start and excludes the end", "acc_1", day, day.Add(24 * time.Hour), []string{"tx_5", "tx_2"}},
+		{"Open ended from", "acc_1", day.Add(time.Hour), time.Time{}, []string{"tx_2", "tx_3"}},
+		{"Other account", "acc_2", time.Time{}, time.Time{}, []string{"tx_4"}},
+		{"Account prefixes do not overlap", "acc", time.Time{}, time.Time{}, []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ledger.Query(tt.accountId, tt.from, tt.to)
+			if err != nil {
+				t.Fatalf("Ledger.Query() error = %v", err)
+			}
+			ids := make([]string, 0)
+			for _, transaction := range got {
+				ids = append(ids, transaction.Id)
+			}
+			if len(ids) != len(tt.want) {
+				t.Fatalf("Ledger.Query() = %v, want %v", ids, tt.want)
+			}
+			for i := range ids {
+				if ids[i] != tt.want[i] {
+					t.Fatalf("Ledger.Query() = %v, want %v", ids, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestLedger_BackfillState(t *testing.T) {
+	ledger, _, cleanup := createTestLedger(t)
+	defer cleanup()
+
+	state, err := ledger.BackfillState("acc_1")
+	if err != nil || state != nil {
+		t.Fatalf("Ledger.BackfillState() = %v, %v, want nil", state, err)
+	}
+
+	saved := &BackfillState{Cursor: "tx_9", Before: time.Date(2019, time.March, 12, 0, 0, 0, 0, time.UTC), Count: 9}
+	if err = ledger.SaveBackfillState("acc_1", saved); err != nil {
+		t.Fatalf("Ledger.SaveBackfillState() error = %v", err)
+	}
+
+	state, err = ledger.BackfillState("acc_1")
+	if err != nil || state.Cursor != "tx_9" || !state.Before.Equal(saved.Before) || state.Complete {
+		t.Errorf("Ledger.BackfillState() = %+v, %v", state, err)
+	}
+}
+
+func TestLedger_WebhookToken(t *testing.T) {
+	ledger, path, cleanup := createTestLedger(t)
+	defer cleanup()
+
+	if token, err := ledger.WebhookToken("acc_1"); err != nil || token != "" {
+		t.Fatalf("Ledger.WebhookToken() = %q, %v, want none", token, err)
+	}
+	for _, token := range []string{"first", "rotated"} {
+		if err := ledger.SaveWebhookToken("acc_1", token); err != nil {
+			t.Fatalf("Ledger.SaveWebhookToken() error = %v", err)
+		}
+	}
+
+	_ = ledger.Close()
+	reopened, err := CreateLedger(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	if token, err := reopened.WebhookToken("acc_1"); err != nil || token != "rotated" {
+		t.Errorf("Ledger.WebhookToken() after reopening = %q, %v, want %q", token, err, "rotated")
+	}
+}
+
+func TestLedger_RoundUps(t *testing.T) {
+	ledger, _, cleanup := createTestLedger(t)
+	defer cleanup()
+
+	pending := &RoundUp{TransactionId: "tx_1", AccountId: "acc_1", PotId: "pot_1", Amount: 35}
+	for _, roundUp := range []*RoundUp{pending, {TransactionId: "tx_2", AccountId: "acc_2", Amount: 10}} {
+		if err := ledger.SaveRoundUp(roundUp); err != nil {
+			t.Fatalf("Ledger.SaveRoundUp() error = %v", err)
+		}
+	}
+
+	pending.DepositId = "deposit_1"
+	second := &RoundUp{TransactionId: "tx_3", AccountId: "acc_1", PotId: "pot_1", Amount: 20, DepositId: "deposit_1"}
+	if err := ledger.SaveRoundUps([]*RoundUp{pending, second}); err != nil {
+		t.Fatalf("Ledger.SaveRoundUps() error = %v", err)
+	}
+
+	got, err := ledger.RoundUps("acc_1")
+	if err != nil || len(got) != 2 || got[0].DepositId != "deposit_1" || got[0].Amount != 35 || got[1].DepositId != "deposit_1" {
+		t.Errorf("Ledger.RoundUps() = %+v, %v", got, err)
+	}
+
+	if roundUp, err := ledger.RoundUp("acc_1", "tx_1"); err != nil || roundUp == nil || roundUp.DepositId != "deposit_1" {
+		t.Errorf("Ledger.RoundUp() = %+v, %v", roundUp, err)
+	}
+	if roundUp, err := ledger.RoundUp("acc_1", "tx_2"); err != nil || roundUp != nil {
+		t.Errorf("Ledger.RoundUp() for another account's transaction = %+v, %v, want nil", roundUp, err)
+	}
+}
+
+func TestLedger_MarkBudgetAlert(t *testing.T) {
+	ledger, _, cleanup := createTestLedger(t)
+	defer cleanup()
+
+	sent := time.Date(2019, time.March, 12, 9, 0, 0, 0, time.UTC)
+	for i, want := range []bool{true, false} {
+		if got, err := ledger.MarkBudgetAlert("user_1/food/2019-03-01/80", sent.Add(time.Duration(i)*time.Hour)); err != nil || got != want {
+			t.Errorf("Ledger.MarkBudgetAlert() call %d = %v, %v, want %v", i, got, err, want)
+		}
+	}
+
+	var stored time.Time
+	err := ledger.db.View(func(tx *bolt.Tx) error {
+		return stored.UnmarshalText(tx.Bucket(budgetAlertsBucket).Get([]byte("user_1/food/2019-03-01/80")))
+	})
+	if err != nil || !stored.Equal(sent) {
+		t.Errorf("Budget alert stored as sent at %v, %v, want %v", stored, err, sent)
+	}
+
+	if err := ledger.ClearBudgetAlert("user_1/food/2019-03-01/80"); err != nil {
+		t.Fatalf("Ledger.ClearBudgetAlert() error = %v", err)
+	}
+	if got, err := ledger.MarkBudgetAlert("user_1/food/2019-03-01/80", sent); err != nil || !got {
+		t.Errorf("Ledger.MarkBudgetAlert() after clearing = %v, %v, want true", got, err)
+	}
+}
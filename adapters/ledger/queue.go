@@ -0,0 +1,144 @@
+package ledger
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var ErrEventNotFound = errors.New("event not found")
+
+// QueuedEvent is a webhook body waiting to be processed, or one that was given up on and dead lettered.
+// Ids increase in the order events were received.
+type QueuedEvent struct {
+	Id          uint64          `json:"id"`
+	AccountId   string          `json:"account_id"`
+	Body        json.RawMessage `json:"body"`
+	Received    time.Time       `json:"received"`
+	Attempts    int             `json:"attempts"`
+	LastError   string          `json:"last_error,omitempty"`
+	NextAttempt time.Time       `json:"next_attempt,omitempty"`
+}
+
+// Enqueue durably stores a webhook body for the account and returns the queued event.
+func (l *Ledger) Enqueue(accountId string, body []byte, received time.Time) (*QueuedEvent, error) {
+	event := &QueuedEvent{AccountId: accountId, Body: body, Received: received}
+	err := l.db.Update(func(tx *bolt.Tx) error {
+		queue := tx.Bucket(webhookQueueBucket)
+		id, err := queue.NextSequence()
+		if err != nil {
+			return err
+		}
+		event.Id = id
+		return putEvent(queue, event)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return event, nil
+}
+
+// Pending returns every queued event, oldest first.
+func (l *Ledger) Pending() ([]*QueuedEvent, error) {
+	return l.events(webhookQueueBucket)
+}
+
+// SaveQueued stores the retry state of an event that is still queued.
+func (l *Ledger) SaveQueued(event *QueuedEvent) error {
+	return l.db.Update(func(tx *bolt.Tx) error {
+		queue := tx.Bucket(webhookQueueBucket)
+		if queue.Get(eventKey(event.Id)) == nil {
+			return ErrEventNotFound
+		}
+		return putEvent(queue, event)
+	})
+}
+
+// Complete removes a processed event from the queue.
+func (l *Ledger) Complete(id uint64) error {
+	return l.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(webhookQueueBucket).Delete(eventKey(id))
+	})
+}
+
+// DeadLetter moves an event out of the queue so it is no longer retried.
+func (l *Ledger) DeadLetter(event *QueuedEvent) error {
+	return l.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket(webhookQueueBucket).Delete(eventKey(event.Id)); err != nil {
+			return err
+		}
+		return putEvent(tx.Bucket(deadLettersBucket), event)
+	})
+}
+
+// DeadLetters returns every dead lettered event, oldest first.
+func (l *Ledger) DeadLetters() ([]*QueuedEvent, error) {
+	return l.events(deadLettersBucket)
+}
+
+// Requeue moves a dead lettered event back onto the queue with its attempts reset.
+// It keeps its id, so it is processed before anything received for the account since.
+func (l *Ledger) Requeue(id uint64) error {
+	return l.db.Update(func(tx *bolt.Tx) error {
+		deadLetters := tx.Bucket(deadLettersBucket)
+		value := deadLetters.Get(eventKey(id))
+		if value == nil {
+			return ErrEventNotFound
+		}
+
+		var event QueuedEvent
+		if err := json.Unmarshal(value, &event); err != nil {
+			return err
+		}
+		event.Attempts = 0
+		event.NextAttempt = time.Time{}
+		if err := deadLetters.Delete(eventKey(id)); err != nil {
+			return err
+		}
+		return putEvent(tx.Bucket(webhookQueueBucket), &event)
+	})
+}
+
+// DeleteDeadLetter discards a dead lettered event for good.
+func (l *Ledger) DeleteDeadLetter(id uint64) error {
+	return l.db.Update(func(tx *bolt.Tx) error {
+		deadLetters := tx.Bucket(deadLettersBucket)
+		if deadLetters.Get(eventKey(id)) == nil {
+			return ErrEventNotFound
+		}
+		return deadLetters.Delete(eventKey(id))
+	})
+}
+
+func (l *Ledger) events(bucket []byte) ([]*QueuedEvent, error) {
+	result := make([]*QueuedEvent, 0)
+	err := l.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucket).ForEach(func(k, v []byte) error {
+			var event QueuedEvent
+			if err := json.Unmarshal(v, &event); err != nil {
+				return err
+			}
+			result = append(result, &event)
+			return nil
+		})
+	})
+	return result, err
+}
+
+func putEvent(bucket *bolt.Bucket, event *QueuedEvent) error {
+	value, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	return bucket.Put(eventKey(event.Id), value)
+}
+
+// eventKey is big endian so events iterate in the order they were received.
+func eventKey(id uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, id)
+	return key
+}
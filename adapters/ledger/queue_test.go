@@ -0,0 +1,75 @@
+package ledger
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLedger_Queue(t *testing.T) {
+	ledger, path, cleanup := createTestLedger(t)
+	defer cleanup()
+
+	received := time.Date(2019, time.March, 12, 8, 30, 0, 0, time.UTC)
+	for _, accountId := range []string{"acc_1", "acc_2", "acc_1"} {
+		if _, err := ledger.Enqueue(accountId, []byte(`{"type":"transaction.created"}`), received); err != nil {
+			t.Fatalf("Ledger.Enqueue() error = %v", err)
+		}
+	}
+
+	pending, err := ledger.Pending()
+	if err != nil || len(pending) != 3 || pending[0].Id != 1 || pending[2].Id != 3 || pending[2].AccountId != "acc_1" {
+		t.Fatalf("Ledger.Pending() = %+v, %v, want the events in the order received", pending, err)
+	}
+
+	pending[0].Attempts = 2
+	pending[0].LastError = "account not found"
+	if err = ledger.SaveQueued(pending[0]); err != nil {
+		t.Fatalf("Ledger.SaveQueued() error = %v", err)
+	}
+	if err = ledger.Complete(pending[1].Id); err != nil {
+		t.Fatalf("Ledger.Complete() error = %v", err)
+	}
+	if err = ledger.DeadLetter(pending[0]); err != nil {
+		t.Fatalf("Ledger.DeadLetter() error = %v", err)
+	}
+
+	if err = ledger.Close(); err != nil {
+		t.Fatal(err)
+	}
+	reopened, err := CreateLedger(path)
+	if err != nil {
+		t.Fatalf("CreateLedger() error = %v", err)
+	}
+	defer reopened.Close()
+
+	if pending, _ = reopened.Pending(); len(pending) != 1 || pending[0].Id != 3 {
+		t.Errorf("Ledger.Pending() after reopening = %+v, want only event 3", pending)
+	}
+	deadLetters, err := reopened.DeadLetters()
+	if err != nil || len(deadLetters) != 1 || deadLetters[0].Attempts != 2 || deadLetters[0].LastError != "account not found" {
+		t.Fatalf("Ledger.DeadLetters() = %+v, %v", deadLetters, err)
+	}
+
+	if err = reopened.Requeue(1); err != nil {
+		t.Fatalf("Ledger.Requeue() error = %v", err)
+	}
+	if pending, _ = reopened.Pending(); len(pending) != 2 || pending[0].Id != 1 || pending[0].Attempts != 0 {
+		t.Errorf("Ledger.Pending() after requeue = %+v, want event 1 first with its attempts reset", pending)
+	}
+	if err = reopened.Requeue(1); err != ErrEventNotFound {
+		t.Errorf("Ledger.Requeue() of a queued event error = %v, want %v", err, ErrEventNotFound)
+	}
+
+	if err = reopened.DeadLetter(pending[1]); err != nil {
+		t.Fatal(err)
+	}
+	if err = reopened.DeleteDeadLetter(3); err != nil {
+		t.Errorf("Ledger.DeleteDeadLetter() error = %v", err)
+	}
+	if deadLetters, _ = reopened.DeadLetters(); len(deadLetters) != 0 {
+		t.Errorf("Ledger.DeadLetters() after delete = %+v", deadLetters)
+	}
+	if err = reopened.SaveQueued(pending[1]); err != ErrEventNotFound {
+		t.Errorf("Ledger.SaveQueued() of a removed event error = %v, want %v", err, ErrEventNotFound)
+	}
+}
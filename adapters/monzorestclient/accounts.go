@@ -1,6 +1,7 @@
 package monzorestclient
 
 import (
+	"context"
 	"encoding/json"
 )
 
@@ -23,8 +24,8 @@ type OwnersResponse struct {
 	PreferredFirstName string `json:"preferred_first_name"`
 }
 
-func (a *MonzoRestClient) ListAccounts(authToken string) (*AccountListResponse, error) {
-	body, err := a.processGetRequest("/accounts", authToken)
+func (a *MonzoRestClient) ListAccounts(ctx context.Context, authToken string) (*AccountListResponse, error) {
+	body, err := a.processGetRequest(ctx, "/accounts", authToken)
 
 	if err != nil {
 		return nil, err
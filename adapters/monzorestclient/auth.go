@@ -1,13 +1,19 @@
 package monzorestclient
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
-	"io/ioutil"
 	"log"
+	"net/http"
 	"net/url"
+	"strings"
 )
 
+// ErrAuthRejected matches, via errors.Is, the *APIError returned when Monzo refuses a code or refresh token.
+// Retrying the same request will not succeed.
+var ErrAuthRejected = errors.New("auth rejected")
+
 type AuthResponse struct {
 	AccessToken  string `json:"access_token"`
 	ClientId     string `json:"client_id"`
@@ -17,7 +23,7 @@ type AuthResponse struct {
 	UserId       string `json:"user_id"`
 }
 
-func (a *MonzoRestClient) Authenticate(code string, clientId string, clientSecret string, redirectUri string) (*AuthResponse, error) {
+func (a *MonzoRestClient) Authenticate(ctx context.Context, code string, clientId string, clientSecret string, redirectUri string) (*AuthResponse, error) {
 	form := url.Values{}
 	form.Add("grant_type", "authorization_code")
 	form.Add("client_id", clientId)
@@ -25,36 +31,33 @@ func (a *MonzoRestClient) Authenticate(code string, clientId string, clientSecre
 	form.Add("code", code)
 	form.Add("redirect_uri", redirectUri)
 
-	return a.authRequest(form)
+	return a.authRequest(ctx, form)
 }
 
-func (a *MonzoRestClient) RefreshAuth(auth string, clientId string, clientSecret string) (*AuthResponse, error) {
+func (a *MonzoRestClient) RefreshAuth(ctx context.Context, auth string, clientId string, clientSecret string) (*AuthResponse, error) {
 	form := url.Values{}
 	form.Add("grant_type", "refresh_token")
 	form.Add("client_id", clientId)
 	form.Add("client_secret", clientSecret)
 	form.Add("refresh_token", auth)
 
-	return a.authRequest(form)
+	return a.authRequest(ctx, form)
 }
 
-func (a *MonzoRestClient) authRequest(form map[string][]string) (*AuthResponse, error) {
-	res, err := a.client.PostForm("https://api.monzo.com/oauth2/token", form)
+func (a *MonzoRestClient) authRequest(ctx context.Context, form map[string][]string) (*AuthResponse, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", a.tokenUrl, strings.NewReader(url.Values(form).Encode()))
 	if err != nil {
-		log.Printf("Error posting for token %+v", err)
 		return nil, err
 	}
 
-	if res.Status != "200 OK" {
-		log.Printf("auth response is not 200. Is %+v", res.Status)
-		return nil, errors.New("response is not 200")
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	body, err := a.do(req)
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		apiErr.tokenRequest = true
 	}
-
-	defer res.Body.Close()
-	body, err := ioutil.ReadAll(res.Body)
-
 	if err != nil {
-		log.Println("Error in auth")
+		log.Printf("Error posting for token %+v", err)
 		return nil, err
 	}
 
@@ -1,6 +1,7 @@
 package monzorestclient
 
 import (
+	"context"
 	"encoding/json"
 )
 
@@ -20,8 +21,8 @@ type LocalSpendResponse struct {
 	Currency   string `json:"currency"`
 }
 
-func (a *MonzoRestClient) GetBalance(accountId string, authToken string) (*BalanceResponse, error) {
-	body, err := a.processGetRequest("/balance?account_id="+accountId, authToken)
+func (a *MonzoRestClient) GetBalance(ctx context.Context, accountId string, authToken string) (*BalanceResponse, error) {
+	body, err := a.processGetRequest(ctx, "/balance?account_id="+accountId, authToken)
 
 	if err != nil {
 		return nil, err
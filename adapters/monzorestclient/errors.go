@@ -0,0 +1,110 @@
+package monzorestclient
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxErrorBody caps how much of an error response is read, Monzo's error bodies are small JSON objects.
+const maxErrorBody = 64 * 1024
+
+// APIError is a response from Monzo with a status outside 2xx. Code and Message come from Monzo's JSON
+// error body, for example "unauthorized.bad_access_token", and are empty if the body was not JSON.
+type APIError struct {
+	StatusCode int
+	Code       string
+	Message    string
+	Method     string
+	Path       string
+	RetryAfter time.Duration
+
+	tokenRequest bool
+}
+
+func (e *APIError) Error() string {
+	detail := e.Code
+	if e.Message != "" {
+		if detail != "" {
+			detail += ": "
+		}
+		detail += e.Message
+	}
+	if detail == "" {
+		detail = http.StatusText(e.StatusCode)
+	}
+	return fmt.Sprintf("monzo %s %s: %d %s", e.Method, e.Path, e.StatusCode, detail)
+}
+
+// Is lets errors.Is(err, ErrAuthRejected) keep working for a token request Monzo refused.
+func (e *APIError) Is(target error) bool {
+	return target == ErrAuthRejected && e.tokenRequest &&
+		(e.StatusCode == http.StatusBadRequest || e.StatusCode == http.StatusUnauthorized)
+}
+
+// IsUnauthorized reports whether Monzo rejected the access token, which usually means it needs refreshing.
+func IsUnauthorized(err error) bool {
+	var apiErr *APIError
+	return errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusUnauthorized
+}
+
+// IsRateLimited reports whether Monzo asked for requests to slow down, see APIError.RetryAfter.
+func IsRateLimited(err error) bool {
+	var apiErr *APIError
+	return errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusTooManyRequests
+}
+
+// IsInsufficientPermissions reports whether the token is valid but not allowed to do this, typically
+// because the user has not yet approved access in the Monzo app.
+func IsInsufficientPermissions(err error) bool {
+	var apiErr *APIError
+	return errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusForbidden
+}
+
+// IsNotFound reports whether the thing asked for does not exist, or is not visible to the token.
+func IsNotFound(err error) bool {
+	var apiErr *APIError
+	return errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound
+}
+
+func readAPIError(res *http.Response) *APIError {
+	apiErr := &APIError{
+		StatusCode: res.StatusCode,
+		Method:     res.Request.Method,
+		Path:       res.Request.URL.Path,
+		RetryAfter: parseRetryAfter(res.Header.Get("Retry-After"), time.Now()),
+	}
+
+	body, _ := ioutil.ReadAll(io.LimitReader(res.Body, maxErrorBody))
+	var monzoErr struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	}
+	if json.Unmarshal(body, &monzoErr) == nil {
+		apiErr.Code = monzoErr.Code
+		apiErr.Message = monzoErr.Message
+	} else {
+		apiErr.Message = strings.TrimSpace(string(body))
+	}
+	return apiErr
+}
+
+// parseRetryAfter reads a Retry-After header given in seconds or as an HTTP date.
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if at, err := http.ParseTime(value); err == nil && at.After(now) {
+		return at.Sub(now)
+	}
+	return 0
+}
@@ -1,12 +1,9 @@
 package monzorestclient
 
 import (
-	"errors"
-	"io/ioutil"
+	"context"
 	"log"
-	"net/http"
 	"net/url"
-	"strings"
 )
 
 type FeedItem struct {
@@ -22,41 +19,20 @@ type Params struct {
 	ImageUrl string `json:"image_url"`
 }
 
-func (a *MonzoRestClient) CreateFeedItem(item *FeedItem, authToken string) error {
+func (a *MonzoRestClient) CreateFeedItem(ctx context.Context, item *FeedItem, authToken string) error {
 	form := url.Values{}
 	form.Add("account_id", item.AccountId)
 	form.Add("type", "basic")
 	form.Add("params[title]", item.Params.Title)
 	form.Add("params[body]", item.Params.Body)
 	form.Add("params[image_url]", item.Params.ImageUrl)
-
-	req, err := http.NewRequest("POST", a.url+"/feed", strings.NewReader(form.Encode()))
-	if err != nil {
-		log.Printf("Something went wrong saving feed item! (1)  %v", err)
-		return err
-	}
-
-	req.PostForm = form
-	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
-	req.Header.Add("Authorization", "Bearer "+authToken)
-
-	res, lastErr := a.client.Do(req)
-
-	if lastErr != nil {
-		log.Printf("Something went wrong saving feed item! (2) %v", lastErr)
-		return lastErr
+	if item.Url != "" {
+		form.Add("url", item.Url)
 	}
 
-	if "200 OK" != res.Status && "201 Created" != res.Status {
-		defer res.Body.Close()
-		body, err := ioutil.ReadAll(res.Body)
-		if err != nil {
-			log.Println("Failed in many ways :'( ")
-			return err
-		}
-
-		log.Printf("Not 200 or 201! is %s. Response is: %+v", res.Status, string(body))
-		return errors.New("not 200 or 201")
+	if _, err := a.processFormRequest(ctx, "POST", "/feed", authToken, form); err != nil {
+		log.Printf("Something went wrong saving feed item! %v", err)
+		return err
 	}
 
 	return nil
@@ -1,62 +1,148 @@
 package monzorestclient
 
 import (
-	"errors"
-	"io"
+	"context"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"net/url"
+	"strings"
+	"time"
 )
 
 type MonzoRestClient struct {
-	url    string
-	client *http.Client
+	url      string
+	tokenUrl string
+	client   *http.Client
+	opts     []CallOption
+	limiter  *rateLimiter
+	sleep    func(ctx context.Context, delay time.Duration) error
 }
 
+// CreateMonzoRestClient talks to the API at url, which must end in a slash. Tokens are requested from
+// url + "oauth2/token" unless WithTokenUrl says otherwise.
 func CreateMonzoRestClient(url string, client *http.Client) *MonzoRestClient {
-	return &MonzoRestClient{url: url, client: client}
+	return &MonzoRestClient{url: url, tokenUrl: url + "oauth2/token", client: client}
 }
 
-func (a *MonzoRestClient) processGetRequest(path string, authToken string) ([]byte, error) {
-	req, err := http.NewRequest("GET", a.url+path, nil)
+func (a *MonzoRestClient) WithTokenUrl(tokenUrl string) *MonzoRestClient {
+	a.tokenUrl = tokenUrl
+	return a
+}
+
+func (a *MonzoRestClient) processGetRequest(ctx context.Context, path string, authToken string) ([]byte, error) {
+	return a.processRequest(ctx, "GET", path, authToken)
+}
+
+func (a *MonzoRestClient) processDeleteRequest(ctx context.Context, path string, authToken string) ([]byte, error) {
+	return a.processRequest(ctx, "DELETE", path, authToken)
+}
+
+func (a *MonzoRestClient) processRequest(ctx context.Context, method string, path string, authToken string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, method, a.url+path, nil)
 
 	if err != nil {
 		return nil, err
 	}
 
 	req.Header.Add("Authorization", "Bearer "+authToken)
-	resp, err := a.client.Do(req)
-	if err != nil {
-		return nil, err
-	}
+	return a.do(req)
+}
 
-	if resp.Status != "200 OK" {
-		log.Printf("Result is not Sucess. Its actually: %s", resp.Status)
-		return nil, errors.New("not 200")
-	}
+func (a *MonzoRestClient) processPatchRequest(ctx context.Context, path string, authToken string, form url.Values, opts ...CallOption) ([]byte, error) {
+	return a.processFormRequest(ctx, "PATCH", path, authToken, form, opts...)
+}
 
-	defer resp.Body.Close()
-	return ioutil.ReadAll(resp.Body)
+func (a *MonzoRestClient) processPutRequest(ctx context.Context, path string, authToken string, form url.Values) ([]byte, error) {
+	return a.processFormRequest(ctx, "PUT", path, authToken, form)
 }
 
-func (a *MonzoRestClient) processPatchRequest(path string, authToken string, body io.Reader) ([]byte, error) {
-	req, err := http.NewRequest("PATCH", a.url+path, body)
+func (a *MonzoRestClient) processFormRequest(ctx context.Context, method string, path string, authToken string, form url.Values, opts ...CallOption) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, method, a.url+path, strings.NewReader(form.Encode()))
 
 	if err != nil {
 		return nil, err
 	}
 
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
 	req.Header.Add("Authorization", "Bearer "+authToken)
+	return a.do(req, opts...)
+}
+
+// do sends the request and returns the body of a 2xx response, anything else is returned as an *APIError.
+// The request's context cancels both the request and any wait for a retry or the rate limit.
+// Failures worth retrying are retried according to the retry policy, unless Monzo's Retry-After asks to
+// wait longer than MaxBackoff, when the error is returned for the caller to try again later.
+func (a *MonzoRestClient) do(req *http.Request, opts ...CallOption) ([]byte, error) {
+	options := a.callOptions(req, opts)
+	attempts := options.policy.MaxAttempts
+	if !options.idempotent && !options.policy.RetryAll {
+		attempts = 1
+	}
+
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 && req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req.Body = body
+		}
+		if a.limiter != nil {
+			if err := a.limiter.wait(req.Context()); err != nil {
+				return nil, err
+			}
+		}
+
+		body, retryAfter, err := a.attempt(req)
+		if err == nil {
+			return body, nil
+		}
+		if attempt+1 >= attempts || !retryable(err) || retryAfter > options.policy.MaxBackoff || req.Context().Err() != nil {
+			return nil, err
+		}
+
+		delay := options.policy.backoff(attempt, retryAfter)
+		log.Printf("Monzo request %s %s failed (attempt %d), retrying in %v: %v", req.Method, req.URL.Path, attempt+1, delay, err)
+		if err := a.wait(req.Context(), delay); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (a *MonzoRestClient) attempt(req *http.Request) ([]byte, time.Duration, error) {
 	resp, err := a.client.Do(req)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
+	}
+
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		apiErr := readAPIError(resp)
+		log.Printf("Monzo request failed: %v", apiErr)
+		return nil, apiErr.RetryAfter, apiErr
 	}
 
-	if resp.Status != "200 OK" {
-		log.Printf("Result is not Sucess. Its actually: %s", resp.Status)
-		return nil, errors.New("not 200")
+	body, err := ioutil.ReadAll(resp.Body)
+	return body, 0, err
+}
+
+func (a *MonzoRestClient) wait(ctx context.Context, delay time.Duration) error {
+	if a.sleep != nil {
+		return a.sleep(ctx, delay)
 	}
+	return sleepContext(ctx, delay)
+}
 
-	defer resp.Body.Close()
-	return ioutil.ReadAll(resp.Body)
+// sleepContext waits for the delay, returning the context's error if it is done first.
+func sleepContext(ctx context.Context, delay time.Duration) error {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
 }
@@ -1,10 +1,16 @@
 package monzorestclient
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"reflect"
+	"strconv"
 	"testing"
+	"time"
 )
 
 func TestCreateMonzoClient(t *testing.T) {
@@ -22,7 +28,7 @@ func TestCreateMonzoClient(t *testing.T) {
 		{
 			name: "Client is created successfully",
 			args: args{url, client},
-			want: &MonzoRestClient{url, client},
+			want: &MonzoRestClient{url: url, tokenUrl: url + "oauth2/token", client: client},
 		},
 	}
 	for _, tt := range tests {
@@ -88,13 +94,328 @@ func TestMonzoClient_processGetRequest(t *testing.T) {
 				url:    tt.server.URL,
 				client: &http.Client{},
 			}
-			got, err := a.processGetRequest(tt.args.path, tt.args.authToken)
+			got, err := a.processGetRequest(context.Background(), tt.args.path, tt.args.authToken)
 			if (err != nil) != tt.wantErr {
-				t.Errorf("MonzoRestClient.processGetRequest() error = %v, wantErr %v", err, tt.wantErr)
+				t.Errorf("MonzoRestClient.processGetRequest(context.Background(), ) error = %v, wantErr %v", err, tt.wantErr)
 				return
 			}
 			if !reflect.DeepEqual(got, tt.want) {
-				t.Errorf("MonzoRestClient.processGetRequest() = %v, want %v", got, tt.want)
+				t.Errorf("MonzoRestClient.processGetRequest(context.Background(), ) = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMonzoRestClient_IterateTransactions(t *testing.T) {
+	all := make([]TransactionDetailsResponse, 0)
+	start := time.Date(2019, time.January, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 7; i++ {
+		all = append(all, TransactionDetailsResponse{Id: fmt.Sprintf("tx_%d", i), Created: start.Add(time.Duration(i) * time.Hour)})
+	}
+
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		query := r.URL.Query()
+		if query.Get("account_id") != "acc_1" || query.Get("expand[]") != "merchant" {
+			http.Error(w, "bad query", http.StatusBadRequest)
+			return
+		}
+		if query.Get("before") != "2019-01-02T00:00:00Z" {
+			http.Error(w, "missing before", http.StatusBadRequest)
+			return
+		}
+
+		limit, _ := strconv.Atoi(query.Get("limit"))
+		first := 0
+		for i, transaction := range all {
+			if transaction.Id == query.Get("since") {
+				first = i + 1
+			}
+		}
+		last := first + limit
+		if last > len(all) {
+			last = len(all)
+		}
+		_ = json.NewEncoder(w).Encode(TransactionsResponse{Transactions: all[first:last]})
+	}))
+	defer server.Close()
+
+	client := CreateMonzoRestClient(server.URL, &http.Client{})
+
+	tests := []struct {
+		name         string
+		since        string
+		wantIds      int
+		wantRequests int
+	}{
+		{"Walks every page", "", 7, 3},
+		{"Resumes after a cursor", "tx_4", 2, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			requests = 0
+			it := client.IterateTransactions(context.Background(), "acc_1", func() string { return "token" }, TransactionsQuery{
+				Since:  tt.since,
+				Before: start.Add(24 * time.Hour),
+				Limit:  3,
+			})
+
+			ids := make([]string, 0)
+			for it.Next() {
+				ids = append(ids, it.Transaction().Id)
+			}
+			if it.Err() != nil {
+				t.Fatalf("TransactionIterator.Err() = %v", it.Err())
+			}
+			if len(ids) != tt.wantIds || ids[len(ids)-1] != "tx_6" {
+				t.Errorf("Iterated %v", ids)
+			}
+			if it.Cursor() != "tx_6" {
+				t.Errorf("TransactionIterator.Cursor() = %s, want tx_6", it.Cursor())
+			}
+			if requests != tt.wantRequests {
+				t.Errorf("Made %d requests, want %d", requests, tt.wantRequests)
+			}
+		})
+	}
+}
+
+func TestMonzoRestClient_UpdateTransaction(t *testing.T) {
+	tests := []struct {
+		name     string
+		update   func(a *MonzoRestClient) (*TransactionDetailsResponse, error)
+		wantForm map[string]string
+	}{
+		{
+			name: "Sends every metadata key form encoded",
+			update: func(a *MonzoRestClient) (*TransactionDetailsResponse, error) {
+				return a.UpdateTransaction(context.Background(), "tx_1", "9876", map[string]string{"notes": "#coffee & cake", "source": "rules"})
+			},
+			wantForm: map[string]string{"metadata[notes]": "#coffee & cake", "metadata[source]": "rules"},
+		},
+		{
+			name: "Deletes keys by sending an empty value",
+			update: func(a *MonzoRestClient) (*TransactionDetailsResponse, error) {
+				return a.DeleteTransactionMetadata(context.Background(), "tx_1", "9876", "source")
+			},
+			wantForm: map[string]string{"metadata[source]": ""},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method != "PATCH" || r.URL.Path != "/transactions/tx_1" {
+					http.Error(w, "wrong endpoint", http.StatusNotFound)
+					return
+				}
+				if r.Header.Get("Content-Type") != "application/x-www-form-urlencoded" || r.Header.Get("Authorization") != "Bearer 9876" {
+					http.Error(w, "wrong headers", http.StatusBadRequest)
+					return
+				}
+				if err := r.ParseForm(); err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+
+				got := map[string]string{}
+				for key := range r.PostForm {
+					got[key] = r.PostForm.Get(key)
+				}
+				if !reflect.DeepEqual(got, tt.wantForm) {
+					t.Errorf("Form = %v, want %v", got, tt.wantForm)
+				}
+
+				_, _ = w.Write([]byte(`{"transaction": {"id": "tx_1", "notes": "#coffee & cake", "merchant": "merch_1"}}`))
+			}))
+			defer server.Close()
+
+			got, err := tt.update(CreateMonzoRestClient(server.URL, &http.Client{}))
+			if err != nil {
+				t.Fatalf("UpdateTransaction() error = %v", err)
+			}
+			if got.Id != "tx_1" || got.Notes != "#coffee & cake" || got.Merchant.Id != "merch_1" {
+				t.Errorf("UpdateTransaction() = %+v", got)
+			}
+		})
+	}
+}
+
+func TestAppendHashtags(t *testing.T) {
+	tests := []struct {
+		name     string
+		notes    string
+		hashtags []string
+		want     string
+	}{
+		{"Empty notes", "", []string{"#coffee"}, "#coffee"},
+		{"Existing notes are kept", "with Sam", []string{"#coffee"}, "with Sam #coffee"},
+		{"Hashes are added when missing", "", []string{"coffee", "treat"}, "#coffee #treat"},
+		{"Existing hashtags are not repeated", "#coffee with Sam", []string{"#coffee"}, "#coffee with Sam"},
+		{"Partial matches are not treated as duplicates", "#coffeeshop", []string{"#coffee"}, "#coffeeshop #coffee"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := AppendHashtags(tt.notes, tt.hashtags...); got != tt.want {
+				t.Errorf("AppendHashtags() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMonzoRestClient_potTransfers(t *testing.T) {
+	tests := []struct {
+		name     string
+		transfer func(a *MonzoRestClient) (*PotResponse, error)
+		wantPath string
+		wantForm map[string]string
+	}{
+		{
+			name: "Deposit sends the source account, amount and dedupe ID",
+			transfer: func(a *MonzoRestClient) (*PotResponse, error) {
+				return a.DepositIntoPot(context.Background(), "pot_1", "acc_1", 150, "dedupe_1", "9876")
+			},
+			wantPath: "/pots/pot_1/deposit",
+			wantForm: map[string]string{"source_account_id": "acc_1", "amount": "150", "dedupe_id": "dedupe_1"},
+		},
+		{
+			name: "Withdraw sends the destination account, amount and dedupe ID",
+			transfer: func(a *MonzoRestClient) (*PotResponse, error) {
+				return a.WithdrawFromPot(context.Background(), "pot_1", "acc_1", 150, "dedupe_2", "9876")
+			},
+			wantPath: "/pots/pot_1/withdraw",
+			wantForm: map[string]string{"destination_account_id": "acc_1", "amount": "150", "dedupe_id": "dedupe_2"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method != "PUT" || r.URL.Path != tt.wantPath || r.Header.Get("Authorization") != "Bearer 9876" {
+					http.Error(w, "wrong request", http.StatusBadRequest)
+					return
+				}
+				_ = r.ParseForm()
+				got := map[string]string{}
+				for key := range r.PostForm {
+					got[key] = r.PostForm.Get(key)
+				}
+				if !reflect.DeepEqual(got, tt.wantForm) {
+					t.Errorf("Form = %v, want %v", got, tt.wantForm)
+				}
+				_, _ = w.Write([]byte(`{"id": "pot_1", "name": "Savings", "balance": 1150}`))
+			}))
+			defer server.Close()
+
+			got, err := tt.transfer(CreateMonzoRestClient(server.URL, &http.Client{}))
+			if err != nil {
+				t.Fatalf("pot transfer error = %v", err)
+			}
+			if got.Id != "pot_1" || got.Balance != 1150 {
+				t.Errorf("pot transfer = %+v", got)
+			}
+		})
+	}
+}
+
+func TestPotDedupeId(t *testing.T) {
+	first := PotDedupeId("tx_1", "pot_1", "roundup")
+	if first != PotDedupeId("tx_1", "pot_1", "roundup") {
+		t.Error("PotDedupeId() is not deterministic")
+	}
+	if first == PotDedupeId("tx_2", "pot_1", "roundup") || first == PotDedupeId("tx_1", "pot_2", "roundup") {
+		t.Error("PotDedupeId() returned the same ID for a different transfer")
+	}
+	if PotDedupeId("a", "bc") == PotDedupeId("ab", "c") {
+		t.Error("PotDedupeId() parts are ambiguous")
+	}
+}
+
+func TestAPIError(t *testing.T) {
+	tests := []struct {
+		name                  string
+		status                int
+		retryAfter            string
+		body                  string
+		want                  APIError
+		wantUnauthorized      bool
+		wantRateLimited       bool
+		wantPermissionsDenied bool
+	}{
+		{
+			name:             "Monzo error body",
+			status:           http.StatusUnauthorized,
+			body:             `{"code":"unauthorized.bad_access_token","message":"Access token has expired"}`,
+			want:             APIError{StatusCode: 401, Code: "unauthorized.bad_access_token", Message: "Access token has expired", Method: "GET", Path: "/accounts"},
+			wantUnauthorized: true,
+		},
+		{
+			name:            "Rate limited with Retry-After in seconds",
+			status:          http.StatusTooManyRequests,
+			retryAfter:      "30",
+			body:            `{"code":"too_many_requests"}`,
+			want:            APIError{StatusCode: 429, Code: "too_many_requests", Method: "GET", Path: "/accounts", RetryAfter: 30 * time.Second},
+			wantRateLimited: true,
+		},
+		{
+			name:                  "Insufficient permissions",
+			status:                http.StatusForbidden,
+			body:                  `{"code":"forbidden.insufficient_permissions","message":"Access forbidden due to insufficient permissions"}`,
+			want:                  APIError{StatusCode: 403, Code: "forbidden.insufficient_permissions", Message: "Access forbidden due to insufficient permissions", Method: "GET", Path: "/accounts"},
+			wantPermissionsDenied: true,
+		},
+		{
+			name:   "Body that is not JSON",
+			status: http.StatusBadGateway,
+			body:   "upstream unavailable\n",
+			want:   APIError{StatusCode: 502, Message: "upstream unavailable", Method: "GET", Path: "/accounts"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tt.retryAfter != "" {
+					w.Header().Set("Retry-After", tt.retryAfter)
+				}
+				w.WriteHeader(tt.status)
+				_, _ = w.Write([]byte(tt.body))
+			}))
+			defer server.Close()
+
+			_, err := CreateMonzoRestClient(server.URL, &http.Client{}).WithRetries(NoRetries).processGetRequest(context.Background(), "/accounts", "token")
+			var apiErr *APIError
+			if !errors.As(err, &apiErr) {
+				t.Fatalf("processGetRequest() error = %v, want an *APIError", err)
+			}
+			if *apiErr != tt.want {
+				t.Errorf("processGetRequest() error = %+v, want %+v", *apiErr, tt.want)
+			}
+			if IsUnauthorized(err) != tt.wantUnauthorized || IsRateLimited(err) != tt.wantRateLimited || IsInsufficientPermissions(err) != tt.wantPermissionsDenied {
+				t.Errorf("IsUnauthorized, IsRateLimited, IsInsufficientPermissions = %v, %v, %v", IsUnauthorized(err), IsRateLimited(err), IsInsufficientPermissions(err))
+			}
+			if errors.Is(err, ErrAuthRejected) {
+				t.Error("An API call error matched ErrAuthRejected")
+			}
+		})
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2019, time.January, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name  string
+		value string
+		want  time.Duration
+	}{
+		{"Missing", "", 0},
+		{"Seconds", "120", 2 * time.Minute},
+		{"HTTP date", now.Add(time.Minute).Format(http.TimeFormat), time.Minute},
+		{"HTTP date in the past", now.Add(-time.Minute).Format(http.TimeFormat), 0},
+		{"Invalid", "soon", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseRetryAfter(tt.value, now); got != tt.want {
+				t.Errorf("parseRetryAfter(%q) = %v, want %v", tt.value, got, tt.want)
 			}
 		})
 	}
@@ -0,0 +1,515 @@
+package monzotest
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/tmilner/monzo-customisation/adapters/monzorestclient"
+)
+
+// apiError is the body Monzo sends with every error response.
+type apiError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (s *Server) routes() *mux.Router {
+	router := mux.NewRouter()
+	router.SkipClean(true)
+
+	router.HandleFunc("/auth", s.authorise).Methods("GET")
+	router.HandleFunc("/oauth2/token", s.token).Methods("POST")
+
+	api := router.NewRoute().Subrouter()
+	api.Use(s.authenticate)
+	api.HandleFunc("/ping/whoami", s.whoAmI).Methods("GET")
+	api.HandleFunc("/accounts", s.listAccounts).Methods("GET")
+	api.HandleFunc("/balance", s.balance).Methods("GET")
+	api.HandleFunc("/pots", s.listPots).Methods("GET")
+	api.HandleFunc("/pots/{potId}/deposit", s.depositIntoPot).Methods("PUT")
+	api.HandleFunc("/pots/{potId}/withdraw", s.withdrawFromPot).Methods("PUT")
+	api.HandleFunc("/transactions", s.listTransactions).Methods("GET")
+	api.HandleFunc("/transactions/{transactionId}", s.getTransaction).Methods("GET")
+	api.HandleFunc("/transactions/{transactionId}", s.updateTransaction).Methods("PATCH")
+	api.HandleFunc("/feed", s.createFeedItem).Methods("POST")
+	api.HandleFunc("/webhooks", s.registerWebhook).Methods("POST")
+	api.HandleFunc("/webhooks", s.listWebhooks).Methods("GET")
+	api.HandleFunc("/webhooks/{webhookId}", s.deleteWebhook).Methods("DELETE")
+
+	router.HandleFunc("/_fake/transactions", s.fakeTransaction).Methods("POST")
+	return router
+}
+
+func writeJson(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(value)
+}
+
+func writeError(w http.ResponseWriter, status int, code string, message string) {
+	writeJson(w, status, apiError{Code: code, Message: message})
+}
+
+type userIdKey struct{}
+
+// authenticate checks the bearer token, handlers find the user with requestUser.
+func (s *Server) authenticate(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		accessToken := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+
+		s.lock.Lock()
+		t, found := s.accessTokens[accessToken]
+		expired := found && !s.now().Before(t.expiresAt)
+		unapproved := found && s.unapproved[t.userId]
+		s.lock.Unlock()
+
+		switch {
+		case !found:
+			writeError(w, http.StatusUnauthorized, "unauthorized.bad_access_token", "Access token is not valid")
+		case expired:
+			writeError(w, http.StatusUnauthorized, "unauthorized.bad_access_token.expired", "Access token has expired")
+		case unapproved && r.URL.Path != "/ping/whoami":
+			writeError(w, http.StatusForbidden, "forbidden.insufficient_permissions", "Access has not been approved in the Monzo app")
+		default:
+			h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), userIdKey{}, t.userId)))
+		}
+	})
+}
+
+func requestUser(r *http.Request) string {
+	userId, _ := r.Context().Value(userIdKey{}).(string)
+	return userId
+}
+
+// authorise stands in for auth.monzo.com, it signs straight in as the auth user and redirects back with a code.
+func (s *Server) authorise(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if query.Get("client_id") != s.clientId {
+		writeError(w, http.StatusBadRequest, "bad_request.bad_client_id", "Unknown client")
+		return
+	}
+	redirect, err := url.Parse(query.Get("redirect_uri"))
+	if err != nil || redirect.Scheme == "" {
+		writeError(w, http.StatusBadRequest, "bad_request.bad_redirect_uri", "Redirect URI is not valid")
+		return
+	}
+
+	s.lock.Lock()
+	userId := s.authUser
+	code := s.id("code")
+	s.codes[code] = userId
+	s.lock.Unlock()
+
+	if userId == "" {
+		writeError(w, http.StatusBadRequest, "bad_request.no_users", "The fake has no users to sign in as")
+		return
+	}
+
+	values := redirect.Query()
+	values.Set("code", code)
+	values.Set("state", query.Get("state"))
+	redirect.RawQuery = values.Encode()
+	http.Redirect(w, r, redirect.String(), http.StatusFound)
+}
+
+func (s *Server) token(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writeError(w, http.StatusBadRequest, "bad_request", err.Error())
+		return
+	}
+	if r.PostForm.Get("client_id") != s.clientId ||
+		subtle.ConstantTimeCompare([]byte(r.PostForm.Get("client_secret")), []byte(s.clientSecret)) != 1 {
+		writeError(w, http.StatusUnauthorized, "unauthorized.bad_client", "Client credentials are not valid")
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var userId string
+	var found bool
+	switch r.PostForm.Get("grant_type") {
+	case "authorization_code":
+		code := r.PostForm.Get("code")
+		userId, found = s.codes[code]
+		delete(s.codes, code)
+	case "refresh_token":
+		refreshToken := r.PostForm.Get("refresh_token")
+		userId, found = s.refreshTokens[refreshToken]
+		delete(s.refreshTokens, refreshToken)
+	default:
+		writeError(w, http.StatusBadRequest, "bad_request.unsupported_grant_type", "Unsupported grant type")
+		return
+	}
+	if !found {
+		writeError(w, http.StatusUnauthorized, "unauthorized.bad_authorization_code", "Code or refresh token is not valid")
+		return
+	}
+
+	writeJson(w, http.StatusOK, s.issueToken(userId))
+}
+
+func (s *Server) whoAmI(w http.ResponseWriter, r *http.Request) {
+	writeJson(w, http.StatusOK, monzorestclient.WhoAmIResponse{
+		Authenticated: true,
+		ClientId:      s.clientId,
+		UserId:        requestUser(r),
+	})
+}
+
+func (s *Server) listAccounts(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	accounts := make([]monzorestclient.AccountResponse, 0)
+	if u, found := s.users[requestUser(r)]; found {
+		for _, id := range u.accounts {
+			accounts = append(accounts, s.accounts[id].response)
+		}
+	}
+	writeJson(w, http.StatusOK, map[string]interface{}{"accounts": accounts})
+}
+
+// userAccount finds an account the request's user owns, writing a not found error if there isn't one.
+func (s *Server) userAccount(w http.ResponseWriter, r *http.Request, accountId string) (*account, bool) {
+	acc, found := s.accounts[accountId]
+	if !found || acc.userId != requestUser(r) {
+		writeError(w, http.StatusNotFound, "not_found.account", "Account not found")
+		return nil, false
+	}
+	return acc, true
+}
+
+func (s *Server) balance(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	accountId := r.URL.Query().Get("account_id")
+	acc, found := s.userAccount(w, r, accountId)
+	if !found {
+		return
+	}
+
+	now := s.now()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	var spendToday int64
+	for _, transaction := range s.transactions {
+		if transaction.AccountId == accountId && transaction.Amount < 0 && transaction.Scheme != "uk_retail_pot" &&
+			transaction.DeclineReason == "" && !transaction.Created.Before(today) {
+			spendToday += transaction.Amount
+		}
+	}
+	total := acc.balance
+	for _, p := range s.pots {
+		if p.accountId == accountId && !p.response.Deleted {
+			total += p.response.Balance
+		}
+	}
+
+	writeJson(w, http.StatusOK, monzorestclient.BalanceResponse{
+		Balance:                   acc.balance,
+		TotalBalance:              total,
+		BalanceIncFlexibleSavings: total,
+		Currency:                  "GBP",
+		SpendToday:                spendToday,
+		LocalSpend:                []monzorestclient.LocalSpendResponse{},
+	})
+}
+
+func (s *Server) listPots(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	pots := make([]monzorestclient.PotResponse, 0)
+	for _, p := range s.pots {
+		if p.userId == requestUser(r) {
+			pots = append(pots, p.response)
+		}
+	}
+	sort.Slice(pots, func(i, j int) bool { return pots[i].Id < pots[j].Id })
+	writeJson(w, http.StatusOK, map[string]interface{}{"pots": pots})
+}
+
+func (s *Server) depositIntoPot(w http.ResponseWriter, r *http.Request) {
+	s.transferPot(w, r, "source_account_id", 1)
+}
+
+func (s *Server) withdrawFromPot(w http.ResponseWriter, r *http.Request) {
+	s.transferPot(w, r, "destination_account_id", -1)
+}
+
+func (s *Server) transferPot(w http.ResponseWriter, r *http.Request, accountField string, direction int64) {
+	if err := r.ParseForm(); err != nil {
+		writeError(w, http.StatusBadRequest, "bad_request", err.Error())
+		return
+	}
+	amount, err := strconv.ParseInt(r.PostForm.Get("amount"), 10, 64)
+	if err != nil || amount <= 0 {
+		writeError(w, http.StatusBadRequest, "bad_request.bad_param.amount", "Amount must be a positive number of pence")
+		return
+	}
+	if r.PostForm.Get("dedupe_id") == "" {
+		writeError(w, http.StatusBadRequest, "bad_request.missing_param.dedupe_id", "dedupe_id is required")
+		return
+	}
+
+	s.lock.Lock()
+	p, found := s.pots[mux.Vars(r)["potId"]]
+	if !found || p.userId != requestUser(r) {
+		s.lock.Unlock()
+		writeError(w, http.StatusNotFound, "not_found.pot", "Pot not found")
+		return
+	}
+	accountId := r.PostForm.Get(accountField)
+	transaction, err := s.potTransfer(p, accountId, amount*direction, r.PostForm.Get("dedupe_id"))
+	response := p.response
+	webhooks := s.accountWebhooks(accountId)
+	s.lock.Unlock()
+
+	switch err {
+	case nil:
+	case ErrInsufficientFunds:
+		writeError(w, http.StatusBadRequest, "bad_request.insufficient_funds", "Not enough money to move")
+		return
+	default:
+		writeError(w, http.StatusNotFound, "not_found.account", "Account not found")
+		return
+	}
+
+	writeJson(w, http.StatusOK, response)
+	if transaction != nil {
+		// Delivered in the background as the caller may be handling a webhook from this account already.
+		go s.deliver(transaction, webhooks)
+	}
+}
+
+func (s *Server) listTransactions(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	var before time.Time
+	if value := query.Get("before"); value != "" {
+		parsed, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "bad_request.bad_param.before", "before must be an RFC3339 timestamp")
+			return
+		}
+		before = parsed
+	}
+	limit := 100
+	if value := query.Get("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed <= 0 || parsed > 100 {
+			writeError(w, http.StatusBadRequest, "bad_request.bad_param.limit", "limit must be between 1 and 100")
+			return
+		}
+		limit = parsed
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	accountId := query.Get("account_id")
+	if _, found := s.userAccount(w, r, accountId); !found {
+		return
+	}
+
+	transactions := make([]monzorestclient.TransactionDetailsResponse, 0)
+	for _, transaction := range s.transactions {
+		if transaction.AccountId == accountId {
+			transactions = append(transactions, *transaction)
+		}
+	}
+	sort.Slice(transactions, func(i, j int) bool {
+		if transactions[i].Created.Equal(transactions[j].Created) {
+			return transactions[i].Id < transactions[j].Id
+		}
+		return transactions[i].Created.Before(transactions[j].Created)
+	})
+
+	start := 0
+	if since := query.Get("since"); since != "" {
+		if sinceTime, err := time.Parse(time.RFC3339, since); err == nil {
+			for start < len(transactions) && transactions[start].Created.Before(sinceTime) {
+				start++
+			}
+		} else {
+			for index, transaction := range transactions {
+				if transaction.Id == since {
+					start = index + 1
+					break
+				}
+			}
+		}
+	}
+
+	result := make([]monzorestclient.TransactionDetailsResponse, 0)
+	for _, transaction := range transactions[start:] {
+		if !before.IsZero() && !transaction.Created.Before(before) {
+			break
+		}
+		if len(result) == limit {
+			break
+		}
+		result = append(result, transaction)
+	}
+	writeJson(w, http.StatusOK, map[string]interface{}{"transactions": result})
+}
+
+// userTransaction finds a transaction on one of the request user's accounts, writing a not found error if there isn't one.
+func (s *Server) userTransaction(w http.ResponseWriter, r *http.Request) (*monzorestclient.TransactionDetailsResponse, bool) {
+	transaction, found := s.transactions[mux.Vars(r)["transactionId"]]
+	if !found || s.accounts[transaction.AccountId].userId != requestUser(r) {
+		writeError(w, http.StatusNotFound, "not_found.transaction", "Transaction not found")
+		return nil, false
+	}
+	return transaction, true
+}
+
+func (s *Server) getTransaction(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if transaction, found := s.userTransaction(w, r); found {
+		writeJson(w, http.StatusOK, map[string]interface{}{"transaction": transaction})
+	}
+}
+
+// updateTransaction applies metadata[key]=value form fields, "notes" sets the notes and an empty value deletes the key.
+func (s *Server) updateTransaction(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writeError(w, http.StatusBadRequest, "bad_request", err.Error())
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	transaction, found := s.userTransaction(w, r)
+	if !found {
+		return
+	}
+
+	for field, values := range r.PostForm {
+		if !strings.HasPrefix(field, "metadata[") || !strings.HasSuffix(field, "]") {
+			continue
+		}
+		key := strings.TrimSuffix(strings.TrimPrefix(field, "metadata["), "]")
+		value := values[0]
+
+		if key == "notes" {
+			transaction.Notes = value
+			continue
+		}
+		if transaction.Metadata == nil {
+			transaction.Metadata = map[string]string{}
+		}
+		if value == "" {
+			delete(transaction.Metadata, key)
+		} else {
+			transaction.Metadata[key] = value
+		}
+	}
+	writeJson(w, http.StatusOK, map[string]interface{}{"transaction": transaction})
+}
+
+func (s *Server) createFeedItem(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writeError(w, http.StatusBadRequest, "bad_request", err.Error())
+		return
+	}
+	if r.PostForm.Get("params[title]") == "" {
+		writeError(w, http.StatusBadRequest, "bad_request.missing_param.title", "params[title] is required")
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, found := s.userAccount(w, r, r.PostForm.Get("account_id")); !found {
+		return
+	}
+	s.feed = append(s.feed, monzorestclient.FeedItem{
+		AccountId: r.PostForm.Get("account_id"),
+		TypeParam: r.PostForm.Get("type"),
+		Url:       r.PostForm.Get("url"),
+		Params: &monzorestclient.Params{
+			Title:    r.PostForm.Get("params[title]"),
+			Body:     r.PostForm.Get("params[body]"),
+			ImageUrl: r.PostForm.Get("params[image_url]"),
+		},
+	})
+	writeJson(w, http.StatusOK, map[string]interface{}{})
+}
+
+func (s *Server) registerWebhook(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writeError(w, http.StatusBadRequest, "bad_request", err.Error())
+		return
+	}
+	if parsed, err := url.Parse(r.PostForm.Get("url")); err != nil || parsed.Scheme == "" || parsed.Host == "" {
+		writeError(w, http.StatusBadRequest, "bad_request.bad_param.url", "url must be absolute")
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	accountId := r.PostForm.Get("account_id")
+	if _, found := s.userAccount(w, r, accountId); !found {
+		return
+	}
+	webhook := &Webhook{Id: s.id("webhook"), AccountId: accountId, Url: r.PostForm.Get("url")}
+	s.webhooks[webhook.Id] = webhook
+	writeJson(w, http.StatusOK, map[string]interface{}{"webhook": webhook})
+}
+
+func (s *Server) listWebhooks(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	accountId := r.URL.Query().Get("account_id")
+	if _, found := s.userAccount(w, r, accountId); !found {
+		return
+	}
+	writeJson(w, http.StatusOK, map[string]interface{}{"webhooks": s.accountWebhooks(accountId)})
+}
+
+func (s *Server) deleteWebhook(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	webhook, found := s.webhooks[mux.Vars(r)["webhookId"]]
+	if !found || s.accounts[webhook.AccountId].userId != requestUser(r) {
+		writeError(w, http.StatusNotFound, "not_found.webhook", "Webhook not found")
+		return
+	}
+	delete(s.webhooks, webhook.Id)
+	writeJson(w, http.StatusOK, map[string]interface{}{})
+}
+
+// fakeTransaction lets local development create a transaction, and trigger its webhooks, by posting
+// the transaction as JSON. It is not part of the Monzo API and needs no token.
+func (s *Server) fakeTransaction(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	var transaction monzorestclient.TransactionDetailsResponse
+	if err := json.NewDecoder(r.Body).Decode(&transaction); err != nil {
+		writeError(w, http.StatusBadRequest, "bad_request", err.Error())
+		return
+	}
+
+	created, err := s.CreateTransaction(transaction)
+	if err != nil {
+		writeError(w, http.StatusNotFound, "not_found.account", "Account not found")
+		return
+	}
+	writeJson(w, http.StatusOK, map[string]interface{}{"transaction": created})
+}
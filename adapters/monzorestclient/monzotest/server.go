@@ -0,0 +1,438 @@
+// Package monzotest provides an in-memory fake of the Monzo API for tests and local development.
+//
+// A Server keeps users, accounts, pots, transactions, feed items and webhooks in memory and serves them
+// in the same shape as the real API, so a MonzoRestClient pointed at it behaves as it would against Monzo.
+// Creating a transaction, directly or through a pot transfer, posts a transaction.created webhook to every
+// webhook registered on the account. Webhooks for transactions created with CreateTransaction are posted
+// before it returns, those for pot transfers made through the API are posted in the background.
+package monzotest
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/tmilner/monzo-customisation/adapters/monzorestclient"
+)
+
+const DefaultTokenLifetime = 6 * time.Hour
+
+var (
+	ErrNotFound          = errors.New("not found")
+	ErrInsufficientFunds = errors.New("insufficient funds")
+)
+
+// Webhook is a webhook registered through the API.
+type Webhook struct {
+	Id        string `json:"id"`
+	AccountId string `json:"account_id"`
+	Url       string `json:"url"`
+}
+
+// Delivery records one attempt to post a webhook. Status is zero if the request failed outright.
+type Delivery struct {
+	WebhookId     string
+	Url           string
+	TransactionId string
+	Status        int
+	Err           error
+}
+
+type user struct {
+	id       string
+	accounts []string
+}
+
+type account struct {
+	response monzorestclient.AccountResponse
+	userId   string
+	balance  int64
+}
+
+type pot struct {
+	response  monzorestclient.PotResponse
+	userId    string
+	accountId string
+}
+
+type token struct {
+	userId    string
+	expiresAt time.Time
+}
+
+type Server struct {
+	clientId      string
+	clientSecret  string
+	tokenLifetime time.Duration
+	now           func() time.Time
+	webhookClient *http.Client
+	router        *mux.Router
+
+	lock          sync.Mutex
+	nextId        int
+	authUser      string
+	users         map[string]*user
+	accounts      map[string]*account
+	pots          map[string]*pot
+	transactions  map[string]*monzorestclient.TransactionDetailsResponse
+	feed          []monzorestclient.FeedItem
+	webhooks      map[string]*Webhook
+	deliveries    []Delivery
+	accessTokens  map[string]*token
+	refreshTokens map[string]string
+	codes         map[string]string
+	dedupeIds     map[string]bool
+	unapproved    map[string]bool
+}
+
+// CreateServer returns an empty fake that only accepts the given OAuth client. Serve it with
+// httptest.NewServer or http.ListenAndServe and point the rest client at its URL followed by a slash.
+func CreateServer(clientId string, clientSecret string) *Server {
+	s := &Server{
+		clientId:      clientId,
+		clientSecret:  clientSecret,
+		tokenLifetime: DefaultTokenLifetime,
+		now:           time.Now,
+		webhookClient: &http.Client{Timeout: 10 * time.Second},
+		users:         map[string]*user{},
+		accounts:      map[string]*account{},
+		pots:          map[string]*pot{},
+		transactions:  map[string]*monzorestclient.TransactionDetailsResponse{},
+		webhooks:      map[string]*Webhook{},
+		accessTokens:  map[string]*token{},
+		refreshTokens: map[string]string{},
+		codes:         map[string]string{},
+		dedupeIds:     map[string]bool{},
+		unapproved:    map[string]bool{},
+	}
+	s.router = s.routes()
+	return s
+}
+
+// SetClock replaces time.Now for token expiry and transaction timestamps.
+func (s *Server) SetClock(now func() time.Time) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.now = now
+}
+
+func (s *Server) SetTokenLifetime(lifetime time.Duration) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.tokenLifetime = lifetime
+}
+
+// SetAuthUser picks the user the fake login page signs in as, by default the first user added.
+func (s *Server) SetAuthUser(userId string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.authUser = userId
+}
+
+// RequireApproval makes the user's tokens useless for anything but whoami until Approve is called, as
+// Monzo does until the user approves access in the app after signing in.
+func (s *Server) RequireApproval(userId string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.unapproved[userId] = true
+}
+
+// Approve grants the user's tokens their permissions, as approving access in the Monzo app does.
+func (s *Server) Approve(userId string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.unapproved, userId)
+}
+
+// AddAccount creates the account, and its user if this is the user's first account.
+func (s *Server) AddAccount(userId string, accountId string, accountType string, balance int64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	u, found := s.users[userId]
+	if !found {
+		u = &user{id: userId}
+		s.users[userId] = u
+		if s.authUser == "" {
+			s.authUser = userId
+		}
+	}
+	u.accounts = append(u.accounts, accountId)
+
+	s.accounts[accountId] = &account{
+		response: monzorestclient.AccountResponse{
+			Id:          accountId,
+			Description: userId,
+			Created:     s.now().UTC().Format(time.RFC3339),
+			Type:        accountType,
+			Owners:      []monzorestclient.OwnersResponse{{UserId: userId, PreferredName: userId, PreferredFirstName: userId}},
+		},
+		userId:  userId,
+		balance: balance,
+	}
+}
+
+// AddPot creates a pot belonging to the account's owner.
+func (s *Server) AddPot(accountId string, potId string, name string, balance int64) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	acc, found := s.accounts[accountId]
+	if !found {
+		return ErrNotFound
+	}
+	now := s.now()
+	s.pots[potId] = &pot{
+		response: monzorestclient.PotResponse{
+			Id:       potId,
+			Name:     name,
+			Style:    "beach_ball",
+			Balance:  balance,
+			Currency: "GBP",
+			Created:  now,
+			Updated:  now,
+		},
+		userId:    acc.userId,
+		accountId: accountId,
+	}
+	return nil
+}
+
+// IssueToken skips the OAuth flow and returns a token for the user straight away.
+func (s *Server) IssueToken(userId string) *monzorestclient.AuthResponse {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.issueToken(userId)
+}
+
+func (s *Server) issueToken(userId string) *monzorestclient.AuthResponse {
+	accessToken := s.id("access")
+	refreshToken := s.id("refresh")
+	s.accessTokens[accessToken] = &token{userId: userId, expiresAt: s.now().Add(s.tokenLifetime)}
+	s.refreshTokens[refreshToken] = userId
+
+	return &monzorestclient.AuthResponse{
+		AccessToken:  accessToken,
+		ClientId:     s.clientId,
+		Expiry:       int32(s.tokenLifetime / time.Second),
+		RefreshToken: refreshToken,
+		TokenType:    "Bearer",
+		UserId:       userId,
+	}
+}
+
+// ExpireTokens makes every access token issued so far invalid, as if they had all timed out.
+func (s *Server) ExpireTokens() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, t := range s.accessTokens {
+		t.expiresAt = time.Time{}
+	}
+}
+
+// CreateTransaction adds the transaction to its account, filling in the ID, creation time and currency if
+// they are missing, moves the balance and posts a webhook to every webhook registered on the account.
+func (s *Server) CreateTransaction(transaction monzorestclient.TransactionDetailsResponse) (*monzorestclient.TransactionDetailsResponse, error) {
+	s.lock.Lock()
+	created, err := s.createTransaction(transaction)
+	webhooks := s.accountWebhooks(transaction.AccountId)
+	s.lock.Unlock()
+
+	if err != nil {
+		return nil, err
+	}
+	s.deliver(created, webhooks)
+	return created, nil
+}
+
+func (s *Server) createTransaction(transaction monzorestclient.TransactionDetailsResponse) (*monzorestclient.TransactionDetailsResponse, error) {
+	acc, found := s.accounts[transaction.AccountId]
+	if !found {
+		return nil, ErrNotFound
+	}
+
+	if transaction.Id == "" {
+		transaction.Id = s.id("tx")
+	}
+	if transaction.Created.IsZero() {
+		transaction.Created = s.now().UTC()
+	}
+	if transaction.Currency == "" {
+		transaction.Currency = "GBP"
+	}
+	if transaction.Category == "" {
+		transaction.Category = "general"
+	}
+	if transaction.DeclineReason == "" {
+		acc.balance += transaction.Amount
+	}
+	transaction.AccountBalance = acc.balance
+
+	s.transactions[transaction.Id] = &transaction
+	return copyTransaction(&transaction), nil
+}
+
+// copyTransaction returns a copy that can be used without the lock, metadata included.
+func copyTransaction(transaction *monzorestclient.TransactionDetailsResponse) *monzorestclient.TransactionDetailsResponse {
+	copied := *transaction
+	if transaction.Metadata != nil {
+		copied.Metadata = make(map[string]string, len(transaction.Metadata))
+		for key, value := range transaction.Metadata {
+			copied.Metadata[key] = value
+		}
+	}
+	return &copied
+}
+
+func (s *Server) accountWebhooks(accountId string) []Webhook {
+	result := make([]Webhook, 0)
+	for _, webhook := range s.webhooks {
+		if webhook.AccountId == accountId {
+			result = append(result, *webhook)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Id < result[j].Id })
+	return result
+}
+
+// deliver posts the webhooks one after another, so by the time CreateTransaction returns every webhook
+// has been handled or has failed.
+func (s *Server) deliver(transaction *monzorestclient.TransactionDetailsResponse, webhooks []Webhook) {
+	body, _ := json.Marshal(map[string]interface{}{
+		"type": "transaction.created",
+		"data": transaction,
+	})
+
+	for _, webhook := range webhooks {
+		delivery := Delivery{WebhookId: webhook.Id, Url: webhook.Url, TransactionId: transaction.Id}
+		res, err := s.webhookClient.Post(webhook.Url, "application/json", bytes.NewReader(body))
+		if err != nil {
+			delivery.Err = err
+		} else {
+			delivery.Status = res.StatusCode
+			_ = res.Body.Close()
+		}
+
+		s.lock.Lock()
+		s.deliveries = append(s.deliveries, delivery)
+		s.lock.Unlock()
+	}
+}
+
+func (s *Server) Deliveries() []Delivery {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]Delivery{}, s.deliveries...)
+}
+
+func (s *Server) FeedItems(accountId string) []monzorestclient.FeedItem {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	result := make([]monzorestclient.FeedItem, 0)
+	for _, item := range s.feed {
+		if item.AccountId == accountId {
+			result = append(result, item)
+		}
+	}
+	return result
+}
+
+func (s *Server) Webhooks(accountId string) []Webhook {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.accountWebhooks(accountId)
+}
+
+func (s *Server) Transaction(transactionId string) (*monzorestclient.TransactionDetailsResponse, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	transaction, found := s.transactions[transactionId]
+	if !found {
+		return nil, ErrNotFound
+	}
+	return copyTransaction(transaction), nil
+}
+
+func (s *Server) Balance(accountId string) (int64, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	acc, found := s.accounts[accountId]
+	if !found {
+		return 0, ErrNotFound
+	}
+	return acc.balance, nil
+}
+
+func (s *Server) PotBalance(potId string) (int64, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	p, found := s.pots[potId]
+	if !found {
+		return 0, ErrNotFound
+	}
+	return p.response.Balance, nil
+}
+
+// potTransfer moves amount from the account into the pot, or out of it when amount is negative, and records
+// the matching transaction on the account. A dedupe ID that has been seen before moves nothing.
+func (s *Server) potTransfer(p *pot, accountId string, amount int64, dedupeId string) (*monzorestclient.TransactionDetailsResponse, error) {
+	key := p.response.Id + "/" + dedupeId
+	if dedupeId != "" && s.dedupeIds[key] {
+		return nil, nil
+	}
+
+	acc, found := s.accounts[accountId]
+	if !found || acc.userId != p.userId {
+		return nil, ErrNotFound
+	}
+	if amount > 0 && acc.balance < amount {
+		return nil, ErrInsufficientFunds
+	}
+	if amount < 0 && p.response.Balance < -amount {
+		return nil, ErrInsufficientFunds
+	}
+
+	if dedupeId != "" {
+		s.dedupeIds[key] = true
+	}
+	p.response.Balance += amount
+	p.response.Updated = s.now()
+
+	metadata := map[string]string{"pot_id": p.response.Id}
+	if amount > 0 {
+		metadata["pot_deposit_id"] = s.id("potdep")
+	} else {
+		metadata["pot_withdrawal_id"] = s.id("potwd")
+	}
+	return s.createTransaction(monzorestclient.TransactionDetailsResponse{
+		AccountId:   accountId,
+		Amount:      -amount,
+		Description: p.response.Id,
+		Scheme:      "uk_retail_pot",
+		Settled:     s.now().UTC().Format(time.RFC3339),
+		Metadata:    metadata,
+	})
+}
+
+func (s *Server) id(prefix string) string {
+	s.nextId++
+	return fmt.Sprintf("%s_%010d", prefix, s.nextId)
+}
+
+// ServeHTTP cleans the path before routing. The rest client joins a base URL ending in a slash to paths
+// starting with one, and letting the router redirect to the clean path would turn a PUT into a GET.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	r.URL.Path = path.Clean("/" + r.URL.Path)
+	s.router.ServeHTTP(w, r)
+}
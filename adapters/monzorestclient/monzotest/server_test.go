@@ -0,0 +1,252 @@
+package monzotest
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tmilner/monzo-customisation/adapters/monzorestclient"
+)
+
+func createTestServer(t *testing.T) (*Server, *monzorestclient.MonzoRestClient, *httptest.Server) {
+	fake := CreateServer("client", "secret")
+	fake.AddAccount("user_1", "acc_1", "uk_retail", 10000)
+	fake.AddAccount("user_2", "acc_2", "uk_retail", 500)
+	if err := fake.AddPot("acc_1", "pot_1", "Savings", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(fake)
+	client := monzorestclient.CreateMonzoRestClient(server.URL+"/", &http.Client{})
+	return fake, client, server
+}
+
+func TestServer_OAuth(t *testing.T) {
+	fake, client, server := createTestServer(t)
+	defer server.Close()
+
+	noRedirect := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	res, err := noRedirect.Get(server.URL + "/auth/?client_id=client&redirect_uri=" + url.QueryEscape("http://localhost/auth_return") + "&response_type=code&state=abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	location, _ := url.Parse(res.Header.Get("Location"))
+	if res.StatusCode != http.StatusFound || location.Query().Get("state") != "abc" {
+		t.Fatalf("Login = %s to %s, want a redirect carrying the state", res.Status, location)
+	}
+
+	auth, err := client.Authenticate(context.Background(), location.Query().Get("code"), "client", "secret", "http://localhost/auth_return")
+	if err != nil || auth.UserId != "user_1" {
+		t.Fatalf("Authenticate() = %+v, %v", auth, err)
+	}
+	if _, err = client.Authenticate(context.Background(), location.Query().Get("code"), "client", "secret", "http://localhost/auth_return"); !errors.Is(err, monzorestclient.ErrAuthRejected) {
+		t.Errorf("Authenticate() with a used code error = %v, want %v", err, monzorestclient.ErrAuthRejected)
+	}
+
+	refreshed, err := client.RefreshAuth(context.Background(), auth.RefreshToken, "client", "secret")
+	if err != nil || refreshed.AccessToken == auth.AccessToken {
+		t.Fatalf("RefreshAuth() = %+v, %v, want a new access token", refreshed, err)
+	}
+	if _, err = client.RefreshAuth(context.Background(), auth.RefreshToken, "client", "secret"); !errors.Is(err, monzorestclient.ErrAuthRejected) {
+		t.Errorf("RefreshAuth() with a used refresh token error = %v, want %v", err, monzorestclient.ErrAuthRejected)
+	}
+
+	whoAmI, err := client.WhoAmI(context.Background(), refreshed.AccessToken)
+	if err != nil || !whoAmI.Authenticated || whoAmI.UserId != "user_1" {
+		t.Errorf("WhoAmI() = %+v, %v", whoAmI, err)
+	}
+
+	fake.ExpireTokens()
+	if _, err = client.WhoAmI(context.Background(), refreshed.AccessToken); err == nil {
+		t.Error("WhoAmI() with an expired token should fail")
+	}
+}
+
+func TestServer_Accounts(t *testing.T) {
+	fake, client, server := createTestServer(t)
+	defer server.Close()
+	token := fake.IssueToken("user_1").AccessToken
+
+	accounts, err := client.ListAccounts(context.Background(), token)
+	if err != nil || len(accounts.Accounts) != 1 || accounts.Accounts[0].Id != "acc_1" {
+		t.Fatalf("ListAccounts() = %+v, %v, want only the user's own account", accounts, err)
+	}
+
+	if _, err = client.GetBalance(context.Background(), "acc_2", token); err == nil {
+		t.Error("GetBalance() for another user's account should fail")
+	}
+
+	fake.RequireApproval("user_1")
+	if _, err = client.ListAccounts(context.Background(), token); !monzorestclient.IsInsufficientPermissions(err) {
+		t.Errorf("ListAccounts() before approval error = %v, want insufficient permissions", err)
+	}
+	if whoAmI, err := client.WhoAmI(context.Background(), token); err != nil || !whoAmI.Authenticated {
+		t.Errorf("WhoAmI() before approval = %+v, %v", whoAmI, err)
+	}
+	fake.Approve("user_1")
+	if _, err = client.ListAccounts(context.Background(), token); err != nil {
+		t.Errorf("ListAccounts() after approval error = %v", err)
+	}
+}
+
+func TestServer_Pots(t *testing.T) {
+	fake, client, server := createTestServer(t)
+	defer server.Close()
+	token := fake.IssueToken("user_1").AccessToken
+
+	for i := 0; i < 2; i++ {
+		pot, err := client.DepositIntoPot(context.Background(), "pot_1", "acc_1", 2500, "deposit-1", token)
+		if err != nil || pot.Balance != 2500 {
+			t.Fatalf("DepositIntoPot() attempt %d = %+v, %v, want the deposit made once", i, pot, err)
+		}
+	}
+	if _, err := client.WithdrawFromPot(context.Background(), "pot_1", "acc_1", 1000, "withdraw-1", token); err != nil {
+		t.Fatalf("WithdrawFromPot() error = %v", err)
+	}
+	if _, err := client.WithdrawFromPot(context.Background(), "pot_1", "acc_1", 5000, "withdraw-2", token); err == nil {
+		t.Error("WithdrawFromPot() for more than the pot holds should fail")
+	}
+
+	balance, err := client.GetBalance(context.Background(), "acc_1", token)
+	if err != nil || balance.Balance != 8500 || balance.TotalBalance != 10000 {
+		t.Errorf("GetBalance() = %+v, %v, want 8500 in the account and 10000 with pots", balance, err)
+	}
+
+	pots, err := client.GetPots(context.Background(), token)
+	if err != nil || len(pots.Pots) != 1 || pots.Pots[0].Balance != 1500 {
+		t.Errorf("GetPots() = %+v, %v", pots, err)
+	}
+
+	transactions, err := client.ListTransactions(context.Background(), "acc_1", token, monzorestclient.TransactionsQuery{})
+	if err != nil || len(transactions.Transactions) != 2 {
+		t.Fatalf("ListTransactions() = %+v, %v, want a transaction for each transfer", transactions, err)
+	}
+	if deposit := transactions.Transactions[0]; deposit.Amount != -2500 || deposit.Scheme != "uk_retail_pot" || deposit.Metadata["pot_id"] != "pot_1" {
+		t.Errorf("Deposit transaction = %+v", deposit)
+	}
+}
+
+func TestServer_Transactions(t *testing.T) {
+	fake, client, server := createTestServer(t)
+	defer server.Close()
+	token := fake.IssueToken("user_1").AccessToken
+
+	start := time.Date(2019, time.March, 12, 9, 0, 0, 0, time.UTC)
+	for i := 0; i < 5; i++ {
+		if _, err := fake.CreateTransaction(monzorestclient.TransactionDetailsResponse{
+			AccountId: "acc_1",
+			Amount:    -100,
+			Created:   start.Add(time.Duration(i) * time.Hour),
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	it := client.IterateTransactions(context.Background(), "acc_1", func() string { return token }, monzorestclient.TransactionsQuery{Limit: 2, Before: start.Add(4 * time.Hour)})
+	count := 0
+	for it.Next() {
+		count++
+	}
+	if it.Err() != nil || count != 4 {
+		t.Errorf("IterateTransactions() walked %d transactions, %v, want 4", count, it.Err())
+	}
+
+	updated, err := client.UpdateTransaction(context.Background(), it.Cursor(), token, map[string]string{"notes": "#coffee", "rule": "coffee"})
+	if err != nil || updated.Notes != "#coffee" || updated.Metadata["rule"] != "coffee" {
+		t.Errorf("UpdateTransaction() = %+v, %v", updated, err)
+	}
+
+	fetched, err := client.GetTransaction(context.Background(), it.Cursor(), token)
+	if err != nil || fetched.Id != it.Cursor() || fetched.AccountId != "acc_1" || fetched.Notes != "#coffee" {
+		t.Errorf("GetTransaction() = %+v, %v", fetched, err)
+	}
+	if _, err := client.GetTransaction(context.Background(), it.Cursor(), fake.IssueToken("user_2").AccessToken); !monzorestclient.IsNotFound(err) {
+		t.Errorf("GetTransaction() with another user's token error = %v, want not found", err)
+	}
+	if _, err := client.GetTransaction(context.Background(), "tx_missing", token); !monzorestclient.IsNotFound(err) {
+		t.Errorf("GetTransaction() of a missing transaction error = %v, want not found", err)
+	}
+
+	if balance, _ := fake.Balance("acc_1"); balance != 9500 {
+		t.Errorf("Balance() = %d, want 9500", balance)
+	}
+}
+
+func TestServer_Webhooks(t *testing.T) {
+	fake, client, server := createTestServer(t)
+	defer server.Close()
+	token := fake.IssueToken("user_1").AccessToken
+
+	var lock sync.Mutex
+	received := make([]string, 0)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var webhook struct {
+			Type string                                     `json:"type"`
+			Data monzorestclient.TransactionDetailsResponse `json:"data"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&webhook)
+		lock.Lock()
+		received = append(received, webhook.Type+" "+webhook.Data.Id)
+		lock.Unlock()
+	}))
+	defer receiver.Close()
+
+	if err := client.RegisterWebhook(context.Background(), "acc_1", token, receiver.URL); err != nil {
+		t.Fatalf("RegisterWebhook() error = %v", err)
+	}
+	if err := client.RegisterWebhook(context.Background(), "acc_2", token, receiver.URL); err == nil {
+		t.Error("RegisterWebhook() on another user's account should fail")
+	}
+	if err := client.RegisterWebhook(context.Background(), "acc_1", token, "https://old.example.com/webhook"); err != nil {
+		t.Fatalf("RegisterWebhook() error = %v", err)
+	}
+
+	webhooks, err := client.ListWebhooks(context.Background(), "acc_1", token)
+	if err != nil || len(webhooks.Webhooks) != 2 {
+		t.Fatalf("ListWebhooks() = %+v, %v, want both webhooks", webhooks, err)
+	}
+	for _, webhook := range webhooks.Webhooks {
+		if webhook.Url != receiver.URL {
+			if err := client.DeleteWebhook(context.Background(), webhook.Id, token); err != nil {
+				t.Fatalf("DeleteWebhook() error = %v", err)
+			}
+			if err := client.DeleteWebhook(context.Background(), webhook.Id, token); !monzorestclient.IsNotFound(err) {
+				t.Errorf("DeleteWebhook() twice error = %v, want not found", err)
+			}
+		}
+	}
+	if _, err := client.ListWebhooks(context.Background(), "acc_2", token); err == nil {
+		t.Error("ListWebhooks() on another user's account should fail")
+	}
+	if remaining := fake.Webhooks("acc_1"); len(remaining) != 1 || remaining[0].Url != receiver.URL {
+		t.Errorf("Webhooks() after delete = %+v", remaining)
+	}
+
+	transaction, err := fake.CreateTransaction(monzorestclient.TransactionDetailsResponse{AccountId: "acc_1", Amount: -350, Description: "Pret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = fake.CreateTransaction(monzorestclient.TransactionDetailsResponse{AccountId: "acc_2", Amount: -100}); err != nil {
+		t.Fatal(err)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	if len(received) != 1 || received[0] != "transaction.created "+transaction.Id {
+		t.Errorf("Received webhooks = %v, want one for %s", received, transaction.Id)
+	}
+	if deliveries := fake.Deliveries(); len(deliveries) != 1 || deliveries[0].Status != http.StatusOK {
+		t.Errorf("Deliveries() = %+v", deliveries)
+	}
+
+	err = client.CreateFeedItem(context.Background(), &monzorestclient.FeedItem{AccountId: "acc_1", Url: "https://monzo.example.com/", Params: &monzorestclient.Params{Title: "Hello"}}, token)
+	if items := fake.FeedItems("acc_1"); err != nil || len(items) != 1 || items[0].Params.Title != "Hello" || items[0].Url != "https://monzo.example.com/" {
+		t.Errorf("FeedItems() = %+v, %v", items, err)
+	}
+}
@@ -1,7 +1,13 @@
 package monzorestclient
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"net/url"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -19,8 +25,8 @@ type PotResponse struct {
 	Deleted  bool      `json:"deleted"`
 }
 
-func (a *MonzoRestClient) GetPots(authToken string) (*PotsResponse, error) {
-	body, err := a.processGetRequest("/pots", authToken)
+func (a *MonzoRestClient) GetPots(ctx context.Context, authToken string) (*PotsResponse, error) {
+	body, err := a.processGetRequest(ctx, "/pots", authToken)
 	if err != nil {
 		return nil, err
 	}
@@ -30,3 +36,44 @@ func (a *MonzoRestClient) GetPots(authToken string) (*PotsResponse, error) {
 
 	return result, err
 }
+
+// DepositIntoPot moves amount pence from the account into the pot. Monzo ignores repeated requests with the
+// same dedupeId, so retries must reuse it.
+func (a *MonzoRestClient) DepositIntoPot(ctx context.Context, potId string, sourceAccountId string, amount int64, dedupeId string, authToken string) (*PotResponse, error) {
+	form := url.Values{}
+	form.Add("source_account_id", sourceAccountId)
+	form.Add("amount", strconv.FormatInt(amount, 10))
+	form.Add("dedupe_id", dedupeId)
+
+	return a.potTransfer(ctx, "/pots/"+potId+"/deposit", form, authToken)
+}
+
+// WithdrawFromPot moves amount pence out of the pot into the account, see DepositIntoPot for dedupeId.
+func (a *MonzoRestClient) WithdrawFromPot(ctx context.Context, potId string, destinationAccountId string, amount int64, dedupeId string, authToken string) (*PotResponse, error) {
+	form := url.Values{}
+	form.Add("destination_account_id", destinationAccountId)
+	form.Add("amount", strconv.FormatInt(amount, 10))
+	form.Add("dedupe_id", dedupeId)
+
+	return a.potTransfer(ctx, "/pots/"+potId+"/withdraw", form, authToken)
+}
+
+func (a *MonzoRestClient) potTransfer(ctx context.Context, path string, form url.Values, authToken string) (*PotResponse, error) {
+	body, err := a.processPutRequest(ctx, path, authToken, form)
+	if err != nil {
+		return nil, err
+	}
+
+	var result PotResponse
+	err = json.Unmarshal(body, &result)
+
+	return &result, err
+}
+
+// PotDedupeId derives a dedupe ID for a pot transfer from whatever triggered it, typically a transaction ID
+// and the reason for the transfer. The same inputs always give the same ID so a retried webhook cannot
+// move money twice.
+func PotDedupeId(parts ...string) string {
+	sum := sha256.Sum256([]byte(strings.Join(parts, "\x00")))
+	return hex.EncodeToString(sum[:16])
+}
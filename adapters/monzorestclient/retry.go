@@ -0,0 +1,164 @@
+package monzorestclient
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultRateLimit = 5.0
+	DefaultRateBurst = 10
+)
+
+// RetryPolicy says how a failed call is retried. Calls are retried after a connection error, a 429 or a
+// 5xx, waiting a random time up to MinBackoff doubled for each attempt and capped at MaxBackoff, or for as
+// long as Monzo's Retry-After asks if that is longer.
+type RetryPolicy struct {
+	MaxAttempts int
+	MinBackoff  time.Duration
+	MaxBackoff  time.Duration
+	// RetryAll retries calls that are not idempotent too, which may repeat their effect.
+	RetryAll bool
+}
+
+var DefaultRetryPolicy = RetryPolicy{MaxAttempts: 4, MinBackoff: 200 * time.Millisecond, MaxBackoff: 10 * time.Second}
+
+// NoRetries makes every call one-shot.
+var NoRetries = RetryPolicy{MaxAttempts: 1}
+
+type callOptions struct {
+	policy     RetryPolicy
+	idempotent bool
+}
+
+// CallOption overrides how calls are made, see MonzoRestClient.With.
+type CallOption func(options *callOptions)
+
+// WithRetryPolicy replaces the client's retry policy.
+func WithRetryPolicy(policy RetryPolicy) CallOption {
+	return func(options *callOptions) {
+		options.policy = policy
+	}
+}
+
+// Idempotent marks calls as safe to repeat so they are retried whatever their method.
+func Idempotent() CallOption {
+	return func(options *callOptions) {
+		options.idempotent = true
+	}
+}
+
+// With returns a client sharing this one's connections and rate limit that makes its calls with the options.
+func (a *MonzoRestClient) With(opts ...CallOption) *MonzoRestClient {
+	copied := *a
+	copied.opts = append(append([]CallOption{}, a.opts...), opts...)
+	return &copied
+}
+
+// WithRetries sets the retry policy for every call made by the client.
+func (a *MonzoRestClient) WithRetries(policy RetryPolicy) *MonzoRestClient {
+	return a.With(WithRetryPolicy(policy))
+}
+
+// WithRateLimit holds calls back so no more than perSecond are made on average, allowing bursts of up to
+// burst. The limit is shared by every user and every client created from this one with With.
+func (a *MonzoRestClient) WithRateLimit(perSecond float64, burst int) *MonzoRestClient {
+	a.limiter = createRateLimiter(perSecond, burst)
+	return a
+}
+
+func (a *MonzoRestClient) callOptions(req *http.Request, opts []CallOption) callOptions {
+	options := callOptions{policy: DefaultRetryPolicy}
+	switch req.Method {
+	case "GET", "HEAD", "PUT", "DELETE", "OPTIONS":
+		options.idempotent = true
+	}
+	for _, opt := range a.opts {
+		opt(&options)
+	}
+	for _, opt := range opts {
+		opt(&options)
+	}
+	return options
+}
+
+// retryable reports whether a failed attempt is worth trying again: the connection failed, Monzo asked
+// for requests to slow down or it had a problem of its own.
+func retryable(err error) bool {
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) {
+		return true
+	}
+	return apiErr.StatusCode == http.StatusTooManyRequests || (apiErr.StatusCode >= 500 && apiErr.StatusCode != http.StatusNotImplemented)
+}
+
+// backoff is how long to wait before the retry following the given attempt, counting from zero.
+func (p RetryPolicy) backoff(attempt int, retryAfter time.Duration) time.Duration {
+	ceiling := p.MinBackoff
+	for i := 0; i < attempt && ceiling < p.MaxBackoff; i++ {
+		ceiling *= 2
+	}
+	if ceiling > p.MaxBackoff {
+		ceiling = p.MaxBackoff
+	}
+
+	var delay time.Duration
+	if ceiling > 0 {
+		delay = time.Duration(rand.Int63n(int64(ceiling) + 1))
+	}
+	if retryAfter > delay {
+		return retryAfter
+	}
+	return delay
+}
+
+// rateLimiter is a token bucket. Callers that find it empty take a token anyway and wait until it would
+// have been refilled, so they are let through in the order they arrived.
+type rateLimiter struct {
+	perSecond float64
+	burst     float64
+	tokens    float64
+	last      time.Time
+	now       func() time.Time
+	sleep     func(ctx context.Context, delay time.Duration) error
+	lock      sync.Mutex
+}
+
+func createRateLimiter(perSecond float64, burst int) *rateLimiter {
+	return &rateLimiter{perSecond: perSecond, burst: float64(burst), tokens: float64(burst), now: time.Now, sleep: sleepContext}
+}
+
+// wait returns once the caller may make a request, or with the context's error if it is done first.
+func (l *rateLimiter) wait(ctx context.Context) error {
+	l.lock.Lock()
+	now := l.now()
+	if !l.last.IsZero() {
+		l.tokens += now.Sub(l.last).Seconds() * l.perSecond
+		if l.tokens > l.burst {
+			l.tokens = l.burst
+		}
+	}
+	l.last = now
+	l.tokens--
+	var delay time.Duration
+	if l.tokens < 0 {
+		delay = time.Duration(-l.tokens / l.perSecond * float64(time.Second))
+	}
+	l.lock.Unlock()
+
+	if delay <= 0 {
+		return nil
+	}
+	if err := l.sleep(ctx, delay); err != nil {
+		// Give the token back, the request will not be made.
+		l.lock.Lock()
+		l.tokens++
+		l.lock.Unlock()
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,261 @@
+package monzorestclient
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMonzoRestClient_retries(t *testing.T) {
+	getAccounts := func(a *MonzoRestClient) error {
+		_, err := a.ListAccounts(context.Background(), "9876")
+		return err
+	}
+	createFeedItem := func(a *MonzoRestClient) error {
+		return a.CreateFeedItem(context.Background(), &FeedItem{AccountId: "acc_1", Params: &Params{Title: "Hello"}}, "9876")
+	}
+	updateTransaction := func(a *MonzoRestClient) error {
+		_, err := a.UpdateTransaction(context.Background(), "tx_1", "9876", map[string]string{"notes": "#coffee"})
+		return err
+	}
+	succeed := func(w http.ResponseWriter) {
+		_, _ = w.Write([]byte(`{"accounts": [], "transaction": {"id": "tx_1"}}`))
+	}
+	fail := func(status int, retryAfter string) func(w http.ResponseWriter) {
+		return func(w http.ResponseWriter) {
+			if retryAfter != "" {
+				w.Header().Set("Retry-After", retryAfter)
+			}
+			w.WriteHeader(status)
+			_, _ = w.Write([]byte(`{"code": "injected"}`))
+		}
+	}
+
+	tests := []struct {
+		name      string
+		call      func(a *MonzoRestClient) error
+		opts      []CallOption
+		responses []func(w http.ResponseWriter)
+		wantCalls int
+		wantErr   bool
+		wantSleep []time.Duration
+	}{
+		{
+			name:      "GET is retried after server errors",
+			call:      getAccounts,
+			responses: []func(w http.ResponseWriter){fail(503, ""), fail(500, ""), succeed},
+			wantCalls: 3,
+		},
+		{
+			name:      "Retry-After is honoured",
+			call:      getAccounts,
+			responses: []func(w http.ResponseWriter){fail(429, "3"), succeed},
+			wantCalls: 2,
+			wantSleep: []time.Duration{3 * time.Second},
+		},
+		{
+			name:      "Retry-After longer than the maximum backoff is left to the caller",
+			call:      getAccounts,
+			responses: []func(w http.ResponseWriter){fail(429, "3600"), succeed},
+			wantCalls: 1,
+			wantErr:   true,
+		},
+		{
+			name:      "Gives up after the maximum attempts",
+			call:      getAccounts,
+			responses: []func(w http.ResponseWriter){fail(502, ""), fail(502, ""), fail(502, ""), fail(502, ""), succeed},
+			wantCalls: 4,
+			wantErr:   true,
+		},
+		{
+			name:      "Client errors are not retried",
+			call:      getAccounts,
+			responses: []func(w http.ResponseWriter){fail(400, ""), succeed},
+			wantCalls: 1,
+			wantErr:   true,
+		},
+		{
+			name:      "POST is not retried by default",
+			call:      createFeedItem,
+			responses: []func(w http.ResponseWriter){fail(503, ""), succeed},
+			wantCalls: 1,
+			wantErr:   true,
+		},
+		{
+			name:      "POST is retried when the policy allows it",
+			call:      createFeedItem,
+			opts:      []CallOption{WithRetryPolicy(RetryPolicy{MaxAttempts: 2, RetryAll: true})},
+			responses: []func(w http.ResponseWriter){fail(503, ""), succeed},
+			wantCalls: 2,
+		},
+		{
+			name:      "Updating metadata is retried with the same form",
+			call:      updateTransaction,
+			responses: []func(w http.ResponseWriter){fail(503, ""), succeed},
+			wantCalls: 2,
+		},
+		{
+			name:      "Retries can be turned off",
+			call:      getAccounts,
+			opts:      []CallOption{WithRetryPolicy(NoRetries)},
+			responses: []func(w http.ResponseWriter){fail(503, ""), succeed},
+			wantCalls: 1,
+			wantErr:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var lock sync.Mutex
+			calls := 0
+			var firstForm string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				lock.Lock()
+				defer lock.Unlock()
+
+				_ = r.ParseForm()
+				if calls == 0 {
+					firstForm = r.PostForm.Encode()
+				} else if r.PostForm.Encode() != firstForm {
+					t.Errorf("Retry sent form %q, want %q", r.PostForm.Encode(), firstForm)
+				}
+				tt.responses[calls](w)
+				calls++
+			}))
+			defer server.Close()
+
+			var slept []time.Duration
+			client := CreateMonzoRestClient(server.URL, &http.Client{}).With(tt.opts...)
+			client.sleep = func(ctx context.Context, delay time.Duration) error {
+				slept = append(slept, delay)
+				return nil
+			}
+
+			err := tt.call(client)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("call error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if calls != tt.wantCalls {
+				t.Errorf("Server called %d times, want %d", calls, tt.wantCalls)
+			}
+			if tt.wantSleep != nil && !reflect.DeepEqual(slept, tt.wantSleep) {
+				t.Errorf("Slept for %v, want %v", slept, tt.wantSleep)
+			}
+			for _, delay := range slept {
+				if delay > DefaultRetryPolicy.MaxBackoff {
+					t.Errorf("Slept for %v, longer than the maximum backoff", delay)
+				}
+			}
+		})
+	}
+}
+
+func TestRetryPolicy_backoff(t *testing.T) {
+	policy := RetryPolicy{MinBackoff: 100 * time.Millisecond, MaxBackoff: time.Second}
+	for attempt, ceiling := range []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond, 800 * time.Millisecond, time.Second, time.Second} {
+		for i := 0; i < 50; i++ {
+			if got := policy.backoff(attempt, 0); got < 0 || got > ceiling {
+				t.Fatalf("backoff(%d) = %v, want between 0 and %v", attempt, got, ceiling)
+			}
+		}
+	}
+	if got := policy.backoff(0, 5*time.Second); got != 5*time.Second {
+		t.Errorf("backoff() with Retry-After = %v, want %v", got, 5*time.Second)
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Date(2019, time.January, 1, 12, 0, 0, 0, time.UTC)
+	var slept []time.Duration
+	limiter := createRateLimiter(2, 2)
+	limiter.now = func() time.Time { return now }
+	limiter.sleep = func(ctx context.Context, delay time.Duration) error {
+		slept = append(slept, delay)
+		return nil
+	}
+
+	// The burst goes straight through, then callers wait their turn for the bucket to refill.
+	for i := 0; i < 4; i++ {
+		_ = limiter.wait(context.Background())
+	}
+	want := []time.Duration{500 * time.Millisecond, time.Second}
+	if !reflect.DeepEqual(slept, want) {
+		t.Errorf("Slept for %v, want %v", slept, want)
+	}
+
+	// Once the queue has been served and the bucket refilled, calls go straight through again.
+	now = now.Add(5 * time.Second)
+	slept = nil
+	_ = limiter.wait(context.Background())
+	_ = limiter.wait(context.Background())
+	if len(slept) != 0 {
+		t.Errorf("Slept for %v after the bucket refilled", slept)
+	}
+}
+
+func TestMonzoRestClient_WithRateLimit(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"accounts": []}`))
+	}))
+	defer server.Close()
+
+	client := CreateMonzoRestClient(server.URL, &http.Client{}).WithRateLimit(1, 1)
+	var slept []time.Duration
+	client.limiter.sleep = func(ctx context.Context, delay time.Duration) error {
+		slept = append(slept, delay)
+		return nil
+	}
+
+	// Clients made with With share the limit.
+	_, _ = client.ListAccounts(context.Background(), "user_1")
+	_, _ = client.With(WithRetryPolicy(NoRetries)).ListAccounts(context.Background(), "user_2")
+	if len(slept) != 1 {
+		t.Errorf("Second call slept %v, want it held back by the shared limit", slept)
+	}
+}
+
+func TestMonzoRestClient_cancelled(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			<-r.Context().Done()
+			return
+		}
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	slowPolicy := WithRetryPolicy(RetryPolicy{MaxAttempts: 10, MinBackoff: time.Hour, MaxBackoff: time.Hour})
+	tests := []struct {
+		name   string
+		client *MonzoRestClient
+		path   string
+	}{
+		{"Deadline reaches the request", CreateMonzoRestClient(server.URL, &http.Client{}), "/slow"},
+		{"Waiting to retry stops", CreateMonzoRestClient(server.URL, &http.Client{}).With(slowPolicy), "/accounts"},
+		{"Waiting for the rate limit stops", CreateMonzoRestClient(server.URL, &http.Client{}).WithRateLimit(0.001, 1), "/slow"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+
+			if tt.client.limiter != nil {
+				// Use up the only token.
+				_ = tt.client.limiter.wait(context.Background())
+			}
+
+			started := time.Now()
+			_, err := tt.client.processGetRequest(ctx, tt.path, "token")
+			if !errors.Is(err, context.DeadlineExceeded) {
+				t.Errorf("processGetRequest() error = %v, want %v", err, context.DeadlineExceeded)
+			}
+			if elapsed := time.Since(started); elapsed > 5*time.Second {
+				t.Errorf("processGetRequest() took %v after the context ended", elapsed)
+			}
+		})
+	}
+}
@@ -1,10 +1,12 @@
 package monzorestclient
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
-	"fmt"
 	"log"
+	"net/url"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -17,19 +19,21 @@ type TransactionResponse struct {
 }
 
 type TransactionDetailsResponse struct {
-	AccountId      string           `json:"account_id,omitempty"`
-	AccountBalance int64            `json:"account_balance,omitempty"`
-	Amount         int64            `json:"amount"`
-	Created        time.Time        `json:"created"`
-	Currency       string           `json:"currency"`
-	Description    string           `json:"description"`
-	Id             string           `json:"id"`
-	Merchant       MerchantResponse `json:"merchant,omitempty"`
-	Notes          string           `json:"notes,omitempty"`
-	IsLoad         bool             `json:"is_load"`
-	Settled        string           `json:"settled"`
-	DeclineReason  string           `json:"decline_reason,omitempty"`
-	Category       string           `json:"category"`
+	AccountId      string            `json:"account_id,omitempty"`
+	AccountBalance int64             `json:"account_balance,omitempty"`
+	Amount         int64             `json:"amount"`
+	Created        time.Time         `json:"created"`
+	Currency       string            `json:"currency"`
+	Description    string            `json:"description"`
+	Id             string            `json:"id"`
+	Merchant       MerchantResponse  `json:"merchant,omitempty"`
+	Notes          string            `json:"notes,omitempty"`
+	IsLoad         bool              `json:"is_load"`
+	Settled        string            `json:"settled"`
+	DeclineReason  string            `json:"decline_reason,omitempty"`
+	Category       string            `json:"category"`
+	Scheme         string            `json:"scheme,omitempty"`
+	Metadata       map[string]string `json:"metadata,omitempty"`
 }
 
 type MerchantResponse struct {
@@ -43,6 +47,16 @@ type MerchantResponse struct {
 	Atm      bool            `json:"atm,omitempty"`
 }
 
+// UnmarshalJSON accepts the merchant ID on its own, which is what Monzo sends when the merchant is not expanded.
+func (m *MerchantResponse) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] == '"' {
+		return json.Unmarshal(data, &m.Id)
+	}
+
+	type merchant MerchantResponse
+	return json.Unmarshal(data, (*merchant)(m))
+}
+
 type AddressResponse struct {
 	Address        string  `json:"address"`
 	City           string  `json:"city"`
@@ -55,8 +69,8 @@ type AddressResponse struct {
 	ShortFormatted string  `json:"short_formatted,omitempty"`
 }
 
-func (a *MonzoRestClient) GetTransactions(accountId string, authToken string) (*TransactionsResponse, error) {
-	body, err := a.processGetRequest("/transactions?expand[]=merchant&account_id="+accountId, authToken)
+func (a *MonzoRestClient) GetTransactions(ctx context.Context, accountId string, authToken string) (*TransactionsResponse, error) {
+	body, err := a.processGetRequest(ctx, "/transactions?expand[]=merchant&account_id="+accountId, authToken)
 	if err != nil {
 		return nil, err
 	}
@@ -67,9 +81,23 @@ func (a *MonzoRestClient) GetTransactions(accountId string, authToken string) (*
 	return &result, err
 }
 
-func (a *MonzoRestClient) GetTransactionsSinceTimestamp(accountId string, authToken string, timestamp string) (*TransactionsResponse, error) {
+// GetTransaction fetches a single transaction with its merchant expanded. A transaction that does not exist,
+// or is not visible to the token, is a 404, see IsNotFound.
+func (a *MonzoRestClient) GetTransaction(ctx context.Context, transactionId string, authToken string) (*TransactionDetailsResponse, error) {
+	body, err := a.processGetRequest(ctx, "/transactions/"+url.PathEscape(transactionId)+"?expand[]=merchant", authToken)
+	if err != nil {
+		return nil, err
+	}
+
+	var result TransactionResponse
+	err = json.Unmarshal(body, &result)
+
+	return &result.Transaction, err
+}
+
+func (a *MonzoRestClient) GetTransactionsSinceTimestamp(ctx context.Context, accountId string, authToken string, timestamp string) (*TransactionsResponse, error) {
 	log.Printf("Getting transactions for %s since %s", accountId, timestamp)
-	body, err := a.processGetRequest("/transactions?expand[]=merchant&account_id="+accountId+"&since="+timestamp, authToken)
+	body, err := a.processGetRequest(ctx, "/transactions?expand[]=merchant&account_id="+accountId+"&since="+timestamp, authToken)
 	if err != nil {
 		return nil, err
 	}
@@ -80,14 +108,92 @@ func (a *MonzoRestClient) GetTransactionsSinceTimestamp(accountId string, authTo
 	return &result, err
 }
 
-func (a *MonzoRestClient) UpdateTransaction(transactionId string, authToken string, metadata map[string]string) (*TransactionsResponse, error) {
+// UpdateTransaction sets each metadata key on the transaction, an empty value deletes the key.
+// Notes are stored under the "notes" key and replace whatever the transaction had before. Setting the same
+// values twice has no further effect, so the call is retried like the idempotent methods.
+func (a *MonzoRestClient) UpdateTransaction(ctx context.Context, transactionId string, authToken string, metadata map[string]string) (*TransactionDetailsResponse, error) {
 	log.Printf("Updating transaction %s", transactionId)
-	var s string
+	form := url.Values{}
 	for key, val := range metadata {
-		s = fmt.Sprintf("metadata[%s]=%s", key, val)
+		form.Set("metadata["+key+"]", val)
 	}
-	s = fmt.Sprintf("{%s}", s)
-	body, err := a.processPatchRequest("/transactions/"+transactionId, authToken, bytes.NewBufferString(s))
+
+	body, err := a.processPatchRequest(ctx, "/transactions/"+transactionId, authToken, form, Idempotent())
+	if err != nil {
+		return nil, err
+	}
+
+	var result TransactionResponse
+	err = json.Unmarshal(body, &result)
+
+	return &result.Transaction, err
+}
+
+func (a *MonzoRestClient) DeleteTransactionMetadata(ctx context.Context, transactionId string, authToken string, keys ...string) (*TransactionDetailsResponse, error) {
+	metadata := make(map[string]string, len(keys))
+	for _, key := range keys {
+		metadata[key] = ""
+	}
+	return a.UpdateTransaction(ctx, transactionId, authToken, metadata)
+}
+
+// AppendHashtags adds each hashtag to the end of notes unless it is already there, keeping whatever the user wrote.
+func AppendHashtags(notes string, hashtags ...string) string {
+	for _, hashtag := range hashtags {
+		if hashtag == "" {
+			continue
+		}
+		if !strings.HasPrefix(hashtag, "#") {
+			hashtag = "#" + hashtag
+		}
+		if containsField(notes, hashtag) {
+			continue
+		}
+		if notes != "" {
+			notes += " "
+		}
+		notes += hashtag
+	}
+	return notes
+}
+
+func containsField(s string, field string) bool {
+	for _, f := range strings.Fields(s) {
+		if f == field {
+			return true
+		}
+	}
+	return false
+}
+
+const maxTransactionsPageSize = 100
+
+// TransactionsQuery pages through an account's transactions. Since can be an RFC3339 timestamp or a transaction ID,
+// in which case only transactions after it are returned. A zero Before or Limit is left off the request.
+type TransactionsQuery struct {
+	Since  string
+	Before time.Time
+	Limit  int
+}
+
+func (q TransactionsQuery) encode(accountId string) string {
+	values := url.Values{}
+	values.Set("expand[]", "merchant")
+	values.Set("account_id", accountId)
+	if q.Since != "" {
+		values.Set("since", q.Since)
+	}
+	if !q.Before.IsZero() {
+		values.Set("before", q.Before.UTC().Format(time.RFC3339))
+	}
+	if q.Limit > 0 {
+		values.Set("limit", strconv.Itoa(q.Limit))
+	}
+	return values.Encode()
+}
+
+func (a *MonzoRestClient) ListTransactions(ctx context.Context, accountId string, authToken string, query TransactionsQuery) (*TransactionsResponse, error) {
+	body, err := a.processGetRequest(ctx, "/transactions?"+query.encode(accountId), authToken)
 	if err != nil {
 		return nil, err
 	}
@@ -97,3 +203,82 @@ func (a *MonzoRestClient) UpdateTransaction(transactionId string, authToken stri
 
 	return &result, err
 }
+
+// TransactionIterator walks every transaction matching a query, oldest first, fetching a page at a time
+// and using the ID of the last transaction seen as the cursor for the next page.
+type TransactionIterator struct {
+	list     func(query TransactionsQuery) (*TransactionsResponse, error)
+	query    TransactionsQuery
+	page     []TransactionDetailsResponse
+	index    int
+	lastPage bool
+	err      error
+}
+
+// CreateTransactionIterator pages through query using list to fetch each page.
+func CreateTransactionIterator(list func(query TransactionsQuery) (*TransactionsResponse, error), query TransactionsQuery) *TransactionIterator {
+	if query.Limit <= 0 || query.Limit > maxTransactionsPageSize {
+		query.Limit = maxTransactionsPageSize
+	}
+	return &TransactionIterator{
+		list:  list,
+		query: query,
+		index: -1,
+	}
+}
+
+// IterateTransactions returns an iterator over the account's transactions. authToken is called before each page
+// is fetched so a long running walk picks up refreshed tokens.
+func (a *MonzoRestClient) IterateTransactions(ctx context.Context, accountId string, authToken func() string, query TransactionsQuery) *TransactionIterator {
+	return CreateTransactionIterator(func(query TransactionsQuery) (*TransactionsResponse, error) {
+		return a.ListTransactions(ctx, accountId, authToken(), query)
+	}, query)
+}
+
+func (it *TransactionIterator) Next() bool {
+	if it.err != nil {
+		return false
+	}
+
+	if it.index+1 < len(it.page) {
+		it.index++
+		it.query.Since = it.page[it.index].Id
+		return true
+	}
+	if it.lastPage {
+		return false
+	}
+
+	res, err := it.list(it.query)
+	if err != nil {
+		it.err = err
+		return false
+	}
+
+	it.page = res.Transactions
+	it.index = -1
+	it.lastPage = len(it.page) < it.query.Limit
+	if len(it.page) == 0 {
+		return false
+	}
+
+	it.index++
+	it.query.Since = it.page[it.index].Id
+	return true
+}
+
+func (it *TransactionIterator) Transaction() *TransactionDetailsResponse {
+	if it.index < 0 || it.index >= len(it.page) {
+		return nil
+	}
+	return &it.page[it.index]
+}
+
+// Cursor is the ID of the last transaction returned by Next, pass it as Since to resume after it.
+func (it *TransactionIterator) Cursor() string {
+	return it.query.Since
+}
+
+func (it *TransactionIterator) Err() error {
+	return it.err
+}
@@ -1,48 +1,52 @@
 package monzorestclient
 
 import (
-	"errors"
-	"io/ioutil"
+	"context"
+	"encoding/json"
 	"log"
-	"net/http"
 	"net/url"
-	"strings"
 )
 
-func (a *MonzoRestClient) RegisterWebhook(accountId string, accessToken string, uri string) error {
+type WebhooksResponse struct {
+	Webhooks []Webhook `json:"webhooks"`
+}
+
+type Webhook struct {
+	Id        string `json:"id"`
+	AccountId string `json:"account_id"`
+	Url       string `json:"url"`
+}
+
+func (a *MonzoRestClient) RegisterWebhook(ctx context.Context, accountId string, accessToken string, uri string) error {
 	form := url.Values{}
 	form.Add("account_id", accountId)
 	form.Add("url", uri)
 
-	req, err := http.NewRequest("POST", a.url+"/webhooks", strings.NewReader(form.Encode()))
-	if err != nil {
+	if _, err := a.processFormRequest(ctx, "POST", "/webhooks", accessToken, form); err != nil {
+		log.Printf("An error occured registering a webhook: %v", err)
 		return err
 	}
 
-	req.PostForm = form
-	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
-	req.Header.Add("Authorization", "Bearer "+accessToken)
-
-	res, lastErr := a.client.Do(req)
-
-	if lastErr != nil || (res.Status != "200 OK" && res.Status != "201 Created") {
-		if res != nil {
-			defer res.Body.Close()
+	log.Println("Registered webhook")
 
-			body, err := ioutil.ReadAll(res.Body)
-			if err != nil {
-				log.Println("Failed in many ways :'( ")
-				return err
-			}
+	return nil
+}
 
-			log.Printf("Registering a web hook... response was not 200 or 201! [%s, %+v]", res.Status, string(body))
-		} else {
-			log.Printf("An error occured registersing a webhook: [%+v]", lastErr)
-		}
-		return errors.New("not 200 or 201")
+// ListWebhooks returns the webhooks registered on the account.
+func (a *MonzoRestClient) ListWebhooks(ctx context.Context, accountId string, accessToken string) (*WebhooksResponse, error) {
+	body, err := a.processGetRequest(ctx, "/webhooks?account_id="+url.QueryEscape(accountId), accessToken)
+	if err != nil {
+		return nil, err
 	}
 
-	log.Println("Registered webhook")
+	var result *WebhooksResponse
+	err = json.Unmarshal(body, &result)
 
-	return nil
+	return result, err
+}
+
+// DeleteWebhook stops Monzo posting to the webhook. Deleting a webhook that has already gone is a 404, see IsNotFound.
+func (a *MonzoRestClient) DeleteWebhook(ctx context.Context, webhookId string, accessToken string) error {
+	_, err := a.processDeleteRequest(ctx, "/webhooks/"+url.PathEscape(webhookId), accessToken)
+	return err
 }
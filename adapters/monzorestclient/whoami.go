@@ -1,6 +1,7 @@
 package monzorestclient
 
 import (
+	"context"
 	"encoding/json"
 )
 
@@ -10,8 +11,8 @@ type WhoAmIResponse struct {
 	UserId        string `json:"user_id"`
 }
 
-func (a *MonzoRestClient) WhoAmI(authToken string) (*WhoAmIResponse, error) {
-	body, err := a.processGetRequest("/ping/whoami", authToken)
+func (a *MonzoRestClient) WhoAmI(ctx context.Context, authToken string) (*WhoAmIResponse, error) {
+	body, err := a.processGetRequest(ctx, "/ping/whoami", authToken)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,217 @@
+package tokenstore
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+)
+
+const encryptedPrefix = "enc:"
+
+type Store interface {
+	Save(token *Token) error
+	Load(userId string) (*Token, error)
+	LoadAll() ([]*Token, error)
+	Delete(userId string) error
+}
+
+// Keyring holds the AES keys used to encrypt tokens. New values are always encrypted with the current key,
+// the others are only kept so values written before a rotation can still be read.
+type Keyring struct {
+	current string
+	keys    map[string]cipher.AEAD
+}
+
+// ParseKeyring reads keys formatted as "id:base64key" separated by commas or new lines.
+// The first key is the current key. Keys must be 16, 24 or 32 bytes long.
+func ParseKeyring(spec string) (*Keyring, error) {
+	keyring := &Keyring{keys: map[string]cipher.AEAD{}}
+
+	entries := strings.FieldsFunc(spec, func(r rune) bool {
+		return r == ',' || r == '\n' || r == '\r'
+	})
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+
+		parts := strings.SplitN(entry, ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, errors.New("keys must be formatted as id:base64key")
+		}
+		id := parts[0]
+		if _, found := keyring.keys[id]; found {
+			return nil, fmt.Errorf("duplicate key id %s", id)
+		}
+
+		key, err := base64.StdEncoding.DecodeString(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("key %s is not valid base64", id)
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("key %s: %v", id, err)
+		}
+		gcm, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+
+		keyring.keys[id] = gcm
+		if keyring.current == "" {
+			keyring.current = id
+		}
+	}
+
+	if keyring.current == "" {
+		return nil, errors.New("no keys supplied")
+	}
+	return keyring, nil
+}
+
+func (k *Keyring) CurrentKeyId() string {
+	return k.current
+}
+
+func (k *Keyring) encrypt(plaintext string, userId string) (string, error) {
+	if plaintext == "" {
+		return "", nil
+	}
+
+	gcm := k.keys[k.current]
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+
+	sealed := gcm.Seal(nonce, nonce, []byte(plaintext), []byte(userId))
+	return encryptedPrefix + k.current + ":" + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// decrypt reverses encrypt. Values without the encrypted prefix are returned as they are so stores written
+// before encryption was enabled can still be read and then re-encrypted.
+func (k *Keyring) decrypt(value string, userId string) (string, error) {
+	if !strings.HasPrefix(value, encryptedPrefix) {
+		return value, nil
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(value, encryptedPrefix), ":", 2)
+	if len(parts) != 2 {
+		return "", errors.New("malformed encrypted value")
+	}
+
+	gcm, found := k.keys[parts[0]]
+	if !found {
+		return "", fmt.Errorf("unknown key id %s", parts[0])
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return "", errors.New("malformed encrypted value")
+	}
+
+	plaintext, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], []byte(userId))
+	if err != nil {
+		return "", fmt.Errorf("unable to decrypt value with key %s", parts[0])
+	}
+	return string(plaintext), nil
+}
+
+// EncryptedTokenStore encrypts the access and refresh tokens before handing them to the wrapped store.
+type EncryptedTokenStore struct {
+	store   Store
+	keyring *Keyring
+}
+
+func CreateEncryptedTokenStore(store Store, keyring *Keyring) *EncryptedTokenStore {
+	return &EncryptedTokenStore{store: store, keyring: keyring}
+}
+
+func (s *EncryptedTokenStore) Save(token *Token) error {
+	encrypted := *token
+
+	var err error
+	if encrypted.AccessToken, err = s.keyring.encrypt(token.AccessToken, token.UserId); err != nil {
+		return err
+	}
+	if encrypted.RefreshToken, err = s.keyring.encrypt(token.RefreshToken, token.UserId); err != nil {
+		return err
+	}
+
+	return s.store.Save(&encrypted)
+}
+
+func (s *EncryptedTokenStore) Load(userId string) (*Token, error) {
+	token, err := s.store.Load(userId)
+	if err != nil {
+		return nil, err
+	}
+	return s.decrypt(token)
+}
+
+// LoadAll skips, and logs, tokens that can't be decrypted so one bad record doesn't stop every other user
+// from being restored.
+func (s *EncryptedTokenStore) LoadAll() ([]*Token, error) {
+	tokens, err := s.store.LoadAll()
+	if err != nil {
+		return nil, err
+	}
+
+	decrypted := make([]*Token, 0, len(tokens))
+	for _, token := range tokens {
+		plain, err := s.decrypt(token)
+		if err != nil {
+			log.Printf("Skipping token for user %s: %v", token.UserId, err)
+			continue
+		}
+		decrypted = append(decrypted, plain)
+	}
+	return decrypted, nil
+}
+
+func (s *EncryptedTokenStore) Delete(userId string) error {
+	return s.store.Delete(userId)
+}
+
+// Rekey re-encrypts every stored token with the current key, returning how many were rewritten. Unlike
+// LoadAll it stops at a token that can't be decrypted, as that needs its key adding back to the keyring.
+func (s *EncryptedTokenStore) Rekey() (int, error) {
+	tokens, err := s.store.LoadAll()
+	if err != nil {
+		return 0, err
+	}
+
+	for index, token := range tokens {
+		plain, err := s.decrypt(token)
+		if err != nil {
+			return index, fmt.Errorf("user %s: %v", token.UserId, err)
+		}
+		if err := s.Save(plain); err != nil {
+			return index, fmt.Errorf("user %s: %v", token.UserId, err)
+		}
+	}
+	return len(tokens), nil
+}
+
+func (s *EncryptedTokenStore) decrypt(token *Token) (*Token, error) {
+	decrypted := *token
+
+	var err error
+	if decrypted.AccessToken, err = s.keyring.decrypt(token.AccessToken, token.UserId); err != nil {
+		return nil, err
+	}
+	if decrypted.RefreshToken, err = s.keyring.decrypt(token.RefreshToken, token.UserId); err != nil {
+		return nil, err
+	}
+	return &decrypted, nil
+}
@@ -0,0 +1,147 @@
+package tokenstore
+
+import (
+	"encoding/base64"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type memoryStore struct {
+	tokens map[string]Token
+}
+
+func (m *memoryStore) Save(token *Token) error {
+	m.tokens[token.UserId] = *token
+	return nil
+}
+
+func (m *memoryStore) Load(userId string) (*Token, error) {
+	token, found := m.tokens[userId]
+	if !found {
+		return nil, ErrNotFound
+	}
+	return &token, nil
+}
+
+func (m *memoryStore) LoadAll() ([]*Token, error) {
+	tokens := make([]*Token, 0)
+	for _, token := range m.tokens {
+		token := token
+		tokens = append(tokens, &token)
+	}
+	return tokens, nil
+}
+
+func (m *memoryStore) Delete(userId string) error {
+	delete(m.tokens, userId)
+	return nil
+}
+
+func key(b byte) string {
+	return base64.StdEncoding.EncodeToString([]byte(strings.Repeat(string(b), 32)))
+}
+
+func TestEncryptedTokenStore(t *testing.T) {
+	token := &Token{
+		AccessToken:  "access",
+		RefreshToken: "refresh",
+		UserId:       "user_123",
+	}
+
+	oldKeyring, err := ParseKeyring("old:" + key('a'))
+	if err != nil {
+		t.Fatalf("ParseKeyring() error = %v", err)
+	}
+	inner := &memoryStore{tokens: map[string]Token{}}
+	store := CreateEncryptedTokenStore(inner, oldKeyring)
+
+	if err = store.Save(token); err != nil {
+		t.Fatalf("EncryptedTokenStore.Save() error = %v", err)
+	}
+
+	stored := inner.tokens[token.UserId]
+	if !strings.HasPrefix(stored.AccessToken, "enc:old:") || !strings.HasPrefix(stored.RefreshToken, "enc:old:") {
+		t.Errorf("Tokens were not encrypted with the old key: %+v", stored)
+	}
+
+	got, err := store.Load(token.UserId)
+	if err != nil {
+		t.Fatalf("EncryptedTokenStore.Load() error = %v", err)
+	}
+	if !reflect.DeepEqual(got, token) {
+		t.Errorf("EncryptedTokenStore.Load() = %v, want %v", got, token)
+	}
+
+	rotated, err := ParseKeyring("new:" + key('b') + "\nold:" + key('a'))
+	if err != nil {
+		t.Fatalf("ParseKeyring() error = %v", err)
+	}
+	store = CreateEncryptedTokenStore(inner, rotated)
+	if count, err := store.Rekey(); err != nil || count != 1 {
+		t.Fatalf("EncryptedTokenStore.Rekey() = %d, %v", count, err)
+	}
+	if stored = inner.tokens[token.UserId]; !strings.HasPrefix(stored.AccessToken, "enc:new:") {
+		t.Errorf("Tokens were not re-encrypted with the new key: %+v", stored)
+	}
+
+	newOnly, _ := ParseKeyring("new:" + key('b'))
+	got, err = CreateEncryptedTokenStore(inner, newOnly).Load(token.UserId)
+	if err != nil || !reflect.DeepEqual(got, token) {
+		t.Errorf("Load() after rekey = %v, %v", got, err)
+	}
+
+	if _, err = CreateEncryptedTokenStore(inner, oldKeyring).Load(token.UserId); err == nil {
+		t.Error("Load() with a keyring missing the new key should fail")
+	}
+}
+
+func TestEncryptedTokenStore_tamperedUser(t *testing.T) {
+	keyring, _ := ParseKeyring("k1:" + key('a'))
+	inner := &memoryStore{tokens: map[string]Token{}}
+	store := CreateEncryptedTokenStore(inner, keyring)
+
+	_ = store.Save(&Token{AccessToken: "access", UserId: "user_1"})
+	moved := inner.tokens["user_1"]
+	moved.UserId = "user_2"
+	inner.tokens["user_2"] = moved
+
+	if _, err := store.Load("user_2"); err == nil {
+		t.Error("Load() should fail when a token is moved to another user")
+	}
+
+	all, err := store.LoadAll()
+	if err != nil || len(all) != 1 || all[0].UserId != "user_1" {
+		t.Errorf("LoadAll() = %v, %v, want only user_1", all, err)
+	}
+	if _, err = store.Rekey(); err == nil {
+		t.Error("Rekey() should fail when a token can't be decrypted")
+	}
+}
+
+func TestParseKeyring(t *testing.T) {
+	tests := []struct {
+		name    string
+		spec    string
+		current string
+		wantErr bool
+	}{
+		{"First key is current", "a:" + key('a') + ",b:" + key('b'), "a", false},
+		{"Comments and blank lines are ignored", "# keys\n\nb:" + key('b') + "\n", "b", false},
+		{"Empty", "", "", true},
+		{"Missing id", ":" + key('a'), "", true},
+		{"Bad key length", "a:" + base64.StdEncoding.EncodeToString([]byte("short")), "", true},
+		{"Duplicate ids", "a:" + key('a') + ",a:" + key('b'), "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseKeyring(tt.spec)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseKeyring() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && got.CurrentKeyId() != tt.current {
+				t.Errorf("ParseKeyring() current = %s, want %s", got.CurrentKeyId(), tt.current)
+			}
+		})
+	}
+}
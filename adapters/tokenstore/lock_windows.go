@@ -0,0 +1,8 @@
+//go:build windows
+
+package tokenstore
+
+// lockFile does nothing on Windows, only one process should use the token store at a time there.
+func lockFile(path string) (func(), error) {
+	return func() {}, nil
+}
@@ -0,0 +1,155 @@
+package tokenstore
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+var ErrNotFound = errors.New("token not found")
+
+type Token struct {
+	AccessToken  string    `json:"access_token"`
+	ClientId     string    `json:"client_id"`
+	Expiry       int32     `json:"expires_in"`
+	ExpiresAt    time.Time `json:"expires_at"`
+	RefreshToken string    `json:"refresh_token"`
+	TokenType    string    `json:"token_type"`
+	UserId       string    `json:"user_id"`
+	// NeedsReauth is set once Monzo has rejected the refresh token, the user must sign in again.
+	NeedsReauth bool `json:"needs_reauth,omitempty"`
+}
+
+// FileTokenStore keeps every user's token in a single JSON file.
+// The file is rewritten through a temporary file and a rename so a crash part way through a write leaves the previous version intact.
+// Writes lock the file and re-read it first, so tokens saved by another process, such as the auth command
+// while serve is running, are kept rather than overwritten with this process's copy.
+type FileTokenStore struct {
+	path   string
+	tokens map[string]Token
+	lock   sync.RWMutex
+}
+
+func CreateFileTokenStore(path string) (*FileTokenStore, error) {
+	tokens, err := readTokens(path)
+	if err != nil {
+		return nil, err
+	}
+	return &FileTokenStore{path: path, tokens: tokens}, nil
+}
+
+func (s *FileTokenStore) Save(token *Token) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.update(func(tokens map[string]Token) {
+		tokens[token.UserId] = *token
+	})
+}
+
+func (s *FileTokenStore) Load(userId string) (*Token, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	token, found := s.tokens[userId]
+	if !found {
+		return nil, ErrNotFound
+	}
+	return &token, nil
+}
+
+func (s *FileTokenStore) LoadAll() ([]*Token, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	tokens := make([]*Token, 0, len(s.tokens))
+	for _, token := range s.tokens {
+		token := token
+		tokens = append(tokens, &token)
+	}
+	return tokens, nil
+}
+
+func (s *FileTokenStore) Delete(userId string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.update(func(tokens map[string]Token) {
+		delete(tokens, userId)
+	})
+}
+
+// update applies change to the tokens on disk while holding the file lock, then keeps the result as this
+// store's copy. Nothing is kept if the write fails.
+func (s *FileTokenStore) update(change func(tokens map[string]Token)) error {
+	unlock, err := lockFile(s.path + ".lock")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	tokens, err := readTokens(s.path)
+	if err != nil {
+		return err
+	}
+	change(tokens)
+
+	body, err := json.MarshalIndent(tokens, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err = writeFileAtomically(s.path, body); err != nil {
+		return err
+	}
+	s.tokens = tokens
+	return nil
+}
+
+func readTokens(path string) (map[string]Token, error) {
+	tokens := map[string]Token{}
+
+	body, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return tokens, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if len(body) > 0 {
+		if err = json.Unmarshal(body, &tokens); err != nil {
+			return nil, err
+		}
+	}
+	return tokens, nil
+}
+
+func writeFileAtomically(path string, body []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err = tmp.Write(body); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Chmod(0600); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,136 @@
+package tokenstore
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFileTokenStore_SaveAndReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tokenstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "tokens.json")
+
+	token := &Token{
+		AccessToken:  "access",
+		ClientId:     "client",
+		Expiry:       21600,
+		ExpiresAt:    time.Date(2019, time.March, 12, 10, 0, 0, 0, time.UTC),
+		RefreshToken: "refresh",
+		TokenType:    "Bearer",
+		UserId:       "user_123",
+	}
+
+	store, err := CreateFileTokenStore(path)
+	if err != nil {
+		t.Fatalf("CreateFileTokenStore() error = %v", err)
+	}
+	if err = store.Save(token); err != nil {
+		t.Fatalf("FileTokenStore.Save() error = %v", err)
+	}
+
+	reloaded, err := CreateFileTokenStore(path)
+	if err != nil {
+		t.Fatalf("CreateFileTokenStore() error = %v", err)
+	}
+	got, err := reloaded.Load(token.UserId)
+	if err != nil {
+		t.Fatalf("FileTokenStore.Load() error = %v", err)
+	}
+	if !reflect.DeepEqual(got, token) {
+		t.Errorf("FileTokenStore.Load() = %v, want %v", got, token)
+	}
+
+	all, _ := reloaded.LoadAll()
+	if len(all) != 1 {
+		t.Errorf("FileTokenStore.LoadAll() returned %d tokens, want 1", len(all))
+	}
+
+	if err = reloaded.Delete(token.UserId); err != nil {
+		t.Fatalf("FileTokenStore.Delete() error = %v", err)
+	}
+	if _, err = reloaded.Load(token.UserId); err != ErrNotFound {
+		t.Errorf("FileTokenStore.Load() after delete error = %v, want %v", err, ErrNotFound)
+	}
+
+	files, _ := ioutil.ReadDir(dir)
+	for _, file := range files {
+		if file.Name() != "tokens.json" && file.Name() != "tokens.json.lock" {
+			t.Errorf("Unexpected file %s left behind", file.Name())
+		}
+	}
+}
+
+func TestFileTokenStore_concurrentProcesses(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tokenstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "tokens.json")
+
+	serve, err := CreateFileTokenStore(path)
+	if err != nil {
+		t.Fatalf("CreateFileTokenStore() error = %v", err)
+	}
+	if err = serve.Save(&Token{UserId: "user_1", AccessToken: "first"}); err != nil {
+		t.Fatalf("FileTokenStore.Save() error = %v", err)
+	}
+
+	auth, err := CreateFileTokenStore(path)
+	if err != nil {
+		t.Fatalf("CreateFileTokenStore() error = %v", err)
+	}
+	if err = auth.Save(&Token{UserId: "user_2", AccessToken: "second"}); err != nil {
+		t.Fatalf("FileTokenStore.Save() error = %v", err)
+	}
+
+	if err = serve.Save(&Token{UserId: "user_1", AccessToken: "refreshed"}); err != nil {
+		t.Fatalf("FileTokenStore.Save() error = %v", err)
+	}
+	if err = serve.Delete("user_3"); err != nil {
+		t.Fatalf("FileTokenStore.Delete() error = %v", err)
+	}
+
+	reloaded, err := CreateFileTokenStore(path)
+	if err != nil {
+		t.Fatalf("CreateFileTokenStore() error = %v", err)
+	}
+	tests := []struct {
+		userId string
+		want   string
+	}{
+		{"user_1", "refreshed"},
+		{"user_2", "second"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.userId, func(t *testing.T) {
+			got, err := reloaded.Load(tt.userId)
+			if err != nil || got.AccessToken != tt.want {
+				t.Errorf("FileTokenStore.Load() = %+v, %v, want access token %s", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestCreateFileTokenStore_corrupt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tokenstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "tokens.json")
+
+	if err = ioutil.WriteFile(path, []byte("{not json"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = CreateFileTokenStore(path); err == nil {
+		t.Error("CreateFileTokenStore() expected an error for a corrupt file")
+	}
+}
@@ -0,0 +1,192 @@
+package application
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/tmilner/monzo-customisation/adapters/monzorestclient"
+)
+
+const (
+	// approvalPollInterval is how often Monzo is asked whether the user has approved access in the app.
+	approvalPollInterval = 2 * time.Second
+	// approvalTimeout is how long a user has to approve access in the app after signing in.
+	approvalTimeout = 10 * time.Minute
+	// approvalRefresh is how often, in seconds, the waiting page reloads itself.
+	approvalRefresh = 3
+	// approvalRetention is how long a finished sign in can still be looked up by its waiting page.
+	approvalRetention = 10 * time.Minute
+)
+
+var errApprovalTimeout = errors.New("access was not approved in the Monzo app in time")
+
+type approvalStatus int
+
+const (
+	approvalPending approvalStatus = iota
+	approvalGranted
+	approvalFailed
+)
+
+// approval is a sign in waiting for the user to approve access in the Monzo app. Failed approvals keep the
+// page status and message to show.
+type approval struct {
+	userId   string
+	redirect string
+	status   approvalStatus
+	code     int
+	message  string
+	expires  time.Time
+}
+
+// approvals tracks sign ins between the OAuth return and the user approving access in the Monzo app, keyed
+// by an unguessable id that the browser polls.
+type approvals struct {
+	pollInterval time.Duration
+	timeout      time.Duration
+	pending      map[string]*approval
+	lock         sync.Mutex
+}
+
+func createApprovals() *approvals {
+	return &approvals{pollInterval: approvalPollInterval, timeout: approvalTimeout, pending: map[string]*approval{}}
+}
+
+// start records a sign in for userId that returns to redirect once approved, and returns its id.
+func (s *approvals) start(userId string, redirect string, now time.Time) (string, error) {
+	id := make([]byte, 32)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(id)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for pendingId, pending := range s.pending {
+		if !now.Before(pending.expires) {
+			delete(s.pending, pendingId)
+		}
+	}
+	s.pending[encoded] = &approval{userId: userId, redirect: redirect, expires: now.Add(s.timeout + approvalRetention)}
+	return encoded, nil
+}
+
+func (s *approvals) get(id string) (approval, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	pending, found := s.pending[id]
+	if !found {
+		return approval{}, false
+	}
+	return *pending, true
+}
+
+func (s *approvals) grant(id string) {
+	s.finish(id, approvalGranted, http.StatusOK, "")
+}
+
+func (s *approvals) fail(id string, code int, message string) {
+	s.finish(id, approvalFailed, code, message)
+}
+
+func (s *approvals) finish(id string, status approvalStatus, code int, message string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if pending, found := s.pending[id]; found {
+		pending.status, pending.code, pending.message = status, code, message
+	}
+}
+
+// waitForApproval polls Monzo until the token can list accounts. Until the user approves access in the app
+// the token is authenticated but every call other than whoami is refused as insufficient permissions.
+func (a *MonzoCustomisation) waitForApproval(ctx context.Context, accessToken string) error {
+	for {
+		_, err := a.client.ListAccounts(ctx, accessToken)
+		switch {
+		case err == nil:
+			return nil
+		case monzorestclient.IsUnauthorized(err):
+			return err
+		case !monzorestclient.IsInsufficientPermissions(err):
+			log.Printf("Unable to check whether access has been approved: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				return errApprovalTimeout
+			}
+			return ctx.Err()
+		case <-time.After(a.approvals.pollInterval):
+		}
+	}
+}
+
+// completeSignIn waits for the user to approve access before saving them, so nothing runs against a token
+// without permissions, then starts the same work as restoring a user at start up.
+func (a *MonzoCustomisation) completeSignIn(id string, auth *Auth) {
+	ctx, cancel := context.WithTimeout(a.jobs, a.approvals.timeout)
+	defer cancel()
+
+	if err := a.waitForApproval(ctx, auth.AccessToken); err != nil {
+		log.Printf("Sign in for user %s not approved: %v", auth.UserId, err)
+		switch {
+		case errors.Is(err, errApprovalTimeout):
+			a.approvals.fail(id, http.StatusGatewayTimeout, "Access was not approved in the Monzo app in time.")
+		case monzorestclient.IsUnauthorized(err):
+			a.approvals.fail(id, http.StatusUnauthorized, "Monzo did not accept the sign in.")
+		default:
+			a.approvals.fail(id, http.StatusServiceUnavailable, "Signing in was interrupted.")
+		}
+		return
+	}
+
+	if err := a.saveUserAndAccounts(a.jobs, auth); err != nil {
+		a.approvals.fail(id, http.StatusBadGateway, "Your accounts could not be loaded from Monzo.")
+		return
+	}
+	a.approvals.grant(id)
+
+	go a.processTodaysTransactions(a.jobs, auth.UserId)
+	go a.runBasicInfo(a.jobs, auth.UserId)
+	go a.backfill(a.jobs, auth.UserId, false)
+}
+
+// approvalHandler is the page a user waits on while approving access in the Monzo app. It reloads itself
+// until access is approved, then behaves as the end of sign in.
+func (a *MonzoCustomisation) approvalHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	startAgain := page{LinkText: "Sign in again", LinkUrl: "/auth_start"}
+
+	pending, found := a.approvals.get(mux.Vars(r)["id"])
+	if !found || !a.now().Before(pending.expires) {
+		startAgain.Title, startAgain.Message = "Unable to sign in", "This sign in has expired."
+		writePage(w, http.StatusNotFound, startAgain)
+		return
+	}
+
+	switch pending.status {
+	case approvalPending:
+		writePage(w, http.StatusOK, page{
+			Title:   "Approve access in your Monzo app",
+			Message: "Open the Monzo app and allow access to your account. This page will update once you have.",
+			Refresh: approvalRefresh,
+		})
+	case approvalFailed:
+		startAgain.Title, startAgain.Message = "Unable to sign in", pending.message
+		writePage(w, pending.code, startAgain)
+	default:
+		if pending.redirect != "" {
+			http.Redirect(w, r, pending.redirect, http.StatusSeeOther)
+			return
+		}
+		writePage(w, http.StatusOK, page{Title: "Signed in", Message: "Your Monzo accounts are connected."})
+	}
+}
@@ -0,0 +1,138 @@
+package application
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// authStateLifetime is how long a user has to sign in to Monzo after visiting /auth_start.
+	authStateLifetime = 5 * time.Minute
+	authStateCookie   = "monzo_auth_state"
+	// authExchangeTimeout is how long exchanging the code Monzo returns for a token may take.
+	authExchangeTimeout = 30 * time.Second
+)
+
+var (
+	errAuthStateMissing = errors.New("no sign in was started from this browser")
+	errAuthStateInvalid = errors.New("sign in cookie or state is not valid")
+	errAuthStateExpired = errors.New("sign in took too long")
+	errAuthStateUsed    = errors.New("sign in has already been completed")
+)
+
+// authFlow is what /auth_start remembers about a sign in, in a signed cookie, for /auth_return to check.
+type authFlow struct {
+	State    string    `json:"state"`
+	Redirect string    `json:"redirect,omitempty"`
+	Expires  time.Time `json:"expires"`
+}
+
+// authStates issues and checks the state of each OAuth flow. The state is bound to the browser that started
+// the flow by a signed cookie and can only be used once. The signing key is generated at start up, so a
+// flow does not survive a restart.
+type authStates struct {
+	key  []byte
+	used map[string]time.Time
+	lock sync.Mutex
+}
+
+func createAuthStates() *authStates {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(err)
+	}
+	return &authStates{key: key, used: map[string]time.Time{}}
+}
+
+// start creates a flow that returns to redirect once signed in, and the cookie to set for it.
+func (s *authStates) start(redirect string, secure bool, now time.Time) (*authFlow, *http.Cookie, error) {
+	state := make([]byte, 32)
+	if _, err := rand.Read(state); err != nil {
+		return nil, nil, err
+	}
+
+	flow := &authFlow{State: base64.RawURLEncoding.EncodeToString(state), Redirect: redirect, Expires: now.Add(authStateLifetime)}
+	payload, err := json.Marshal(flow)
+	if err != nil {
+		return nil, nil, err
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+
+	return flow, &http.Cookie{
+		Name:     authStateCookie,
+		Value:    encoded + "." + s.sign(encoded),
+		Path:     "/",
+		MaxAge:   int(authStateLifetime.Seconds()),
+		Secure:   secure,
+		HttpOnly: true,
+		// Lax, not Strict, so the cookie is sent when Monzo redirects the browser back.
+		SameSite: http.SameSiteLaxMode,
+	}, nil
+}
+
+// finish checks the state Monzo returned against the request's cookie and uses the flow up.
+func (s *authStates) finish(r *http.Request, state string, now time.Time) (*authFlow, error) {
+	cookie, err := r.Cookie(authStateCookie)
+	if err != nil {
+		return nil, errAuthStateMissing
+	}
+
+	parts := strings.Split(cookie.Value, ".")
+	if len(parts) != 2 || !hmac.Equal([]byte(parts[1]), []byte(s.sign(parts[0]))) {
+		return nil, errAuthStateInvalid
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, errAuthStateInvalid
+	}
+	var flow authFlow
+	if err = json.Unmarshal(payload, &flow); err != nil || subtle.ConstantTimeCompare([]byte(flow.State), []byte(state)) != 1 {
+		return nil, errAuthStateInvalid
+	}
+	if !now.Before(flow.Expires) {
+		return nil, errAuthStateExpired
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for used, expires := range s.used {
+		if !now.Before(expires) {
+			delete(s.used, used)
+		}
+	}
+	if _, found := s.used[flow.State]; found {
+		return nil, errAuthStateUsed
+	}
+	s.used[flow.State] = flow.Expires
+	return &flow, nil
+}
+
+func (s *authStates) sign(value string) string {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(value))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// clearAuthStateCookie removes the flow's cookie from the browser.
+func clearAuthStateCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{Name: authStateCookie, Value: "", Path: "/", MaxAge: -1, HttpOnly: true})
+}
+
+// safeRedirect reports whether the target is a path on this site, so signing in cannot send the user elsewhere.
+func safeRedirect(target string) bool {
+	if !strings.HasPrefix(target, "/") || strings.HasPrefix(target, "//") || strings.HasPrefix(target, "/\\") {
+		return false
+	}
+	parsed, err := url.Parse(target)
+	return err == nil && parsed.Scheme == "" && parsed.Host == ""
+}
@@ -0,0 +1,230 @@
+package application
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/tmilner/monzo-customisation/adapters/monzorestclient"
+	"github.com/tmilner/monzo-customisation/adapters/monzorestclient/monzotest"
+)
+
+func TestMonzoCustomisation_authFlow(t *testing.T) {
+	fake := monzotest.CreateServer("client", "secret")
+	fake.AddAccount("user_1", "acc_1", "uk_retail", 10000)
+	// tokenDelay holds up the token exchange, in nanoseconds.
+	var tokenDelay int64
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/oauth2/token" {
+			time.Sleep(time.Duration(atomic.LoadInt64(&tokenDelay)))
+		}
+		fake.ServeHTTP(w, r)
+	}))
+	defer api.Close()
+
+	// login follows Monzo's redirects until the browser would be sent back to the app.
+	login := &http.Client{CheckRedirect: func(r *http.Request, via []*http.Request) error {
+		if r.URL.Host == "localhost" {
+			return http.ErrUseLastResponse
+		}
+		return nil
+	}}
+
+	tests := []struct {
+		name         string
+		redirect     string
+		tamper       func(query url.Values, cookie *http.Cookie)
+		wait         time.Duration
+		slowToken    bool
+		returnTwice  bool
+		wantStatus   int
+		wantLocation string
+	}{
+		{name: "Signs in", wantStatus: http.StatusOK},
+		{name: "Slower than the request timeout", slowToken: true, wantStatus: http.StatusOK},
+		{name: "Returns to the redirect", redirect: "/admin/budgets/user_1", wantStatus: http.StatusSeeOther, wantLocation: "/admin/budgets/user_1"},
+		{name: "Missing cookie", tamper: func(query url.Values, cookie *http.Cookie) { cookie.Name = "other" }, wantStatus: http.StatusBadRequest},
+		{name: "State from another flow", tamper: func(query url.Values, cookie *http.Cookie) { query.Set("state", "guessed") }, wantStatus: http.StatusBadRequest},
+		{name: "Tampered cookie", tamper: func(query url.Values, cookie *http.Cookie) { cookie.Value = "x" + cookie.Value[1:] }, wantStatus: http.StatusBadRequest},
+		{name: "Expired", wait: authStateLifetime, wantStatus: http.StatusBadRequest},
+		{name: "Used twice", returnTwice: true, wantStatus: http.StatusBadRequest},
+		{name: "Refused in Monzo", tamper: func(query url.Values, cookie *http.Cookie) { query.Set("error", "access_denied") }, wantStatus: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now := time.Now()
+			config := &Config{ClientId: "client", ClientSecret: "secret", MonzoAuthUrl: api.URL + "/auth", RedirectUri: "http://localhost/auth_return"}
+			client := monzorestclient.CreateMonzoRestClient(api.URL+"/", &http.Client{})
+			a := CreateMonzoCustomisation(client, config, &RuleSet{}, nil, nil).WithClock(func() time.Time { return now })
+			a.approvals.pollInterval = time.Millisecond
+			defer a.stopJobs()
+
+			feedItems := len(fake.FeedItems("acc_1"))
+
+			start := httptest.NewRecorder()
+			a.ServeHTTP(start, httptest.NewRequest("GET", "/auth_start?redirect="+url.QueryEscape(tt.redirect), nil))
+			cookies := start.Result().Cookies()
+			if start.Code != http.StatusSeeOther || len(cookies) != 1 {
+				t.Fatalf("Auth start = %d with cookies %v", start.Code, cookies)
+			}
+
+			res, err := login.Get(start.Header().Get("Location"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+			returned, _ := url.Parse(res.Header.Get("Location"))
+			query := returned.Query()
+			cookie := cookies[0]
+			if tt.tamper != nil {
+				tt.tamper(query, cookie)
+			}
+			now = now.Add(tt.wait)
+			if tt.slowToken {
+				atomic.StoreInt64(&tokenDelay, int64(1500*time.Millisecond))
+				defer atomic.StoreInt64(&tokenDelay, 0)
+			}
+
+			authReturn := func() *httptest.ResponseRecorder {
+				w := httptest.NewRecorder()
+				r := httptest.NewRequest("GET", "/auth_return?"+query.Encode(), nil)
+				r.AddCookie(cookie)
+				a.ServeHTTP(w, r)
+				return w
+			}
+			w := authReturn()
+			first := w
+			if tt.returnTwice {
+				w = authReturn()
+			}
+			if pending := first.Header().Get("Location"); strings.HasPrefix(pending, "/auth_pending/") {
+				finished := followApproval(t, a, pending)
+				if !tt.returnTwice {
+					w = finished
+				}
+			}
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("Auth return status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if location := w.Header().Get("Location"); location != tt.wantLocation {
+				t.Errorf("Auth return redirected to %q, want %q", location, tt.wantLocation)
+			}
+			if w.Code != http.StatusSeeOther && !strings.Contains(w.Header().Get("Content-Type"), "text/html") {
+				t.Errorf("Auth return Content-Type = %q, want a page", w.Header().Get("Content-Type"))
+			}
+			// The first of two returns signs the user in.
+			wantSignedIn := tt.wantStatus < 400 || tt.returnTwice
+			_, signedIn := a.user("user_1")
+			if signedIn != wantSignedIn {
+				t.Errorf("User signed in = %v, want %v", signedIn, wantSignedIn)
+			}
+			if signedIn {
+				// Let the welcome run finish before its context is cancelled.
+				waitFor(t, "the welcome feed item", func() bool { return len(fake.FeedItems("acc_1")) > feedItems })
+			}
+		})
+	}
+}
+
+// followApproval polls the page a user waits on while approving access until it stops refreshing.
+func followApproval(t *testing.T, a *MonzoCustomisation, path string) *httptest.ResponseRecorder {
+	var w *httptest.ResponseRecorder
+	waitFor(t, "sign in to be approved", func() bool {
+		w = httptest.NewRecorder()
+		a.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return !strings.Contains(w.Body.String(), `http-equiv="refresh"`)
+	})
+	return w
+}
+
+func TestMonzoCustomisation_approval(t *testing.T) {
+	tests := []struct {
+		name         string
+		approve      bool
+		wantStatus   int
+		wantSignedIn bool
+	}{
+		{name: "Approved in the app", approve: true, wantStatus: http.StatusOK, wantSignedIn: true},
+		{name: "Not approved in time", wantStatus: http.StatusGatewayTimeout},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := monzotest.CreateServer("client", "secret")
+			fake.AddAccount("user_1", "acc_1", "uk_retail", 10000)
+			fake.RequireApproval("user_1")
+			api := httptest.NewServer(fake)
+			defer api.Close()
+
+			client := monzorestclient.CreateMonzoRestClient(api.URL+"/", &http.Client{})
+			a := CreateMonzoCustomisation(client, &Config{WebhookURI: "https://monzo.example.com/webhook"}, &RuleSet{}, nil, nil)
+			a.approvals.pollInterval = time.Millisecond
+			a.approvals.timeout = 200 * time.Millisecond
+			defer a.stopJobs()
+
+			id, err := a.approvals.start("user_1", "", a.now())
+			if err != nil {
+				t.Fatal(err)
+			}
+			go a.completeSignIn(id, AuthFromResponse(fake.IssueToken("user_1"), a.now()))
+
+			w := httptest.NewRecorder()
+			a.ServeHTTP(w, httptest.NewRequest("GET", "/auth_pending/"+id, nil))
+			if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `http-equiv="refresh"`) {
+				t.Fatalf("Pending page = %d, want a page that refreshes: %s", w.Code, w.Body)
+			}
+			if _, signedIn := a.user("user_1"); signedIn {
+				t.Error("User signed in before approving access")
+			}
+			if tt.approve {
+				fake.Approve("user_1")
+			}
+
+			w = followApproval(t, a, "/auth_pending/"+id)
+			if w.Code != tt.wantStatus {
+				t.Errorf("Finished page status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if _, signedIn := a.user("user_1"); signedIn != tt.wantSignedIn {
+				t.Errorf("User signed in = %v, want %v", signedIn, tt.wantSignedIn)
+			}
+			if tt.wantSignedIn {
+				waitFor(t, "the webhook to be registered", func() bool { return len(fake.Webhooks("acc_1")) == 1 })
+			} else if webhooks := fake.Webhooks("acc_1"); len(webhooks) != 0 {
+				t.Errorf("Webhooks() = %+v, want none without approval", webhooks)
+			}
+		})
+	}
+
+	a := CreateMonzoCustomisation(&fakeFeedClient{}, &Config{}, &RuleSet{}, nil, nil)
+	w := httptest.NewRecorder()
+	a.ServeHTTP(w, httptest.NewRequest("GET", "/auth_pending/unknown", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Unknown pending sign in status = %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
+
+func TestSafeRedirect(t *testing.T) {
+	tests := []struct {
+		target string
+		want   bool
+	}{
+		{"/", true},
+		{"/admin/budgets/user_1?period=month", true},
+		{"https://evil.example.com/", false},
+		{"//evil.example.com/", false},
+		{"/\\evil.example.com", false},
+		{"budgets", false},
+		{"javascript:alert(1)", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.target, func(t *testing.T) {
+			if got := safeRedirect(tt.target); got != tt.want {
+				t.Errorf("safeRedirect(%q) = %v, want %v", tt.target, got, tt.want)
+			}
+		})
+	}
+}
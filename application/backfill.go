@@ -0,0 +1,108 @@
+package application
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/tmilner/monzo-customisation/adapters/ledger"
+	"github.com/tmilner/monzo-customisation/adapters/monzorestclient"
+)
+
+const backfillCheckpointEvery = 100
+
+// backfill copies the history of each of the user's accounts into the ledger. Monzo only allows the full
+// history to be read shortly after authentication, so this runs straight after the OAuth flow. Everything
+// from the start of the day the backfill began is left to processTodaysTransactions and the webhook.
+// With resumeOnly set, only backfills that were interrupted part way through are carried on. A backfill
+// stopped by ctx saves its progress and carries on from there next time.
+func (a *MonzoCustomisation) backfill(ctx context.Context, userId string, resumeOnly bool) {
+	if a.ledger == nil {
+		return
+	}
+
+	user, found := a.activeUser(userId)
+	if !found {
+		return
+	}
+
+	for _, account := range user.accounts {
+		a.backfillAccount(ctx, userId, account.id, resumeOnly)
+	}
+}
+
+func (a *MonzoCustomisation) backfillAccount(ctx context.Context, userId string, accountId string, resumeOnly bool) {
+	state, err := a.ledger.BackfillState(accountId)
+	if err != nil {
+		log.Printf("Unable to read backfill state for account %s: %+v", accountId, err)
+		return
+	}
+	if state != nil && state.Complete {
+		return
+	}
+	if state == nil {
+		if resumeOnly {
+			return
+		}
+		now := a.now()
+		state = &ledger.BackfillState{Before: time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())}
+	}
+
+	log.Printf("Backfilling account %s from %q up to %s", accountId, state.Cursor, state.Before.Format(time.RFC3339))
+
+	it := monzorestclient.CreateTransactionIterator(func(query monzorestclient.TransactionsQuery) (*monzorestclient.TransactionsResponse, error) {
+		return a.client.ListTransactions(ctx, accountId, a.accessToken(userId), query)
+	}, monzorestclient.TransactionsQuery{Since: state.Cursor, Before: state.Before})
+
+	failed := false
+	for it.Next() {
+		if _, err := a.ledger.Record(it.Transaction()); err != nil {
+			log.Printf("Backfill of account %s stopped, unable to record transaction: %+v", accountId, err)
+			failed = true
+			break
+		}
+		// History is never actioned, even if a late webhook for it turns up.
+		if err := a.ledger.MarkActioned(it.Transaction().Id); err != nil {
+			log.Printf("Backfill of account %s stopped, unable to mark transaction actioned: %+v", accountId, err)
+			failed = true
+			break
+		}
+		state.Cursor = it.Cursor()
+		state.Count++
+
+		if state.Count%backfillCheckpointEvery == 0 {
+			a.saveBackfillState(accountId, state)
+		}
+	}
+
+	if it.Err() != nil {
+		log.Printf("Backfill of account %s interrupted after %d transactions: %+v", accountId, state.Count, it.Err())
+		if user, found := a.user(userId); found {
+			a.checkApiError(user, it.Err())
+		}
+		a.saveBackfillState(accountId, state)
+		return
+	}
+	if failed {
+		a.saveBackfillState(accountId, state)
+		return
+	}
+
+	state.Complete = true
+	a.saveBackfillState(accountId, state)
+	log.Printf("Backfilled %d transactions for account %s", state.Count, accountId)
+}
+
+func (a *MonzoCustomisation) saveBackfillState(accountId string, state *ledger.BackfillState) {
+	state.Updated = a.now()
+	if err := a.ledger.SaveBackfillState(accountId, state); err != nil {
+		log.Printf("Unable to save backfill state for account %s: %+v", accountId, err)
+	}
+}
+
+func (a *MonzoCustomisation) accessToken(userId string) string {
+	if user, found := a.user(userId); found {
+		return user.accessToken()
+	}
+	return ""
+}
@@ -0,0 +1,136 @@
+package application
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/tmilner/monzo-customisation/adapters/ledger"
+	"github.com/tmilner/monzo-customisation/adapters/monzorestclient"
+)
+
+type fakeListClient struct {
+	MonzoClient
+	transactions []monzorestclient.TransactionDetailsResponse
+	failAfter    int
+	calls        int
+}
+
+func (f *fakeListClient) ListTransactions(ctx context.Context, accountId string, authToken string, query monzorestclient.TransactionsQuery) (*monzorestclient.TransactionsResponse, error) {
+	f.calls++
+	if f.failAfter > 0 && f.calls > f.failAfter {
+		return nil, errors.New("forbidden")
+	}
+
+	first := 0
+	for i, transaction := range f.transactions {
+		if transaction.Id == query.Since {
+			first = i + 1
+		}
+	}
+	last := first + query.Limit
+	if last > len(f.transactions) {
+		last = len(f.transactions)
+	}
+	return &monzorestclient.TransactionsResponse{Transactions: f.transactions[first:last]}, nil
+}
+
+// failingRecordLedger fails to record one transaction, as a full disk would.
+type failingRecordLedger struct {
+	*fakeLedger
+	failOn string
+}
+
+func (f *failingRecordLedger) Record(transaction *monzorestclient.TransactionDetailsResponse) (bool, error) {
+	if transaction.Id == f.failOn {
+		return false, errors.New("disk full")
+	}
+	return f.fakeLedger.Record(transaction)
+}
+
+func TestMonzoCustomisation_backfill(t *testing.T) {
+	transactions := make([]monzorestclient.TransactionDetailsResponse, 0)
+	for i := 0; i < 250; i++ {
+		transactions = append(transactions, monzorestclient.TransactionDetailsResponse{Id: fmt.Sprintf("tx_%03d", i), AccountId: "acc_1"})
+	}
+
+	user := &User{id: "user_1", auth: &Auth{AccessToken: "token"}}
+	user.accounts = []*Account{{id: "acc_1", user: user}}
+	store := &fakeLedger{recorded: map[string]bool{}, backfill: map[string]*ledger.BackfillState{}}
+	client := &fakeListClient{transactions: transactions, failAfter: 2}
+
+	a := &MonzoCustomisation{
+		now:    time.Now,
+		client: client,
+		users:  map[string]*User{user.id: user},
+		ledger: store,
+	}
+
+	a.backfill(context.Background(), user.id, false)
+
+	state := store.backfill["acc_1"]
+	if state == nil || state.Complete || state.Cursor != "tx_199" || len(store.recorded) != 200 {
+		t.Fatalf("Interrupted backfill state = %+v, recorded %d", state, len(store.recorded))
+	}
+
+	client.failAfter = 0
+	client.calls = 0
+	a.backfill(context.Background(), user.id, true)
+
+	state = store.backfill["acc_1"]
+	if !state.Complete || state.Count != 250 || len(store.recorded) != 250 {
+		t.Errorf("Resumed backfill state = %+v, recorded %d", state, len(store.recorded))
+	}
+	if client.calls != 1 {
+		t.Errorf("Resumed backfill made %d requests, want 1", client.calls)
+	}
+
+	client.calls = 0
+	a.backfill(context.Background(), user.id, false)
+	if client.calls != 0 {
+		t.Errorf("Completed backfill made %d requests, want 0", client.calls)
+	}
+}
+
+func TestMonzoCustomisation_backfill_ledgerFailure(t *testing.T) {
+	transactions := make([]monzorestclient.TransactionDetailsResponse, 0)
+	for i := 0; i < 150; i++ {
+		transactions = append(transactions, monzorestclient.TransactionDetailsResponse{Id: fmt.Sprintf("tx_%03d", i), AccountId: "acc_1"})
+	}
+
+	user := &User{id: "user_1", auth: &Auth{AccessToken: "token"}}
+	user.accounts = []*Account{{id: "acc_1", user: user}}
+	store := &failingRecordLedger{
+		fakeLedger: &fakeLedger{recorded: map[string]bool{}, backfill: map[string]*ledger.BackfillState{}},
+		failOn:     "tx_120",
+	}
+	client := &fakeListClient{transactions: transactions}
+
+	a := &MonzoCustomisation{
+		now:    time.Now,
+		client: client,
+		users:  map[string]*User{user.id: user},
+		ledger: store,
+	}
+
+	a.backfill(context.Background(), user.id, false)
+
+	state := store.backfill["acc_1"]
+	if state == nil || state.Complete || state.Cursor != "tx_119" || state.Count != 120 {
+		t.Fatalf("Failed backfill state = %+v", state)
+	}
+
+	store.failOn = ""
+	client.calls = 0
+	a.backfill(context.Background(), user.id, true)
+
+	state = store.backfill["acc_1"]
+	if !state.Complete || state.Count != 150 || len(store.recorded) != 150 {
+		t.Errorf("Resumed backfill state = %+v, recorded %d", state, len(store.recorded))
+	}
+	if client.calls != 1 {
+		t.Errorf("Resumed backfill made %d requests, want 1", client.calls)
+	}
+}
@@ -0,0 +1,289 @@
+package application
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/tmilner/monzo-customisation/adapters/monzorestclient"
+)
+
+const (
+	PeriodDay      = "day"
+	PeriodWeek     = "week"
+	PeriodMonth    = "month"
+	PeriodPayCycle = "pay_cycle"
+)
+
+var defaultBudgetThresholds = []int{50, 80, 100}
+
+// BudgetConfig limits spending on a Monzo category, a hashtag in the notes or a merchant over a period.
+// Weeks start on Monday and a pay cycle runs from PayDay in one month to PayDay in the next.
+// Each threshold, a percentage of Limit, sends a feed item the first time it is crossed in a period.
+type BudgetConfig struct {
+	Name       string `json:"name"`
+	UserId     string `json:"user_id,omitempty"`
+	Category   string `json:"category,omitempty"`
+	Hashtag    string `json:"hashtag,omitempty"`
+	Merchant   string `json:"merchant,omitempty"`
+	Limit      int64  `json:"limit"`
+	Period     string `json:"period"`
+	PayDay     int    `json:"pay_day,omitempty"`
+	Thresholds []int  `json:"thresholds,omitempty"`
+}
+
+type BudgetStatus struct {
+	Name        string    `json:"name"`
+	PeriodStart time.Time `json:"period_start"`
+	PeriodEnd   time.Time `json:"period_end"`
+	Spent       int64     `json:"spent"`
+	Limit       int64     `json:"limit"`
+	Percent     int64     `json:"percent"`
+}
+
+func LoadBudgets(path string) ([]*BudgetConfig, error) {
+	body, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var budgets []*BudgetConfig
+	if err = json.Unmarshal(body, &budgets); err != nil {
+		return nil, fmt.Errorf("unable to parse budgets file %s: %v", path, err)
+	}
+
+	for index, budget := range budgets {
+		if err = budget.validate(); err != nil {
+			return nil, fmt.Errorf("budget %d (%s): %v", index, budget.Name, err)
+		}
+	}
+	return budgets, nil
+}
+
+func (b *BudgetConfig) validate() error {
+	if b.Name == "" {
+		return errors.New("name is required")
+	}
+	if b.Category == "" && b.Hashtag == "" && b.Merchant == "" {
+		return errors.New("one of category, hashtag or merchant is required")
+	}
+	if b.Limit <= 0 {
+		return errors.New("limit must be a positive number of pence")
+	}
+	switch b.Period {
+	case PeriodDay, PeriodWeek, PeriodMonth:
+	case PeriodPayCycle:
+		if b.PayDay < 1 || b.PayDay > 28 {
+			return errors.New("pay_day must be between 1 and 28")
+		}
+	default:
+		return fmt.Errorf("unknown period %q", b.Period)
+	}
+	if len(b.Thresholds) == 0 {
+		b.Thresholds = defaultBudgetThresholds
+	}
+	sort.Ints(b.Thresholds)
+	for _, threshold := range b.Thresholds {
+		if threshold <= 0 {
+			return errors.New("thresholds must be positive percentages")
+		}
+	}
+	return nil
+}
+
+// period returns the start and end of the budget period containing t in the local time zone.
+func (b *BudgetConfig) period(t time.Time) (time.Time, time.Time) {
+	t = t.In(time.Local)
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.Local)
+
+	switch b.Period {
+	case PeriodWeek:
+		start := day.AddDate(0, 0, -((int(day.Weekday()) + 6) % 7))
+		return start, start.AddDate(0, 0, 7)
+	case PeriodMonth:
+		start := time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.Local)
+		return start, start.AddDate(0, 1, 0)
+	case PeriodPayCycle:
+		start := time.Date(t.Year(), t.Month(), b.PayDay, 0, 0, 0, 0, time.Local)
+		if t.Day() < b.PayDay {
+			start = start.AddDate(0, -1, 0)
+		}
+		return start, start.AddDate(0, 1, 0)
+	default:
+		return day, day.AddDate(0, 0, 1)
+	}
+}
+
+func (b *BudgetConfig) appliesToUser(userId string) bool {
+	return b.UserId == "" || b.UserId == userId
+}
+
+func (b *BudgetConfig) matches(transaction *monzorestclient.TransactionDetailsResponse) bool {
+	if !isSpending(transaction) {
+		return false
+	}
+	if b.Category != "" && b.Category != transaction.Category {
+		return false
+	}
+	if b.Merchant != "" && !strings.EqualFold(b.Merchant, transaction.Merchant.Name) {
+		return false
+	}
+	if b.Hashtag != "" && !containsHashtag(transaction.Notes, b.Hashtag) {
+		return false
+	}
+	return true
+}
+
+func containsHashtag(notes string, hashtag string) bool {
+	if !strings.HasPrefix(hashtag, "#") {
+		hashtag = "#" + hashtag
+	}
+	return monzorestclient.AppendHashtags(notes, hashtag) == notes
+}
+
+// budgetStatus adds up the matching spending across all of the user's accounts for the period containing at.
+func (a *MonzoCustomisation) budgetStatus(budget *BudgetConfig, user *User, at time.Time) (*BudgetStatus, error) {
+	start, end := budget.period(at)
+	status := &BudgetStatus{
+		Name:        budget.Name,
+		PeriodStart: start,
+		PeriodEnd:   end,
+		Limit:       budget.Limit,
+	}
+
+	for _, account := range user.accounts {
+		transactions, err := a.ledger.Query(account.id, start, end)
+		if err != nil {
+			return nil, err
+		}
+		for _, transaction := range transactions {
+			if budget.matches(transaction) {
+				status.Spent -= transaction.Amount
+			}
+		}
+	}
+
+	status.Percent = status.Spent * 100 / status.Limit
+	return status, nil
+}
+
+// checkBudgets sends a feed item for the highest threshold the transaction pushed each matching budget
+// over. The ledger remembers which thresholds have fired so each one only fires once per period, unless the
+// feed item could not be sent. The first failure is returned once every budget has been checked.
+func (a *MonzoCustomisation) checkBudgets(ctx context.Context, transaction *monzorestclient.TransactionDetailsResponse, account *Account) error {
+	if a.ledger == nil {
+		return nil
+	}
+
+	var failed error
+	fail := func(err error) {
+		if failed == nil {
+			failed = fmt.Errorf("checking budgets for transaction %s: %v", transaction.Id, err)
+		}
+	}
+
+	for _, budget := range a.config.Budgets {
+		if !budget.appliesToUser(account.user.id) || !budget.matches(transaction) {
+			continue
+		}
+
+		status, err := a.budgetStatus(budget, account.user, transaction.Created)
+		if err != nil {
+			log.Printf("Unable to work out budget %s: %+v", budget.Name, err)
+			fail(err)
+			continue
+		}
+
+		crossed := 0
+		marked := make([]string, 0)
+		for _, threshold := range budget.Thresholds {
+			if status.Percent < int64(threshold) {
+				break
+			}
+			key := fmt.Sprintf("%s/%s/%s/%d", account.user.id, budget.Name, status.PeriodStart.Format("2006-01-02"), threshold)
+			isNew, err := a.ledger.MarkBudgetAlert(key, a.now())
+			if err != nil {
+				log.Printf("Unable to record budget alert %s: %+v", key, err)
+				fail(err)
+				continue
+			}
+			if isNew {
+				crossed = threshold
+				marked = append(marked, key)
+			}
+		}
+		if crossed == 0 {
+			continue
+		}
+
+		log.Printf("Budget %s is at %d%%", budget.Name, status.Percent)
+		params := &monzorestclient.Params{
+			Title:    fmt.Sprintf("%s budget: %d%% used", budget.Name, crossed),
+			Body:     fmt.Sprintf("You've spent £%.2f of your £%.2f %s budget this %s.", float64(status.Spent)/100, float64(status.Limit)/100, budget.Name, periodName(budget.Period)),
+			ImageUrl: a.config.FeedImageUrl,
+		}
+		if err := a.createFeedItem(ctx, account, params); err != nil {
+			log.Printf("Error creating budget feed item for %s: %+v", budget.Name, err)
+			fail(err)
+			// Forget the thresholds so the alert is sent when the transaction is retried.
+			for _, key := range marked {
+				if err := a.ledger.ClearBudgetAlert(key); err != nil {
+					log.Printf("Unable to clear budget alert %s: %+v", key, err)
+				}
+			}
+		}
+	}
+	return failed
+}
+
+func periodName(period string) string {
+	if period == PeriodPayCycle {
+		return "pay cycle"
+	}
+	return period
+}
+
+// BudgetStatus reports the current state of every budget that applies to the user.
+func (a *MonzoCustomisation) BudgetStatus(userId string) ([]*BudgetStatus, error) {
+	if a.ledger == nil {
+		return nil, errors.New("budgets need a ledger")
+	}
+
+	user, found := a.user(userId)
+	if !found {
+		return nil, errors.New("user not found")
+	}
+
+	statuses := make([]*BudgetStatus, 0)
+	now := a.now()
+	for _, budget := range a.config.Budgets {
+		if !budget.appliesToUser(userId) {
+			continue
+		}
+		status, err := a.budgetStatus(budget, user, now)
+		if err != nil {
+			return nil, err
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+func (a *MonzoCustomisation) budgetsHandler(w http.ResponseWriter, r *http.Request) {
+	statuses, err := a.BudgetStatus(mux.Vars(r)["userId"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(statuses)
+}
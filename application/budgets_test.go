@@ -0,0 +1,117 @@
+package application
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/tmilner/monzo-customisation/adapters/ledger"
+	"github.com/tmilner/monzo-customisation/adapters/monzorestclient"
+)
+
+type fakeFeedClient struct {
+	MonzoClient
+	items []*monzorestclient.FeedItem
+}
+
+func (f *fakeFeedClient) CreateFeedItem(ctx context.Context, item *monzorestclient.FeedItem, authToken string) error {
+	f.items = append(f.items, item)
+	return nil
+}
+
+func TestBudgetConfig_period(t *testing.T) {
+	at := time.Date(2019, time.March, 13, 15, 30, 0, 0, time.Local)
+	tests := []struct {
+		name      string
+		budget    BudgetConfig
+		wantStart time.Time
+		wantEnd   time.Time
+	}{
+		{"Day", BudgetConfig{Period: PeriodDay}, time.Date(2019, time.March, 13, 0, 0, 0, 0, time.Local), time.Date(2019, time.March, 14, 0, 0, 0, 0, time.Local)},
+		{"Week starts on Monday", BudgetConfig{Period: PeriodWeek}, time.Date(2019, time.March, 11, 0, 0, 0, 0, time.Local), time.Date(2019, time.March, 18, 0, 0, 0, 0, time.Local)},
+		{"Month", BudgetConfig{Period: PeriodMonth}, time.Date(2019, time.March, 1, 0, 0, 0, 0, time.Local), time.Date(2019, time.April, 1, 0, 0, 0, 0, time.Local)},
+		{"Pay cycle after pay day", BudgetConfig{Period: PeriodPayCycle, PayDay: 10}, time.Date(2019, time.March, 10, 0, 0, 0, 0, time.Local), time.Date(2019, time.April, 10, 0, 0, 0, 0, time.Local)},
+		{"Pay cycle before pay day", BudgetConfig{Period: PeriodPayCycle, PayDay: 25}, time.Date(2019, time.February, 25, 0, 0, 0, 0, time.Local), time.Date(2019, time.March, 25, 0, 0, 0, 0, time.Local)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start, end := tt.budget.period(at)
+			if !start.Equal(tt.wantStart) || !end.Equal(tt.wantEnd) {
+				t.Errorf("BudgetConfig.period() = %v - %v, want %v - %v", start, end, tt.wantStart, tt.wantEnd)
+			}
+		})
+	}
+}
+
+func TestMonzoCustomisation_checkBudgets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "budgets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	transactions, err := ledger.CreateLedger(filepath.Join(dir, "ledger.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer transactions.Close()
+
+	budget := &BudgetConfig{Name: "Coffee", Hashtag: "coffee", Limit: 1000, Period: PeriodWeek}
+	if err = budget.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	user := &User{id: "user_1", auth: &Auth{AccessToken: "token"}}
+	current := &Account{id: "acc_1", user: user}
+	joint := &Account{id: "acc_2", user: user}
+	user.accounts = []*Account{current, joint}
+	client := &fakeFeedClient{}
+
+	a := &MonzoCustomisation{
+		now:      time.Now,
+		client:   client,
+		config:   &Config{Budgets: []*BudgetConfig{budget}},
+		users:    map[string]*User{user.id: user},
+		accounts: map[string]*Account{current.id: current, joint.id: joint},
+		ledger:   transactions,
+	}
+
+	created := time.Now()
+	spend := []struct {
+		account   *Account
+		amount    int64
+		notes     string
+		wantItems int
+	}{
+		{current, -300, "#coffee", 0},
+		{current, -250, "#coffee", 1},
+		{joint, -100, "with Sam #coffee", 1},
+		{current, -5000, "#groceries", 1},
+		{joint, -300, "#coffee", 2},
+		{current, -400, "#coffee", 3},
+		{current, -400, "#coffee", 3},
+	}
+	for i, s := range spend {
+		transaction := &monzorestclient.TransactionDetailsResponse{
+			Id:        string(rune('a' + i)),
+			AccountId: s.account.id,
+			Amount:    s.amount,
+			Notes:     s.notes,
+			Created:   created,
+		}
+		if _, err = transactions.Record(transaction); err != nil {
+			t.Fatal(err)
+		}
+		a.checkBudgets(context.Background(), transaction, s.account)
+		if len(client.items) != s.wantItems {
+			t.Fatalf("After transaction %d there were %d feed items, want %d", i, len(client.items), s.wantItems)
+		}
+	}
+
+	statuses, err := a.BudgetStatus(user.id)
+	if err != nil || len(statuses) != 1 || statuses[0].Spent != 1750 || statuses[0].Percent != 175 {
+		t.Errorf("BudgetStatus() = %+v, %v", statuses, err)
+	}
+}
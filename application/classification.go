@@ -0,0 +1,85 @@
+package application
+
+import (
+	"strings"
+
+	"github.com/tmilner/monzo-customisation/adapters/monzorestclient"
+)
+
+// TransactionKind is what a transaction did with the money, worked out from the webhook payload.
+type TransactionKind string
+
+const (
+	KindCardSpend     TransactionKind = "card_spend"
+	KindPotTransfer   TransactionKind = "pot_transfer"
+	KindFasterPayment TransactionKind = "faster_payment"
+	KindDirectDebit   TransactionKind = "direct_debit"
+	KindAtm           TransactionKind = "atm"
+	KindRefund        TransactionKind = "refund"
+	KindTopUp         TransactionKind = "top_up"
+	KindInterest      TransactionKind = "interest"
+	KindOther         TransactionKind = "other"
+)
+
+// Payment schemes Monzo reports on transactions.
+const (
+	schemeCard          = "mastercard"
+	schemePot           = "uk_retail_pot"
+	schemeFasterPayment = "payport_faster_payments"
+	schemeBacs          = "bacs"
+)
+
+// ClassifyTransaction checks the most specific signals first: pot transfers carry a pot scheme or pot
+// metadata even when they have a description, and top ups are flagged by is_load whatever their scheme.
+func ClassifyTransaction(transaction *monzorestclient.TransactionDetailsResponse) TransactionKind {
+	switch {
+	case transaction.Scheme == schemePot,
+		transaction.Metadata["pot_id"] != "",
+		strings.HasPrefix(transaction.Description, "pot_"):
+		return KindPotTransfer
+	case transaction.IsLoad:
+		return KindTopUp
+	case transaction.Merchant.Atm, transaction.Category == "cash" && transaction.Scheme == schemeCard:
+		return KindAtm
+	case transaction.Scheme == schemeFasterPayment:
+		return KindFasterPayment
+	case transaction.Scheme == schemeBacs:
+		return KindDirectDebit
+	case transaction.Merchant.Id != "" || transaction.Scheme == schemeCard:
+		if transaction.Amount > 0 {
+			return KindRefund
+		}
+		return KindCardSpend
+	case transaction.Amount > 0 && isInterest(transaction):
+		return KindInterest
+	default:
+		return KindOther
+	}
+}
+
+func isInterest(transaction *monzorestclient.TransactionDetailsResponse) bool {
+	return transaction.Metadata["interest_payment"] != "" ||
+		strings.HasPrefix(strings.ToLower(transaction.Description), "interest")
+}
+
+// isSpending reports whether the transaction is money leaving the user's control. Declined payments and
+// money moved into the user's own pots are not spending, and nor is anything coming in.
+func isSpending(transaction *monzorestclient.TransactionDetailsResponse) bool {
+	if transaction.Amount >= 0 || transaction.DeclineReason != "" {
+		return false
+	}
+	switch ClassifyTransaction(transaction) {
+	case KindCardSpend, KindFasterPayment, KindDirectDebit, KindAtm, KindOther:
+		return true
+	default:
+		return false
+	}
+}
+
+// countsTowardsDailyTotal is spending plus refunds, which give back money spent earlier.
+func countsTowardsDailyTotal(transaction *monzorestclient.TransactionDetailsResponse) bool {
+	if transaction.DeclineReason != "" {
+		return false
+	}
+	return isSpending(transaction) || ClassifyTransaction(transaction) == KindRefund
+}
@@ -0,0 +1,98 @@
+package application
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/tmilner/monzo-customisation/adapters/monzorestclient"
+)
+
+func loadWebhookFixture(t *testing.T, name string) *monzorestclient.TransactionDetailsResponse {
+	body, err := ioutil.ReadFile(filepath.Join("testdata", "webhooks", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var webhook WebhookResponse
+	if err = json.Unmarshal(body, &webhook); err != nil {
+		t.Fatalf("Unable to parse %s: %v", name, err)
+	}
+	return &webhook.Data
+}
+
+func TestClassifyTransaction(t *testing.T) {
+	tests := []struct {
+		fixture      string
+		want         TransactionKind
+		wantSpending bool
+		wantCounted  bool
+	}{
+		{"card_spend.json", KindCardSpend, true, true},
+		{"pot_transfer_deposit.json", KindPotTransfer, false, false},
+		{"pot_transfer_withdrawal.json", KindPotTransfer, false, false},
+		{"faster_payment.json", KindFasterPayment, true, true},
+		{"direct_debit.json", KindDirectDebit, true, true},
+		{"atm.json", KindAtm, true, true},
+		{"refund.json", KindRefund, false, true},
+		{"top_up.json", KindTopUp, false, false},
+		{"interest.json", KindInterest, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.fixture, func(t *testing.T) {
+			transaction := loadWebhookFixture(t, tt.fixture)
+			if got := ClassifyTransaction(transaction); got != tt.want {
+				t.Errorf("ClassifyTransaction() = %s, want %s", got, tt.want)
+			}
+			if got := isSpending(transaction); got != tt.wantSpending {
+				t.Errorf("isSpending() = %v, want %v", got, tt.wantSpending)
+			}
+			if got := countsTowardsDailyTotal(transaction); got != tt.wantCounted {
+				t.Errorf("countsTowardsDailyTotal() = %v, want %v", got, tt.wantCounted)
+			}
+		})
+	}
+}
+
+func TestClassifyTransaction_declined(t *testing.T) {
+	transaction := loadWebhookFixture(t, "card_spend.json")
+	transaction.DeclineReason = "INSUFFICIENT_FUNDS"
+
+	if isSpending(transaction) || countsTowardsDailyTotal(transaction) {
+		t.Error("Declined payments should not count as spending")
+	}
+}
+
+func TestMonzoCustomisation_handleTransaction_potTransfer(t *testing.T) {
+	user := &User{id: "User123", auth: &Auth{AccessToken: "token"}}
+	account := &Account{id: "acc_00008gju41AHyfLUzBUk8A", type_: "uk_retail", user: user}
+	user.accounts = []*Account{account}
+	client := &fakeFeedClient{}
+
+	a := &MonzoCustomisation{
+		now:      time.Now,
+		executor: startedExecutor(1),
+		client:   client,
+		config:   &Config{},
+		users:    map[string]*User{user.id: user},
+		accounts: map[string]*Account{account.id: account},
+		rules:    &RuleSet{},
+	}
+
+	created := time.Now()
+	for _, fixture := range []string{"pot_transfer_deposit.json", "card_spend.json"} {
+		transaction := loadWebhookFixture(t, fixture)
+		transaction.Created = created
+		a.handleTransaction(context.Background(), transaction)
+	}
+
+	dailyInfo, _ := account.dailyInfo.Load(timeToDate(created))
+	if total := dailyInfo.(DailyInfo).total; total != -350 {
+		t.Errorf("Daily total = %d, want only the card payment of -350", total)
+	}
+	if len(client.items) != 0 {
+		t.Errorf("Feed items = %v, moving money into a pot should not trigger a spending alert", client.items)
+	}
+}
@@ -0,0 +1,256 @@
+package application
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	DefaultListenAddr    = ":80"
+	DefaultMonzoApiUrl   = "https://api.monzo.com/"
+	DefaultMonzoAuthUrl  = "https://auth.monzo.com"
+	DefaultMonzoTokenUrl = "https://api.monzo.com/oauth2/token"
+	DefaultFeedImageUrl  = "https://d33wubrfki0l68.cloudfront.net/673084cc885831461ab2cdd1151ad577cda6a49a/92a4d/static/images/favicon.png"
+	DefaultFeedUrl       = "http://tmilner.co.uk"
+	DefaultTimezone      = "Europe/London"
+)
+
+const redacted = "[redacted]"
+
+// Config is everything the application needs to run. It is loaded from an optional YAML file and then
+// overridden by environment variables, see configSettings for the names of each.
+type Config struct {
+	ClientId          string `yaml:"client_id"`
+	ClientSecret      string `yaml:"client_secret,omitempty"`
+	ClientSecretFile  string `yaml:"client_secret_file,omitempty"`
+	URI               string `yaml:"uri"`
+	WebhookURI        string `yaml:"webhook_uri"`
+	RedirectUri       string `yaml:"redirect_uri"`
+	ListenAddr        string `yaml:"listen_addr"`
+	MonzoApiUrl       string `yaml:"monzo_api_url"`
+	MonzoAuthUrl      string `yaml:"monzo_auth_url"`
+	MonzoTokenUrl     string `yaml:"monzo_token_url"`
+	FeedImageUrl      string `yaml:"feed_image_url"`
+	FeedUrl           string `yaml:"feed_url"`
+	RulesFile         string `yaml:"rules_file,omitempty"`
+	RoundUpsFile      string `yaml:"round_ups_file,omitempty"`
+	BudgetsFile       string `yaml:"budgets_file,omitempty"`
+	TokenStorePath    string `yaml:"token_store_path"`
+	TokenKeys         string `yaml:"token_keys,omitempty"`
+	TokenKeysFile     string `yaml:"token_keys_file,omitempty"`
+	LedgerPath        string `yaml:"ledger_path"`
+	AdminToken        string `yaml:"admin_token,omitempty"`
+	AdminTokenFile    string `yaml:"admin_token_file,omitempty"`
+	WebhookAllowedIps string `yaml:"webhook_allowed_ips,omitempty"`
+	WebhookIpHeader   string `yaml:"webhook_ip_header,omitempty"`
+	VerifyWebhooks    string `yaml:"verify_webhooks,omitempty"`
+	Timezone          string `yaml:"timezone"`
+
+	RoundUps []*RoundUpConfig `yaml:"-"`
+	Budgets  []*BudgetConfig  `yaml:"-"`
+}
+
+// configSetting ties a config file key to the environment variable that overrides it.
+// Secrets can also be read from the file named by the key or variable with a _file suffix.
+type configSetting struct {
+	key   string
+	env   string
+	value func(c *Config) *string
+	file  func(c *Config) *string
+}
+
+var configSettings = []configSetting{
+	{key: "client_id", env: "CLIENT_ID", value: func(c *Config) *string { return &c.ClientId }},
+	{key: "client_secret", env: "CLIENT_SECRET", value: func(c *Config) *string { return &c.ClientSecret }, file: func(c *Config) *string { return &c.ClientSecretFile }},
+	{key: "uri", env: "URI", value: func(c *Config) *string { return &c.URI }},
+	{key: "webhook_uri", env: "WEBHOOK_URI", value: func(c *Config) *string { return &c.WebhookURI }},
+	{key: "redirect_uri", env: "REDIRECT_URI", value: func(c *Config) *string { return &c.RedirectUri }},
+	{key: "listen_addr", env: "LISTEN_ADDR", value: func(c *Config) *string { return &c.ListenAddr }},
+	{key: "monzo_api_url", env: "MONZO_API_URL", value: func(c *Config) *string { return &c.MonzoApiUrl }},
+	{key: "monzo_auth_url", env: "MONZO_AUTH_URL", value: func(c *Config) *string { return &c.MonzoAuthUrl }},
+	{key: "monzo_token_url", env: "MONZO_TOKEN_URL", value: func(c *Config) *string { return &c.MonzoTokenUrl }},
+	{key: "feed_image_url", env: "FEED_IMAGE_URL", value: func(c *Config) *string { return &c.FeedImageUrl }},
+	{key: "feed_url", env: "FEED_URL", value: func(c *Config) *string { return &c.FeedUrl }},
+	{key: "rules_file", env: "RULES_FILE", value: func(c *Config) *string { return &c.RulesFile }},
+	{key: "round_ups_file", env: "ROUNDUPS_FILE", value: func(c *Config) *string { return &c.RoundUpsFile }},
+	{key: "budgets_file", env: "BUDGETS_FILE", value: func(c *Config) *string { return &c.BudgetsFile }},
+	{key: "token_store_path", env: "TOKEN_STORE_PATH", value: func(c *Config) *string { return &c.TokenStorePath }},
+	{key: "token_keys", env: "TOKEN_KEYS", value: func(c *Config) *string { return &c.TokenKeys }, file: func(c *Config) *string { return &c.TokenKeysFile }},
+	{key: "ledger_path", env: "LEDGER_PATH", value: func(c *Config) *string { return &c.LedgerPath }},
+	{key: "admin_token", env: "ADMIN_TOKEN", value: func(c *Config) *string { return &c.AdminToken }, file: func(c *Config) *string { return &c.AdminTokenFile }},
+	{key: "webhook_allowed_ips", env: "WEBHOOK_ALLOWED_IPS", value: func(c *Config) *string { return &c.WebhookAllowedIps }},
+	{key: "webhook_ip_header", env: "WEBHOOK_IP_HEADER", value: func(c *Config) *string { return &c.WebhookIpHeader }},
+	{key: "verify_webhooks", env: "VERIFY_WEBHOOKS", value: func(c *Config) *string { return &c.VerifyWebhooks }},
+	{key: "timezone", env: "TIMEZONE", value: func(c *Config) *string { return &c.Timezone }},
+}
+
+func DefaultConfig() *Config {
+	return &Config{
+		ListenAddr:     DefaultListenAddr,
+		MonzoApiUrl:    DefaultMonzoApiUrl,
+		MonzoAuthUrl:   DefaultMonzoAuthUrl,
+		MonzoTokenUrl:  DefaultMonzoTokenUrl,
+		FeedImageUrl:   DefaultFeedImageUrl,
+		FeedUrl:        DefaultFeedUrl,
+		TokenStorePath: "tokens.json",
+		LedgerPath:     "ledger.db",
+		Timezone:       DefaultTimezone,
+	}
+}
+
+// LoadConfig reads the YAML file at path over the defaults, skipping it if path is empty, then applies
+// the environment variables returned by getenv and reads any secrets kept in files. Setting a value in
+// the environment replaces a secret file from the config file and the other way round.
+// The result is not validated, call Validate before using it to serve.
+func LoadConfig(path string, getenv func(string) string) (*Config, error) {
+	config := DefaultConfig()
+
+	if path != "" {
+		body, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if err = yaml.UnmarshalStrict(body, config); err != nil {
+			return nil, fmt.Errorf("unable to parse config file %s: %v", path, err)
+		}
+	}
+
+	for _, setting := range configSettings {
+		value := getenv(setting.env)
+		if value != "" {
+			*setting.value(config) = value
+		}
+		if setting.file == nil {
+			continue
+		}
+
+		if file := getenv(setting.env + "_FILE"); file != "" {
+			if value != "" {
+				return nil, fmt.Errorf("only one of %s and %s_FILE can be set", setting.env, setting.env)
+			}
+			*setting.value(config) = ""
+			*setting.file(config) = file
+		} else if value != "" {
+			*setting.file(config) = ""
+		}
+
+		if file := *setting.file(config); file != "" {
+			if *setting.value(config) != "" {
+				return nil, fmt.Errorf("only one of %s and %s_file can be set", setting.key, setting.key)
+			}
+			secret, err := ioutil.ReadFile(file)
+			if err != nil {
+				return nil, fmt.Errorf("unable to read %s_file: %v", setting.key, err)
+			}
+			*setting.value(config) = strings.TrimSpace(string(secret))
+		}
+	}
+
+	if config.URI != "" {
+		base := strings.TrimSuffix(config.URI, "/")
+		if config.RedirectUri == "" {
+			config.RedirectUri = base + "/auth_return"
+		}
+		if config.WebhookURI == "" {
+			config.WebhookURI = base + "/webhook"
+		}
+	}
+
+	return config, nil
+}
+
+// Validate reports every problem with the config at once, naming the file key and environment variable for each.
+func (c *Config) Validate() error {
+	problems := make([]string, 0)
+	problem := func(key string, format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf("%s (%s): %s", key, configEnv(key), fmt.Sprintf(format, args...)))
+	}
+
+	for _, key := range []string{"client_id", "client_secret", "uri", "listen_addr", "token_store_path", "ledger_path"} {
+		if *configValue(c, key) == "" {
+			problem(key, "is required")
+		}
+	}
+
+	for _, key := range []string{"uri", "webhook_uri", "redirect_uri", "monzo_api_url", "monzo_auth_url", "monzo_token_url", "feed_image_url", "feed_url"} {
+		value := *configValue(c, key)
+		if value == "" {
+			continue
+		}
+		parsed, err := url.Parse(value)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			problem(key, "%q is not an absolute http or https URL", value)
+		}
+	}
+
+	if _, err := parseIpAllowlist(c.WebhookAllowedIps); err != nil {
+		problem("webhook_allowed_ips", "%v", err)
+	}
+	if _, err := strconv.ParseBool(c.VerifyWebhooks); c.VerifyWebhooks != "" && err != nil {
+		problem("verify_webhooks", "%q is not true or false", c.VerifyWebhooks)
+	}
+	if _, err := c.Location(); err != nil {
+		problem("timezone", "%q is not a known time zone", c.Timezone)
+	}
+
+	if len(problems) == 0 {
+		return nil
+	}
+	return errors.New("invalid config:\n  " + strings.Join(problems, "\n  "))
+}
+
+// verifyWebhooks reports whether webhooks are checked against the API before being handled.
+func (c *Config) verifyWebhooks() bool {
+	verify, _ := strconv.ParseBool(c.VerifyWebhooks)
+	return verify
+}
+
+// Location is the time zone that rule times of day are in.
+func (c *Config) Location() (*time.Location, error) {
+	return time.LoadLocation(c.Timezone)
+}
+
+// Redacted returns a copy of the config that is safe to print, with every secret value hidden.
+func (c *Config) Redacted() *Config {
+	copied := *c
+	for _, setting := range configSettings {
+		if setting.file != nil && *setting.value(&copied) != "" {
+			*setting.value(&copied) = redacted
+		}
+	}
+	return &copied
+}
+
+// String prints the effective config as YAML with secrets redacted.
+func (c *Config) String() string {
+	body, err := yaml.Marshal(c.Redacted())
+	if err != nil {
+		return err.Error()
+	}
+	return string(body)
+}
+
+func configValue(c *Config, key string) *string {
+	for _, setting := range configSettings {
+		if setting.key == key {
+			return setting.value(c)
+		}
+	}
+	panic("unknown config key " + key)
+}
+
+func configEnv(key string) string {
+	for _, setting := range configSettings {
+		if setting.key == key {
+			return setting.env
+		}
+	}
+	return ""
+}
@@ -0,0 +1,163 @@
+package application
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	write := func(name string, body string) string {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(body), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	configFile := write("config.yaml", "client_id: file-client\nclient_secret: file-secret\nuri: https://example.com/\nlisten_addr: :8080\n")
+	secretFile := write("secret", "secret-from-file\n")
+	unknownKey := write("unknown.yaml", "client_idd: typo\n")
+
+	tests := []struct {
+		name    string
+		path    string
+		env     map[string]string
+		got     func(c *Config) string
+		want    string
+		wantErr string
+	}{
+		{
+			name: "Defaults without a file",
+			got:  func(c *Config) string { return c.ListenAddr + " " + c.MonzoApiUrl + " " + c.MonzoAuthUrl },
+			want: ":80 https://api.monzo.com/ https://auth.monzo.com",
+		},
+		{
+			name: "File values and derived URIs",
+			path: configFile,
+			got: func(c *Config) string {
+				return c.ClientId + " " + c.ListenAddr + " " + c.RedirectUri + " " + c.WebhookURI
+			},
+			want: "file-client :8080 https://example.com/auth_return https://example.com/webhook",
+		},
+		{
+			name: "Environment overrides the file",
+			path: configFile,
+			env:  map[string]string{"CLIENT_ID": "env-client", "LISTEN_ADDR": ":9090"},
+			got:  func(c *Config) string { return c.ClientId + " " + c.ListenAddr },
+			want: "env-client :9090",
+		},
+		{
+			name: "Secret from a file replaces the file value",
+			path: configFile,
+			env:  map[string]string{"CLIENT_SECRET_FILE": secretFile},
+			got:  func(c *Config) string { return c.ClientSecret },
+			want: "secret-from-file",
+		},
+		{
+			name:    "Secret and secret file together",
+			env:     map[string]string{"CLIENT_SECRET": "a", "CLIENT_SECRET_FILE": secretFile},
+			wantErr: "only one of CLIENT_SECRET and CLIENT_SECRET_FILE",
+		},
+		{
+			name:    "Missing secret file",
+			env:     map[string]string{"ADMIN_TOKEN_FILE": filepath.Join(dir, "missing")},
+			wantErr: "unable to read admin_token_file",
+		},
+		{
+			name:    "Unknown keys are rejected",
+			path:    unknownKey,
+			wantErr: "field client_idd not found",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := LoadConfig(tt.path, func(key string) string { return tt.env[key] })
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("LoadConfig() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("LoadConfig() error = %v", err)
+			}
+			if value := tt.got(got); value != tt.want {
+				t.Errorf("LoadConfig() = %q, want %q", value, tt.want)
+			}
+		})
+	}
+}
+
+func TestConfig_Validate(t *testing.T) {
+	valid := func() *Config {
+		config := DefaultConfig()
+		config.ClientId = "client"
+		config.ClientSecret = "secret"
+		config.URI = "https://example.com"
+		return config
+	}
+
+	tests := []struct {
+		name   string
+		modify func(c *Config)
+		want   []string
+	}{
+		{"Valid", func(c *Config) {}, nil},
+		{"Missing required values", func(c *Config) { c.ClientId = ""; c.ClientSecret = "" }, []string{"client_id (CLIENT_ID): is required", "client_secret (CLIENT_SECRET): is required"}},
+		{"Relative URL", func(c *Config) { c.MonzoApiUrl = "api.monzo.com" }, []string{`monzo_api_url (MONZO_API_URL): "api.monzo.com" is not an absolute http or https URL`}},
+		{"Webhook allowlist", func(c *Config) { c.WebhookAllowedIps = "10.0.0.1, 192.168.0.0/16" }, nil},
+		{"Bad webhook verification", func(c *Config) { c.VerifyWebhooks = "sometimes" }, []string{`verify_webhooks (VERIFY_WEBHOOKS): "sometimes" is not true or false`}},
+		{"Unknown timezone", func(c *Config) { c.Timezone = "Europe/Atlantis" }, []string{`timezone (TIMEZONE): "Europe/Atlantis" is not a known time zone`}},
+		{"Bad webhook allowlist", func(c *Config) { c.WebhookAllowedIps = "10.0.0.1,monzo" }, []string{`webhook_allowed_ips (WEBHOOK_ALLOWED_IPS): "monzo" is not an IP or CIDR range`}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := valid()
+			tt.modify(config)
+			err := config.Validate()
+			if tt.want == nil {
+				if err != nil {
+					t.Errorf("Config.Validate() error = %v", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatal("Config.Validate() error = nil")
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("Config.Validate() error = %v, want it to mention %q", err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestConfig_String(t *testing.T) {
+	config := DefaultConfig()
+	config.ClientId = "client"
+	config.ClientSecret = "super-secret"
+	config.AdminToken = "admin-secret"
+	config.TokenKeys = "k1:c2VjcmV0"
+
+	printed := config.String()
+	for _, secret := range []string{"super-secret", "admin-secret", "c2VjcmV0"} {
+		if strings.Contains(printed, secret) {
+			t.Errorf("Config.String() leaked %q:\n%s", secret, printed)
+		}
+	}
+	if !strings.Contains(printed, "client_id: client") {
+		t.Errorf("Config.String() = %s, want the client id", printed)
+	}
+	if config.ClientSecret != "super-secret" {
+		t.Error("Config.String() modified the config")
+	}
+}
@@ -0,0 +1,109 @@
+package application
+
+import (
+	"errors"
+	"hash/fnv"
+	"sync"
+)
+
+const (
+	accountShards    = 16
+	accountQueueSize = 64
+)
+
+var (
+	errExecutorStopped    = errors.New("account executor stopped")
+	errExecutorNotStarted = errors.New("account executor not started")
+)
+
+// accountExecutor runs work for accounts on a fixed set of goroutines. Every account is owned by exactly
+// one of them, so work for an account runs one piece at a time in the order it was submitted and the
+// account's state needs no locks, while different accounts are handled in parallel.
+// Work must not submit to the executor itself, it would wait on its own goroutine.
+type accountExecutor struct {
+	shards  []chan func()
+	lock    sync.RWMutex
+	started bool
+	stopped bool
+	done    sync.WaitGroup
+}
+
+// createAccountExecutor makes the shards without starting them, call start before submitting work.
+func createAccountExecutor(shards int) *accountExecutor {
+	executor := &accountExecutor{shards: make([]chan func(), shards)}
+	for i := range executor.shards {
+		executor.shards[i] = make(chan func(), accountQueueSize)
+	}
+	return executor
+}
+
+// start runs a goroutine for each shard. It does nothing once the executor has been started or stopped.
+func (e *accountExecutor) start() {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	if e.started || e.stopped {
+		return
+	}
+	e.started = true
+	for _, work := range e.shards {
+		e.done.Add(1)
+		go e.runShard(work)
+	}
+}
+
+func (e *accountExecutor) runShard(work chan func()) {
+	defer e.done.Done()
+	for next := range work {
+		next()
+	}
+}
+
+// run does the work on the account's goroutine and waits for it to finish.
+func (e *accountExecutor) run(accountId string, work func()) error {
+	finished := make(chan struct{})
+	if err := e.submit(accountId, func() {
+		defer close(finished)
+		work()
+	}); err != nil {
+		return err
+	}
+	<-finished
+	return nil
+}
+
+// submit queues the work on the account's goroutine without waiting for it.
+func (e *accountExecutor) submit(accountId string, work func()) error {
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+
+	if e.stopped {
+		return errExecutorStopped
+	}
+	if !e.started {
+		return errExecutorNotStarted
+	}
+	e.shards[shardFor(accountId, len(e.shards))] <- work
+	return nil
+}
+
+// stop finishes the work already submitted and then stops the goroutines.
+func (e *accountExecutor) stop() {
+	e.lock.Lock()
+	if !e.stopped {
+		e.stopped = true
+		for _, work := range e.shards {
+			close(work)
+		}
+	}
+	e.lock.Unlock()
+
+	e.done.Wait()
+}
+
+// shardFor spreads keys evenly over shards, always putting the same key in the same shard.
+func shardFor(key string, shards int) int {
+	hash := fnv.New32a()
+	_, _ = hash.Write([]byte(key))
+	return int(hash.Sum32() % uint32(shards))
+}
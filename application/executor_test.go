@@ -0,0 +1,195 @@
+package application
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/tmilner/monzo-customisation/adapters/monzorestclient"
+)
+
+// startedExecutor is an executor ready for work, as Serve leaves it.
+func startedExecutor(shards int) *accountExecutor {
+	executor := createAccountExecutor(shards)
+	executor.start()
+	return executor
+}
+
+func TestAccountExecutor(t *testing.T) {
+	executor := createAccountExecutor(4)
+	if err := executor.submit("acc_1", func() {}); err != errExecutorNotStarted {
+		t.Fatalf("submit() before start() error = %v, want %v", err, errExecutorNotStarted)
+	}
+	executor.start()
+
+	var lock sync.Mutex
+	order := map[string][]int{}
+	var wait sync.WaitGroup
+	for _, accountId := range []string{"acc_1", "acc_2", "acc_3"} {
+		for i := 0; i < 50; i++ {
+			accountId, i := accountId, i
+			wait.Add(1)
+			if err := executor.submit(accountId, func() {
+				defer wait.Done()
+				lock.Lock()
+				order[accountId] = append(order[accountId], i)
+				lock.Unlock()
+			}); err != nil {
+				t.Fatalf("submit() error = %v", err)
+			}
+		}
+	}
+	wait.Wait()
+
+	for accountId, got := range order {
+		for i, value := range got {
+			if value != i {
+				t.Fatalf("Work for %s ran in order %v, want submission order", accountId, got)
+			}
+		}
+	}
+
+	// Work for one account blocking must not hold up another account on a different goroutine.
+	blocked := make(chan struct{})
+	first := "acc_1"
+	second := "acc_2"
+	for shardFor(second, 4) == shardFor(first, 4) {
+		second += "x"
+	}
+	_ = executor.submit(first, func() { <-blocked })
+	ran := make(chan struct{})
+	go func() {
+		_ = executor.run(second, func() {})
+		close(ran)
+	}()
+	select {
+	case <-ran:
+	case <-time.After(5 * time.Second):
+		t.Error("Work for another account waited on a blocked account")
+	}
+	close(blocked)
+
+	executor.stop()
+	if err := executor.run(first, func() {}); err != errExecutorStopped {
+		t.Errorf("run() after stop() error = %v, want %v", err, errExecutorStopped)
+	}
+}
+
+// slowUpdateClient stands in for Monzo taking a while to answer each annotation.
+type slowUpdateClient struct {
+	MonzoClient
+	latency time.Duration
+	updates int64
+}
+
+func (f *slowUpdateClient) UpdateTransaction(ctx context.Context, transactionId string, authToken string, metadata map[string]string) (*monzorestclient.TransactionDetailsResponse, error) {
+	time.Sleep(f.latency)
+	atomic.AddInt64(&f.updates, 1)
+	return &monzorestclient.TransactionDetailsResponse{Id: transactionId, Notes: metadata["notes"]}, nil
+}
+
+func createConcurrentCustomisation(shards int, accounts int, client MonzoClient) (*MonzoCustomisation, []*Account) {
+	rules, _ := CreateRuleSet([]*Rule{{Name: "Everything", Actions: RuleActions{AddHashtags: []string{"#seen"}}}})
+	a := CreateMonzoCustomisation(client, &Config{}, rules, nil, nil)
+	a.executor = startedExecutor(shards)
+
+	created := make([]*Account, accounts)
+	for i := range created {
+		user := &User{id: fmt.Sprintf("user_%d", i), auth: &Auth{AccessToken: "token"}}
+		created[i] = &Account{id: fmt.Sprintf("acc_%d", i), type_: "uk_retail", user: user}
+		user.accounts = []*Account{created[i]}
+		a.addUser(user)
+	}
+	return a, created
+}
+
+func TestMonzoCustomisation_handleTransaction_concurrent(t *testing.T) {
+	client := &slowUpdateClient{latency: time.Millisecond}
+	a, accounts := createConcurrentCustomisation(accountShards, 8, client)
+	defer a.executor.stop()
+
+	created := time.Now()
+	var wait sync.WaitGroup
+	for worker := 0; worker < 16; worker++ {
+		wait.Add(1)
+		go func(worker int) {
+			defer wait.Done()
+			for i := 0; i < 20; i++ {
+				account := accounts[(worker+i)%len(accounts)]
+				transaction := &monzorestclient.TransactionDetailsResponse{Id: fmt.Sprintf("tx_%d_%d", worker, i), AccountId: account.id, Amount: -100, Created: created}
+				if err := a.handleTransaction(context.Background(), transaction); err != nil {
+					t.Errorf("handleTransaction() error = %v", err)
+				}
+				// Token refreshes land while transactions are being handled.
+				a.updateAuth(&Auth{UserId: account.user.id, AccessToken: "refreshed"})
+			}
+		}(worker)
+	}
+	wait.Wait()
+
+	for _, account := range accounts {
+		info, _ := account.dailyInfo.Load(timeToDate(created))
+		if total := info.(DailyInfo).total; total != -4000 {
+			t.Errorf("Daily total for %s = %d, want -4000", account.id, total)
+		}
+	}
+	if updates := atomic.LoadInt64(&client.updates); updates != 320 {
+		t.Errorf("Updated %d transactions, want 320", updates)
+	}
+}
+
+func TestMonzoCustomisation_processTodaysTransactions(t *testing.T) {
+	client := &fakeTodayClient{transactions: []monzorestclient.TransactionDetailsResponse{
+		{Id: "tx_1", AccountId: "acc_0", Amount: -250, Created: time.Now()},
+		{Id: "tx_2", AccountId: "acc_0", Amount: -100, Created: time.Now()},
+	}}
+	a, accounts := createConcurrentCustomisation(2, 1, client)
+	defer a.executor.stop()
+
+	// Run twice, the first run used to release a lock it no longer held.
+	a.processTodaysTransactions(context.Background(), accounts[0].user.id)
+	a.processTodaysTransactions(context.Background(), accounts[0].user.id)
+	a.processTodaysTransactions(context.Background(), "unknown")
+
+	info, _ := accounts[0].dailyInfo.Load(timeToDate(time.Now()))
+	if total := info.(DailyInfo).total; total != -350 {
+		t.Errorf("Daily total = %d, want -350", total)
+	}
+}
+
+type fakeTodayClient struct {
+	slowUpdateClient
+	transactions []monzorestclient.TransactionDetailsResponse
+}
+
+func (f *fakeTodayClient) GetTransactionsSinceTimestamp(ctx context.Context, accountId string, authToken string, timestamp string) (*monzorestclient.TransactionsResponse, error) {
+	return &monzorestclient.TransactionsResponse{Transactions: f.transactions}, nil
+}
+
+// BenchmarkMonzoCustomisation_handleTransaction handles webhooks from many goroutines for 64 accounts while
+// Monzo takes 100µs to answer each annotation. With one shard every account waits on every other, as they
+// did behind the global lock.
+func BenchmarkMonzoCustomisation_handleTransaction(b *testing.B) {
+	for _, shards := range []int{1, accountShards} {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			a, accounts := createConcurrentCustomisation(shards, 64, &slowUpdateClient{latency: 100 * time.Microsecond})
+			defer a.executor.stop()
+
+			created := time.Now()
+			var next int64
+			b.SetParallelism(16)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					i := atomic.AddInt64(&next, 1)
+					account := accounts[i%int64(len(accounts))]
+					_ = a.handleTransaction(context.Background(), &monzorestclient.TransactionDetailsResponse{Id: fmt.Sprintf("tx_%d", i), AccountId: account.id, Amount: -100, Created: created})
+				}
+			})
+			b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "webhooks/s")
+		})
+	}
+}
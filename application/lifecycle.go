@@ -0,0 +1,126 @@
+package application
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"time"
+)
+
+// shutdownTimeout bounds how long Run waits for in flight webhooks once its context is done.
+const shutdownTimeout = 30 * time.Second
+
+// ErrAlreadyStarted is returned by Run when the service has already been started or shut down.
+var ErrAlreadyStarted = errors.New("already started")
+
+// Run restores stored users, starts the background jobs and serves on config.ListenAddr until ctx is done
+// or Shutdown is called. When ctx ends Run shuts down itself, giving in flight webhooks shutdownTimeout to finish.
+func (a *MonzoCustomisation) Run(ctx context.Context) error {
+	listener, err := net.Listen("tcp", a.config.ListenAddr)
+	if err != nil {
+		return err
+	}
+	return a.Serve(ctx, listener)
+}
+
+// Serve is Run on an existing listener, which is closed when Serve returns.
+func (a *MonzoCustomisation) Serve(ctx context.Context, listener net.Listener) error {
+	a.lifecycle.Lock()
+	if a.server != nil || a.draining {
+		a.lifecycle.Unlock()
+		_ = listener.Close()
+		return ErrAlreadyStarted
+	}
+	a.server = &http.Server{Handler: a, BaseContext: func(net.Listener) context.Context { return a.work }}
+	server := a.server
+	a.lifecycle.Unlock()
+
+	a.executor.start()
+	a.restoreUsers(a.jobs)
+	if a.workers != nil {
+		a.workers.start(a.work)
+	}
+	for _, roundUp := range a.config.RoundUps {
+		if roundUp.BatchDaily {
+			go a.runDailyRoundUps(a.jobs)
+			break
+		}
+	}
+
+	served := make(chan error, 1)
+	go func() {
+		log.Printf("Serving on %s", listener.Addr())
+		served <- server.Serve(listener)
+	}()
+
+	select {
+	case err := <-served:
+		if err == http.ErrServerClosed {
+			return nil
+		}
+		_ = a.drain()
+		return err
+	case <-ctx.Done():
+		log.Println("Shutting down")
+		return a.drain()
+	}
+}
+
+func (a *MonzoCustomisation) drain() error {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	return a.Shutdown(ctx)
+}
+
+// Shutdown stops accepting requests, cancels the background jobs and token refreshes and waits for in flight
+// webhooks to finish handling, queued webhooks not yet started are left for the next run. Webhooks that
+// arrive while draining are turned away so Monzo retries them.
+// If ctx ends first the Monzo calls still in flight are cancelled and ctx's error is returned.
+func (a *MonzoCustomisation) Shutdown(ctx context.Context) error {
+	a.lifecycle.Lock()
+	a.draining = true
+	server := a.server
+	if a.stopJobs != nil {
+		a.stopJobs()
+	}
+	a.lifecycle.Unlock()
+
+	var err error
+	if server != nil {
+		err = server.Shutdown(ctx)
+	}
+	a.tokenManager.stopAll()
+
+	drained := make(chan struct{})
+	go func() {
+		a.inFlight.Wait()
+		if a.workers != nil {
+			a.workers.stopAll()
+		}
+		a.executor.stop()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	if a.cancelWork != nil {
+		a.cancelWork()
+	}
+	return err
+}
+
+// startWebhook counts a webhook as in flight, unless the service is draining.
+func (a *MonzoCustomisation) startWebhook() bool {
+	a.lifecycle.Lock()
+	defer a.lifecycle.Unlock()
+
+	if a.draining {
+		return false
+	}
+	a.inFlight.Add(1)
+	return true
+}
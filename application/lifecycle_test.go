@@ -0,0 +1,183 @@
+package application
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/tmilner/monzo-customisation/adapters/ledger"
+	"github.com/tmilner/monzo-customisation/adapters/monzorestclient"
+	"github.com/tmilner/monzo-customisation/adapters/monzorestclient/monzotest"
+)
+
+// blockingLedger holds up recording each transaction until release is closed.
+type blockingLedger struct {
+	*fakeLedger
+	started chan string
+	release chan struct{}
+}
+
+func (f *blockingLedger) Record(transaction *monzorestclient.TransactionDetailsResponse) (bool, error) {
+	f.started <- transaction.Id
+	<-f.release
+	return f.fakeLedger.Record(transaction)
+}
+
+func webhookBody(transaction monzorestclient.TransactionDetailsResponse) *bytes.Reader {
+	body, _ := json.Marshal(WebhookResponse{TransactionType: transactionCreated, Data: transaction})
+	return bytes.NewReader(body)
+}
+
+func TestMonzoCustomisation_Serve(t *testing.T) {
+	fake := monzotest.CreateServer("client", "secret")
+	fake.AddAccount("user_1", "acc_1", "uk_retail", 10000)
+	api := httptest.NewServer(fake)
+	defer api.Close()
+	client := monzorestclient.CreateMonzoRestClient(api.URL+"/", &http.Client{})
+
+	transactions := &blockingLedger{
+		fakeLedger: &fakeLedger{recorded: map[string]bool{}, backfill: map[string]*ledger.BackfillState{}, roundUps: map[string]*ledger.RoundUp{}, alerts: map[string]bool{}},
+		started:    make(chan string, 1),
+		release:    make(chan struct{}),
+	}
+	a := CreateMonzoCustomisation(client, &Config{}, &RuleSet{}, &fakeTokenStore{}, transactions)
+	user := &User{id: "user_1", auth: &Auth{AccessToken: fake.IssueToken("user_1").AccessToken}}
+	account := &Account{id: "acc_1", type_: "uk_retail", user: user}
+	user.accounts = []*Account{account}
+	a.users[user.id] = user
+	a.accounts[account.id] = account
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	webhookUrl := "http://" + listener.Addr().String() + webhookPath(t, a, "acc_1")
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() { served <- a.Serve(ctx, listener) }()
+
+	go func() {
+		res, err := http.Post(webhookUrl, "application/json", webhookBody(monzorestclient.TransactionDetailsResponse{Id: "tx_1", AccountId: "acc_1", Amount: -6000, Created: time.Now()}))
+		if err == nil {
+			res.Body.Close()
+		}
+	}()
+	<-transactions.started
+
+	cancel()
+	select {
+	case err := <-served:
+		t.Fatalf("Serve() returned %v before the in flight webhook was handled", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(transactions.release)
+	if err := <-served; err != nil {
+		t.Fatalf("Serve() error = %v", err)
+	}
+	if items := fake.FeedItems("acc_1"); len(items) != 1 {
+		t.Errorf("FeedItems() = %+v, want the spending alert sent before shutdown finished", items)
+	}
+	if _, err := http.Post(webhookUrl, "application/json", nil); err == nil {
+		t.Error("Webhook server still accepting connections after shutdown")
+	}
+}
+
+func TestMonzoCustomisation_Shutdown(t *testing.T) {
+	transactions := &blockingLedger{
+		fakeLedger: &fakeLedger{recorded: map[string]bool{}},
+		started:    make(chan string, 1),
+		release:    make(chan struct{}),
+	}
+	a := CreateMonzoCustomisation(&fakeFeedClient{}, &Config{}, &RuleSet{}, nil, transactions)
+	a.executor.start()
+	account := &Account{id: "acc_1", user: &User{id: "user_1", auth: &Auth{}}}
+	a.accounts[account.id] = account
+
+	handled := make(chan struct{})
+	go func() {
+		a.webhookHandler(httptest.NewRecorder(), httptest.NewRequest("POST", "/webhook", webhookBody(monzorestclient.TransactionDetailsResponse{Id: "tx_1", AccountId: "acc_1", Amount: -100})))
+		close(handled)
+	}()
+	<-transactions.started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := a.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Shutdown() with a webhook in flight error = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	late := httptest.NewRecorder()
+	a.webhookHandler(late, httptest.NewRequest("POST", "/webhook", webhookBody(monzorestclient.TransactionDetailsResponse{Id: "tx_2", AccountId: "acc_1"})))
+	if late.Code != http.StatusServiceUnavailable {
+		t.Errorf("Webhook while draining status = %d, want %d", late.Code, http.StatusServiceUnavailable)
+	}
+
+	close(transactions.release)
+	<-handled
+	if err := a.Shutdown(context.Background()); err != nil {
+		t.Errorf("Shutdown() after draining error = %v", err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Serve(context.Background(), listener); err != ErrAlreadyStarted {
+		t.Errorf("Serve() after Shutdown() error = %v, want %v", err, ErrAlreadyStarted)
+	}
+}
+
+// cancellableUpdateClient holds up every annotation until its context is done.
+type cancellableUpdateClient struct {
+	MonzoClient
+	started   chan string
+	cancelled chan error
+}
+
+func (f *cancellableUpdateClient) UpdateTransaction(ctx context.Context, transactionId string, authToken string, metadata map[string]string) (*monzorestclient.TransactionDetailsResponse, error) {
+	f.started <- transactionId
+	<-ctx.Done()
+	f.cancelled <- ctx.Err()
+	return nil, ctx.Err()
+}
+
+func TestMonzoCustomisation_Shutdown_cancelsMonzoCalls(t *testing.T) {
+	client := &cancellableUpdateClient{started: make(chan string, 1), cancelled: make(chan error, 1)}
+	rules, _ := CreateRuleSet([]*Rule{{Name: "Everything", Actions: RuleActions{AddHashtags: []string{"#seen"}}}})
+	a := CreateMonzoCustomisation(client, &Config{}, rules, nil, nil).WithWebhookQueue(createMemoryQueue())
+	user := &User{id: "user_1", auth: &Auth{AccessToken: "token"}}
+	user.accounts = []*Account{{id: "acc_1", type_: "uk_retail", user: user}}
+	a.addUser(user)
+	a.executor.start()
+	a.workers.start(a.work)
+
+	w := httptest.NewRecorder()
+	a.ServeHTTP(w, httptest.NewRequest("POST", webhookPath(t, a, "acc_1"), webhookBody(monzorestclient.TransactionDetailsResponse{Id: "tx_1", AccountId: "acc_1", Amount: -100, Created: time.Now()})))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Webhook status = %d, want %d", w.Code, http.StatusOK)
+	}
+	<-client.started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := a.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Shutdown() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+	select {
+	case err := <-client.cancelled:
+		if err != context.Canceled {
+			t.Errorf("In flight call ended with %v, want %v", err, context.Canceled)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("In flight Monzo call was not cancelled when the shutdown timed out")
+	}
+
+	if err := a.Shutdown(context.Background()); err != nil {
+		t.Errorf("Shutdown() after cancelling error = %v", err)
+	}
+}
@@ -1,67 +1,148 @@
 package application
 
 import (
+	"context"
+	"crypto/subtle"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/gorilla/mux"
 	"github.com/justinas/alice"
+	"github.com/tmilner/monzo-customisation/adapters/ledger"
 	"github.com/tmilner/monzo-customisation/adapters/monzorestclient"
-	"github.com/twinj/uuid"
-	"io"
+	"github.com/tmilner/monzo-customisation/adapters/tokenstore"
+	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
+	"strings"
 	"sync"
 	"time"
 )
 
-//TODO [TM] Move response objects out of client impl and split up this into multiple files
+// TODO [TM] Move response objects out of client impl and split up this into multiple files
 type MonzoClient interface {
-	GetTransactions(accountId string, authToken string) (*monzorestclient.TransactionsResponse, error)
-	UpdateTransaction(transactionId string, authToken string, metadata map[string]string) (*monzorestclient.TransactionsResponse, error)
-	GetTransactionsSinceTimestamp(accountId string, authToken string, timestamp string) (*monzorestclient.TransactionsResponse, error)
-	GetPots(authToken string) (*monzorestclient.PotsResponse, error)
-	GetBalance(accountId string, authToken string) (*monzorestclient.BalanceResponse, error)
-	ListAccounts(authToken string) (*monzorestclient.AccountListResponse, error)
-	CreateFeedItem(item *monzorestclient.FeedItem, authToken string) error
-	RegisterWebhook(accountId string, accessToken string, uri string) error
-	Authenticate(code string, clientId string, clientSecret string, redirectUri string) (*monzorestclient.AuthResponse, error)
-	RefreshAuth(auth string, clientId string, clientSecret string) (*monzorestclient.AuthResponse, error)
-	WhoAmI(authToken string) (*monzorestclient.WhoAmIResponse, error)
+	GetTransactions(ctx context.Context, accountId string, authToken string) (*monzorestclient.TransactionsResponse, error)
+	UpdateTransaction(ctx context.Context, transactionId string, authToken string, metadata map[string]string) (*monzorestclient.TransactionDetailsResponse, error)
+	GetTransaction(ctx context.Context, transactionId string, authToken string) (*monzorestclient.TransactionDetailsResponse, error)
+	GetTransactionsSinceTimestamp(ctx context.Context, accountId string, authToken string, timestamp string) (*monzorestclient.TransactionsResponse, error)
+	ListTransactions(ctx context.Context, accountId string, authToken string, query monzorestclient.TransactionsQuery) (*monzorestclient.TransactionsResponse, error)
+	GetPots(ctx context.Context, authToken string) (*monzorestclient.PotsResponse, error)
+	DepositIntoPot(ctx context.Context, potId string, sourceAccountId string, amount int64, dedupeId string, authToken string) (*monzorestclient.PotResponse, error)
+	WithdrawFromPot(ctx context.Context, potId string, destinationAccountId string, amount int64, dedupeId string, authToken string) (*monzorestclient.PotResponse, error)
+	GetBalance(ctx context.Context, accountId string, authToken string) (*monzorestclient.BalanceResponse, error)
+	ListAccounts(ctx context.Context, authToken string) (*monzorestclient.AccountListResponse, error)
+	CreateFeedItem(ctx context.Context, item *monzorestclient.FeedItem, authToken string) error
+	RegisterWebhook(ctx context.Context, accountId string, accessToken string, uri string) error
+	ListWebhooks(ctx context.Context, accountId string, accessToken string) (*monzorestclient.WebhooksResponse, error)
+	DeleteWebhook(ctx context.Context, webhookId string, accessToken string) error
+	Authenticate(ctx context.Context, code string, clientId string, clientSecret string, redirectUri string) (*monzorestclient.AuthResponse, error)
+	RefreshAuth(ctx context.Context, auth string, clientId string, clientSecret string) (*monzorestclient.AuthResponse, error)
+	WhoAmI(ctx context.Context, authToken string) (*monzorestclient.WhoAmIResponse, error)
+}
+
+type TransactionLedger interface {
+	Record(transaction *monzorestclient.TransactionDetailsResponse) (bool, error)
+	MarkActioned(transactionId string) error
+	Actioned(transactionId string) (bool, error)
+	MarkActionDone(transactionId string, action string) error
+	ActionDone(transactionId string, action string) (bool, error)
+	Query(accountId string, from time.Time, to time.Time) ([]*monzorestclient.TransactionDetailsResponse, error)
+	BackfillState(accountId string) (*ledger.BackfillState, error)
+	SaveBackfillState(accountId string, state *ledger.BackfillState) error
+	SaveRoundUp(roundUp *ledger.RoundUp) error
+	SaveRoundUps(roundUps []*ledger.RoundUp) error
+	RoundUp(accountId string, transactionId string) (*ledger.RoundUp, error)
+	RoundUps(accountId string) ([]*ledger.RoundUp, error)
+	MarkBudgetAlert(key string, sent time.Time) (bool, error)
+	ClearBudgetAlert(key string) error
+}
+
+type TokenStore interface {
+	Save(token *tokenstore.Token) error
+	Load(userId string) (*tokenstore.Token, error)
+	LoadAll() ([]*tokenstore.Token, error)
+	Delete(userId string) error
 }
 
 type MonzoCustomisation struct {
 	client       MonzoClient
 	config       *Config
 	users        map[string]*User
-	usersLock    sync.RWMutex
 	accounts     map[string]*Account
-	accountsLock sync.RWMutex
-	ticker       *time.Ticker
-	stateToken   string
-}
-
-type Config struct {
-	ClientId     string
-	ClientSecret string
-	URI          string
-	WebhookURI   string
-	RedirectUri  string
+	directory    sync.RWMutex
+	executor     *accountExecutor
+	authStates   *authStates
+	approvals    *approvals
+	rules        *RuleSet
+	tokens       TokenStore
+	tokenManager *tokenManager
+	ledger       TransactionLedger
+	queue        WebhookQueue
+	// webhookTokens are the tokens accepted in each account's webhook URL, current first, under directory.
+	webhookTokens     map[string][]string
+	webhookTokenStore WebhookTokenStore
+	// webhookAllowlist is parsed from WebhookAllowedIps, nil allows every IP.
+	webhookAllowlist []*net.IPNet
+	verification     VerificationStats
+	workers          *webhookWorkerPool
+	now              func() time.Time
+	handler          http.Handler
+	server           *http.Server
+	jobs             context.Context
+	stopJobs         context.CancelFunc
+	work             context.Context
+	cancelWork       context.CancelFunc
+	draining         bool
+	inFlight         sync.WaitGroup
+	lifecycle        sync.Mutex
 }
 
+// User is shared by every account the user can see. Accounts are fixed once the user is added,
+// auth changes on every token refresh so it is only read and written under lock.
 type User struct {
 	id       string
 	auth     *Auth
 	accounts []*Account
+	lock     sync.RWMutex
+}
+
+func (u *User) accessToken() string {
+	u.lock.RLock()
+	defer u.lock.RUnlock()
+	return u.auth.AccessToken
+}
+
+func (u *User) currentAuth() *Auth {
+	u.lock.RLock()
+	defer u.lock.RUnlock()
+	return u.auth
+}
+
+func (u *User) setAuth(auth *Auth) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	u.auth = auth
+}
+
+// needsReauth reports whether Monzo has rejected the user's refresh token, nothing can be done for them
+// until they sign in again.
+func (u *User) needsReauth() bool {
+	u.lock.RLock()
+	defer u.lock.RUnlock()
+	return u.auth != nil && u.auth.NeedsReauth
 }
 
 type Auth struct {
 	AccessToken  string
 	ClientId     string
 	Expiry       int32
+	ExpiresAt    time.Time
 	RefreshToken string
 	TokenType    string
 	UserId       string
+	NeedsReauth  bool
 }
 
 type Account struct {
@@ -93,30 +174,68 @@ type WebhookResponse struct {
 	Data            monzorestclient.TransactionDetailsResponse `json:"data"`
 }
 
-func CreateMonzoCustomisation(client *monzorestclient.MonzoRestClient, config *Config) *MonzoCustomisation {
+// CreateMonzoCustomisation wires up the service without starting anything, the returned value is an
+// http.Handler for the webhook, auth and admin endpoints. Call Run to restore users and serve.
+func CreateMonzoCustomisation(client MonzoClient, config *Config, rules *RuleSet, tokens TokenStore, transactionLedger TransactionLedger) *MonzoCustomisation {
 	monzo := &MonzoCustomisation{
-		client:       client,
-		config:       config,
-		users:        map[string]*User{},
-		usersLock:    sync.RWMutex{},
-		accounts:     map[string]*Account{},
-		accountsLock: sync.RWMutex{},
-		ticker:       time.NewTicker(2 * time.Hour),
-		stateToken:   uuid.NewV4().String(),
+		client:        client,
+		config:        config,
+		users:         map[string]*User{},
+		accounts:      map[string]*Account{},
+		webhookTokens: map[string][]string{},
+		executor:      createAccountExecutor(accountShards),
+		authStates:    createAuthStates(),
+		approvals:     createApprovals(),
+		rules:         rules,
+		tokens:        tokens,
+		ledger:        transactionLedger,
+		now:           time.Now,
 	}
-	go monzo.extendAuth()
+	monzo.jobs, monzo.stopJobs = context.WithCancel(context.Background())
+	monzo.work, monzo.cancelWork = context.WithCancel(context.Background())
+	monzo.tokenManager = createTokenManager(client, config, monzo.updateAuth, monzo.markNeedsReauth)
+	monzo.webhookAllowlist = createWebhookAllowlist(config.WebhookAllowedIps)
 
-	errorChain := alice.New(loggerHandler, recoverHandler, timeoutHandler)
+	errorChain := alice.New(loggerHandler, recoverHandler)
 
 	router := mux.NewRouter()
-	router.HandleFunc("/webhook", monzo.webhookHandler).Methods("POST")
+	// Exchanging the sign in code can wait on the rate limiter and a slow token endpoint, so it is left out
+	// of the request timeout and given its own deadline.
 	router.HandleFunc("/auth_return", monzo.authReturnHandler).Methods("GET")
-	router.HandleFunc("/auth_start", monzo.authHandler).Methods("GET")
-	log.Println("Setting up webhook server")
-	_ = http.ListenAndServe(":80", errorChain.Then(router))
+
+	timed := router.NewRoute().Subrouter()
+	timed.Use(timeoutHandler)
+	webhook := monzo.webhookAuthHandler(http.HandlerFunc(monzo.webhookHandler))
+	timed.Handle("/webhook/{token}", webhook).Methods("POST")
+	timed.HandleFunc("/auth_start", monzo.authHandler).Methods("GET")
+	timed.HandleFunc("/auth_pending/{id}", monzo.approvalHandler).Methods("GET")
+
+	admin := timed.PathPrefix("/admin").Subrouter()
+	admin.Use(monzo.adminAuthHandler)
+	admin.HandleFunc("/budgets/{userId}", monzo.budgetsHandler).Methods("GET")
+	admin.HandleFunc("/dead_letters", monzo.deadLettersHandler).Methods("GET")
+	admin.HandleFunc("/dead_letters/{id}/retry", monzo.retryDeadLetterHandler).Methods("POST")
+	admin.HandleFunc("/dead_letters/{id}", monzo.deleteDeadLetterHandler).Methods("DELETE")
+	admin.HandleFunc("/webhooks/{accountId}/rotate", monzo.rotateWebhookHandler).Methods("POST")
+	admin.HandleFunc("/webhook_verification", monzo.verificationHandler).Methods("GET")
+	admin.HandleFunc("/status", monzo.statusHandler).Methods("GET")
+	monzo.handler = errorChain.Then(router)
 
 	return monzo
+}
+
+// WithClock replaces the clock used for dates, round ups, backfills and token refreshes.
+func (a *MonzoCustomisation) WithClock(now func() time.Time) *MonzoCustomisation {
+	a.now = now
+	a.tokenManager.now = now
+	if a.workers != nil {
+		a.workers.now = now
+	}
+	return a
+}
 
+func (a *MonzoCustomisation) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	a.handler.ServeHTTP(w, r)
 }
 
 func loggerHandler(h http.Handler) http.Handler {
@@ -139,49 +258,81 @@ func recoverHandler(next http.Handler) http.Handler {
 	})
 }
 
+// adminAuthHandler only lets requests through that carry the configured admin token.
+// With no token configured the admin API is switched off.
+func (a *MonzoCustomisation) adminAuthHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		expected := "Bearer " + a.config.AdminToken
+		if a.config.AdminToken == "" || subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte(expected)) != 1 {
+			http.NotFound(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
 func timeoutHandler(h http.Handler) http.Handler {
 	return http.TimeoutHandler(h, 1*time.Second, "timed out")
 }
 
-func (a *MonzoCustomisation) extendAuth() {
-	for {
-		select {
-		case <-a.ticker.C:
-			_ = a.refreshAuth()
-		}
-	}
+// user returns the user with the given id. The directory lock is only held to read the map, never
+// while calling out, so lookups cannot deadlock with the work done for an account.
+func (a *MonzoCustomisation) user(userId string) (*User, bool) {
+	a.directory.RLock()
+	defer a.directory.RUnlock()
+	user, found := a.users[userId]
+	return user, found
 }
 
-func (a *MonzoCustomisation) findUserForAccount(accountId string) (*User, error) {
-	if acc := a.accounts[accountId]; acc != nil {
-		return acc.user, nil
-	} else {
-		return nil, errors.New("cannot find Account")
-	}
+func (a *MonzoCustomisation) account(accountId string) (*Account, bool) {
+	a.directory.RLock()
+	defer a.directory.RUnlock()
+	account, found := a.accounts[accountId]
+	return account, found
 }
 
-func (a *MonzoCustomisation) processTodaysTransactions(userId string) {
-	defer a.usersLock.RUnlock()
-	defer a.accountsLock.Unlock()
+func (a *MonzoCustomisation) allAccounts() []*Account {
+	a.directory.RLock()
+	defer a.directory.RUnlock()
+	accounts := make([]*Account, 0, len(a.accounts))
+	for _, account := range a.accounts {
+		accounts = append(accounts, account)
+	}
+	return accounts
+}
 
-	a.usersLock.RLock()
-	a.accountsLock.Lock()
+// addUser makes the user and their accounts available, replacing any earlier copy of them.
+func (a *MonzoCustomisation) addUser(user *User) {
+	a.directory.Lock()
+	defer a.directory.Unlock()
+	a.users[user.id] = user
+	for _, account := range user.accounts {
+		a.accounts[account.id] = account
+	}
+}
 
-	var user = a.users[userId]
+func (a *MonzoCustomisation) processTodaysTransactions(ctx context.Context, userId string) {
+	user, found := a.activeUser(userId)
+	if !found {
+		return
+	}
 
-	var today = timeToDate(time.Now())
+	var today = timeToDate(a.now())
 
 	for _, acc := range user.accounts {
-		res, err := a.client.GetTransactionsSinceTimestamp(acc.id, user.auth.AccessToken, today)
+		res, err := a.client.GetTransactionsSinceTimestamp(ctx, acc.id, user.accessToken(), today)
 		if err != nil {
-			log.Println("Error getting transactions for today! :( ")
+			log.Printf("Error getting transactions for today: %+v", err)
+			a.checkApiError(user, err)
 			return
 		} else {
 			log.Printf("Got transactison! %d", len(res.Transactions))
 		}
 
 		for _, transact := range res.Transactions {
-			a.handleTransaction(&transact, true, true)
+			if err := a.handleTransaction(ctx, &transact); err != nil {
+				log.Printf("Unable to handle transaction %s: %+v", transact.Id, err)
+			}
 		}
 
 		if dailyTotal, found := acc.dailyInfo.Load(today); found {
@@ -190,32 +341,29 @@ func (a *MonzoCustomisation) processTodaysTransactions(userId string) {
 			log.Printf("Processed todays transactions [%d] for account %s. Found none.", len(res.Transactions), acc.type_)
 		}
 	}
-	a.usersLock.RUnlock()
-
 }
 
 func timeToDate(timestamp time.Time) string {
 	return time.Date(timestamp.Year(), timestamp.Month(), timestamp.Day(), 0, 0, 0, 0, timestamp.Location()).Format(time.RFC3339)
 }
 
-func (a *MonzoCustomisation) runBasicInfo(userId string) {
-	defer a.usersLock.RUnlock()
-	defer a.accountsLock.Unlock()
-	a.usersLock.RLock()
-	a.accountsLock.Lock()
-
-	user := a.users[userId]
-	authToken := a.users[userId].auth.AccessToken
+func (a *MonzoCustomisation) runBasicInfo(ctx context.Context, userId string) {
+	user, found := a.activeUser(userId)
+	if !found {
+		return
+	}
+	authToken := user.accessToken()
 
 	log.Println("Retrieving pots:")
-	pots, err := a.client.GetPots(authToken)
+	pots, err := a.client.GetPots(ctx, authToken)
 	if err != nil {
-		log.Fatalln("GetPots error", err)
-	}
-
-	for _, pot := range pots.Pots {
-		if !pot.Deleted {
-			log.Printf("Found a pot called %s, its got a balence of %d", pot.Name, pot.Balance)
+		log.Printf("GetPots error: %+v", err)
+		a.checkApiError(user, err)
+	} else {
+		for _, pot := range pots.Pots {
+			if !pot.Deleted {
+				log.Printf("Found a pot called %s, its got a balence of %d", pot.Name, pot.Balance)
+			}
 		}
 	}
 
@@ -223,45 +371,50 @@ func (a *MonzoCustomisation) runBasicInfo(userId string) {
 
 	for _, account := range user.accounts {
 		if !account.closed {
-			balance, err := a.client.GetBalance(account.id, authToken)
+			balance, err := a.client.GetBalance(ctx, account.id, authToken)
 			if err != nil {
 				log.Printf("Error getting balance: %+v", err)
+			} else {
+				log.Printf("Balance for account %s is %d", account.type_, balance.Balance)
 			}
-			log.Printf("Balance for account %s is %d", account.type_, balance.Balance)
 
 			params := &monzorestclient.Params{
 				Title:    "tmilner.co.uk Authenticated!",
 				Body:     "Woop Woop",
-				ImageUrl: "https://d33wubrfki0l68.cloudfront.net/673084cc885831461ab2cdd1151ad577cda6a49a/92a4d/static/images/favicon.png",
+				ImageUrl: a.config.FeedImageUrl,
 			}
 
 			log.Printf("Creating a feed item: %+v", params)
-			feedErr := a.createFeedItem(account.id, params, true, true)
+			feedErr := a.createFeedItem(ctx, account, params)
 			if feedErr != nil {
 				log.Printf("Feed error: %+v", feedErr)
 			}
 
-			err = a.registerWebhook(account.id)
-			if err != nil {
-				log.Printf("Error creting webhook: %+v", err)
+			if err := a.reconcileWebhooks(ctx, account); err != nil {
+				log.Printf("Error reconciling webhooks for account %s: %+v", account.id, err)
 			}
 		}
 	}
 }
 
-func (a *MonzoCustomisation) saveUserAndAccounts(response *Auth, usersLocked bool) error {
-	if !usersLocked {
-		defer a.usersLock.Unlock()
-		a.usersLock.Lock()
-	}
+func (a *MonzoCustomisation) saveUserAndAccounts(ctx context.Context, response *Auth) error {
 	user := &User{
 		id:       response.UserId,
 		auth:     response,
 		accounts: make([]*Account, 0),
 	}
-	a.users[response.UserId] = user
 
-	accountRes, err := a.client.ListAccounts(response.AccessToken)
+	a.persistAuth(response)
+	a.tokenManager.schedule(response)
+
+	err := a.loadAccounts(ctx, user)
+	a.addUser(user)
+	return err
+}
+
+// loadAccounts fetches the user's open accounts, call addUser to make them available to the webhook.
+func (a *MonzoCustomisation) loadAccounts(ctx context.Context, user *User) error {
+	accountRes, err := a.client.ListAccounts(ctx, user.accessToken())
 	if err != nil {
 		log.Printf("Failed to get account info for authorised account %+v", err)
 		return errors.New("failed to get account info")
@@ -275,7 +428,7 @@ func (a *MonzoCustomisation) saveUserAndAccounts(response *Auth, usersLocked boo
 			}
 
 			account := &Account{
-				id: acc.Id,
+				id:                    acc.Id,
 				processedTransactions: sync.Map{},
 				dailyInfo:             sync.Map{},
 				closed:                acc.Closed,
@@ -288,213 +441,500 @@ func (a *MonzoCustomisation) saveUserAndAccounts(response *Auth, usersLocked boo
 				user:                  user,
 			}
 
-			a.accountsLock.Lock()
-			a.accounts[acc.Id] = account
-			a.accountsLock.Unlock()
-
-			user = &User{
-				id:       user.id,
-				auth:     user.auth,
-				accounts: append(user.accounts, account),
+			if err := a.loadWebhookToken(account.id); err != nil {
+				log.Printf("Unable to load the webhook token for account %s: %+v", account.id, err)
 			}
+			user.accounts = append(user.accounts, account)
 		}
 	}
 
-	a.users[response.UserId] = user
-
 	return nil
 }
 
-func (a *MonzoCustomisation) refreshAuth() error {
-	log.Println("Refreshing auth")
+// restoreUsers loads the stored users and catches up on their transactions in the background until ctx is done.
+func (a *MonzoCustomisation) restoreUsers(ctx context.Context) {
+	if a.tokens == nil {
+		return
+	}
 
-	a.usersLock.Lock()
-	for _, user := range a.users {
-		res, err := a.client.RefreshAuth(user.auth.AccessToken, a.config.ClientId, a.config.ClientSecret)
-		if err != nil {
-			return err
+	tokens, err := a.tokens.LoadAll()
+	if err != nil {
+		log.Printf("Unable to load stored tokens: %+v", err)
+		return
+	}
+
+	for _, token := range tokens {
+		auth := Auth(*token)
+		if auth.NeedsReauth {
+			// The stored token is useless, keep the user visible in the status until they sign in again.
+			log.Printf("Restored user %s, they need to sign in again before anything is done for them", token.UserId)
+			a.addUser(&User{id: auth.UserId, auth: &auth, accounts: make([]*Account, 0)})
+			continue
+		}
+		if err := a.saveUserAndAccounts(ctx, &auth); err != nil {
+			log.Printf("Unable to restore user %s: %+v", token.UserId, err)
+			continue
 		}
+		log.Printf("Restored user %s", token.UserId)
+		go a.processTodaysTransactions(ctx, token.UserId)
+		go a.backfill(ctx, token.UserId, true)
+		go a.reconcileUserWebhooks(ctx, token.UserId)
+	}
+}
 
-		auth := Auth(*res)
-		return a.saveUserAndAccounts(&auth, true)
+func (a *MonzoCustomisation) updateAuth(auth *Auth) {
+	if user, found := a.user(auth.UserId); found {
+		user.setAuth(auth)
 	}
-	a.usersLock.Unlock()
 
-	return nil
+	a.persistAuth(auth)
 }
 
-func (a *MonzoCustomisation) createFeedItem(accountId string, params *monzorestclient.Params, hasAccountLock bool, hasUserReadLock bool) error {
-	if !hasAccountLock {
-		a.accountsLock.RLock()
-		defer a.accountsLock.RUnlock()
-	}
-	if !hasUserReadLock {
-		a.usersLock.RLock()
-		defer a.usersLock.RUnlock()
+// markNeedsReauth flags the user once Monzo has permanently rejected their refresh token. The flag is kept in
+// the token store so the user is not treated as healthy after a restart, and is cleared by signing in again.
+func (a *MonzoCustomisation) markNeedsReauth(userId string) {
+	var auth Auth
+	if user, found := a.user(userId); found {
+		auth = *user.currentAuth()
+	} else if a.tokens != nil {
+		token, err := a.tokens.Load(userId)
+		if err != nil {
+			log.Printf("Unable to flag user %s as needing to sign in again: %+v", userId, err)
+			return
+		}
+		auth = Auth(*token)
+	} else {
+		return
 	}
 
-	account, found := a.accounts[accountId]
+	auth.NeedsReauth = true
+	a.updateAuth(&auth)
+}
+
+// activeUser finds a user that work can be done for, leaving out users that need to sign in again.
+func (a *MonzoCustomisation) activeUser(userId string) (*User, bool) {
+	user, found := a.user(userId)
 	if !found {
-		return errors.New("account not found")
+		return nil, false
 	}
-
-	authToken := account.user.auth.AccessToken
-
-	feedItem := &monzorestclient.FeedItem{
-		AccountId: accountId,
-		TypeParam: "basic",
-		Url:       "http://tmilner.co.uk",
-		Params:    params,
+	if user.needsReauth() {
+		log.Printf("Skipping user %s, they need to sign in again", userId)
+		return nil, false
 	}
+	return user, true
+}
 
-	return a.client.CreateFeedItem(feedItem, authToken)
+// checkApiError reacts to a call made with the user's token failing. A 401 means Monzo no longer accepts
+// the token, so it is refreshed now rather than when it was due to expire.
+func (a *MonzoCustomisation) checkApiError(user *User, err error) {
+	switch {
+	case monzorestclient.IsUnauthorized(err):
+		if auth := user.currentAuth(); auth != nil && !auth.NeedsReauth {
+			log.Printf("Access token for user %s was rejected, refreshing it", user.id)
+			a.tokenManager.refreshNow(auth)
+		}
+	case monzorestclient.IsInsufficientPermissions(err):
+		log.Printf("User %s has not granted permission for this, they may need to approve access in the Monzo app", user.id)
+	case monzorestclient.IsRateLimited(err):
+		var apiErr *monzorestclient.APIError
+		errors.As(err, &apiErr)
+		log.Printf("Rate limited by Monzo for user %s, retry after %v", user.id, apiErr.RetryAfter)
+	}
 }
 
-func (a *MonzoCustomisation) registerWebhook(accountId string) error {
-	a.accountsLock.RLock()
-	account, found := a.accounts[accountId]
-	a.accountsLock.RUnlock()
+func (a *MonzoCustomisation) persistAuth(auth *Auth) {
+	if a.tokens == nil {
+		return
+	}
 
-	a.usersLock.RLock()
-	accessToken := account.user.auth.AccessToken
-	a.usersLock.RUnlock()
+	token := tokenstore.Token(*auth)
+	if err := a.tokens.Save(&token); err != nil {
+		log.Printf("Failed to persist token for user %s: %+v", auth.UserId, err)
+	}
+}
 
-	if !found {
-		return errors.New("account not found")
+func (a *MonzoCustomisation) createFeedItem(ctx context.Context, account *Account, params *monzorestclient.Params) error {
+	feedItem := &monzorestclient.FeedItem{
+		AccountId: account.id,
+		TypeParam: "basic",
+		Url:       a.config.FeedUrl,
+		Params:    params,
 	}
 
-	return a.client.RegisterWebhook(accountId, accessToken, a.config.WebhookURI)
+	err := a.client.CreateFeedItem(ctx, feedItem, account.user.accessToken())
+	a.checkApiError(account.user, err)
+	return err
 }
 
+// authHandler starts signing a user in with Monzo. The optional redirect query parameter is a path on this
+// site to send the user to once they have signed in.
 func (a *MonzoCustomisation) authHandler(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
 
-	uri := "https://auth.monzo.com/?client_id=" + a.config.ClientId + "&redirect_uri=" + a.config.RedirectUri + "&response_type=code&state=" + a.stateToken
+	redirect := r.URL.Query().Get("redirect")
+	if redirect != "" && !safeRedirect(redirect) {
+		writePage(w, http.StatusBadRequest, page{Title: "Unable to sign in", Message: "The page to return to after signing in must be on this site."})
+		return
+	}
 
-	http.Redirect(w, r, uri, 303)
+	flow, cookie, err := a.authStates.start(redirect, strings.HasPrefix(a.config.RedirectUri, "https://"), a.now())
+	if err != nil {
+		log.Printf("Unable to start sign in: %v", err)
+		writePage(w, http.StatusInternalServerError, page{Title: "Unable to sign in", Message: "Something went wrong starting to sign in, please try again."})
+		return
+	}
+	http.SetCookie(w, cookie)
+
+	query := url.Values{}
+	query.Set("client_id", a.config.ClientId)
+	query.Set("redirect_uri", a.config.RedirectUri)
+	query.Set("response_type", "code")
+	query.Set("state", flow.State)
+	http.Redirect(w, r, strings.TrimSuffix(a.config.MonzoAuthUrl, "/")+"/?"+query.Encode(), http.StatusSeeOther)
 }
 
 func (a *MonzoCustomisation) authReturnHandler(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
 	log.Println("Auth_Return received!")
-	code := r.URL.Query().Get("code")
-	stateReturned := r.URL.Query().Get("state")
+	startAgain := page{LinkText: "Sign in again", LinkUrl: "/auth_start"}
 
-	if stateReturned != a.stateToken {
-		log.Println("State token is not correct!")
-		_, _ = io.WriteString(w, "Fuck Off.")
+	flow, err := a.authStates.finish(r, r.URL.Query().Get("state"), a.now())
+	clearAuthStateCookie(w)
+	if err != nil {
+		log.Printf("Rejected sign in: %v", err)
+		startAgain.Title, startAgain.Message = "Unable to sign in", "This sign in link has expired or has already been used."
+		writePage(w, http.StatusBadRequest, startAgain)
+		return
+	}
+	if denied := r.URL.Query().Get("error"); denied != "" {
+		log.Printf("Sign in refused by Monzo: %s", denied)
+		startAgain.Title, startAgain.Message = "Sign in cancelled", "Monzo did not give access to your account."
+		writePage(w, http.StatusForbidden, startAgain)
 		return
 	}
 
-	res, err := a.client.Authenticate(code, a.config.ClientId, a.config.ClientSecret, a.config.RedirectUri)
+	ctx, cancel := context.WithTimeout(a.jobs, authExchangeTimeout)
+	defer cancel()
+	res, err := a.client.Authenticate(ctx, r.URL.Query().Get("code"), a.config.ClientId, a.config.ClientSecret, a.config.RedirectUri)
 	if err != nil {
-		w.WriteHeader(http.StatusUnauthorized)
-		_, _ = w.Write([]byte(err.Error()))
+		log.Printf("Unable to exchange the sign in code: %v", err)
+		startAgain.Title, startAgain.Message = "Unable to sign in", "Monzo did not accept the sign in."
+		writePage(w, http.StatusUnauthorized, startAgain)
 		return
 	}
-	auth := Auth(*res)
+	auth := AuthFromResponse(res, a.now())
 
-	err = a.saveUserAndAccounts(&auth, false)
+	// The new token has no permissions until the user approves access in the Monzo app, so wait for that
+	// in the background while the browser polls the pending page.
+	id, err := a.approvals.start(auth.UserId, flow.Redirect, a.now())
 	if err != nil {
+		log.Printf("Unable to start waiting for approval: %v", err)
+		startAgain.Title, startAgain.Message = "Unable to sign in", "Something went wrong finishing signing in, please try again."
+		writePage(w, http.StatusInternalServerError, startAgain)
 		return
 	}
+	go a.completeSignIn(id, auth)
 
-	go a.processTodaysTransactions(res.UserId)
-	go a.runBasicInfo(res.UserId)
-
-	_, _ = io.WriteString(w, "Suck it.")
+	http.Redirect(w, r, "/auth_pending/"+id, http.StatusSeeOther)
 }
 
 func (a *MonzoCustomisation) webhookHandler(w http.ResponseWriter, req *http.Request) {
 	defer req.Body.Close()
-	decoder := json.NewDecoder(req.Body)
-	var result WebhookResponse
-	err := decoder.Decode(&result)
+	if !a.startWebhook() {
+		http.Error(w, "shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	defer a.inFlight.Done()
 
+	body, err := ioutil.ReadAll(req.Body)
+	var result WebhookResponse
+	if err == nil {
+		err = json.Unmarshal(body, &result)
+	}
 	if err != nil {
-		log.Printf("Error decoding webhook: %v", decoder)
+		log.Printf("Error decoding webhook: %v", err)
 		http.NotFound(w, req)
 		return
 	}
+
+	// Requests that reach here through the router have a token naming the account the transaction must be on.
+	if accountId, found := req.Context().Value(webhookAccountKey{}).(string); found && result.Data.AccountId != accountId {
+		log.Printf("Rejected webhook for account %s posted with the token of account %s", result.Data.AccountId, accountId)
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+
+	if a.queue == nil {
+		w.WriteHeader(http.StatusOK)
+		if !isHandledWebhook(&result) {
+			return
+		}
+		if err = a.handleWebhookTransaction(req.Context(), &result.Data); err != nil {
+			log.Printf("Unable to handle transaction %s: %+v", result.Data.Id, err)
+		}
+		return
+	}
+
+	// Monzo retries webhooks that are not acknowledged, so only acknowledge once the event is safely stored.
+	if _, err = a.queue.Enqueue(result.Data.AccountId, body, a.now()); err != nil {
+		log.Printf("Unable to queue webhook for transaction %s: %+v", result.Data.Id, err)
+		http.Error(w, "unable to queue webhook", http.StatusInternalServerError)
+		return
+	}
 	w.WriteHeader(http.StatusOK)
-	a.handleTransaction(&result.Data, false, false)
+	a.workers.wake(result.Data.AccountId)
+}
+
+// handleTransaction counts, alerts on and applies rules to a transaction the first time it is seen, on the
+// goroutine that owns the transaction's account. It returns an error, leaving the transaction unprocessed,
+// if the account is unknown or the ledger could not record it, so a queued webhook can be retried.
+func (a *MonzoCustomisation) handleTransaction(ctx context.Context, transaction *monzorestclient.TransactionDetailsResponse) error {
+	account, found := a.account(transaction.AccountId)
+	if !found {
+		return fmt.Errorf("account %s not found", transaction.AccountId)
+	}
+
+	var err error
+	if runErr := a.executor.run(account.id, func() {
+		err = a.handleAccountTransaction(ctx, transaction, account)
+	}); runErr != nil {
+		return runErr
+	}
+	return err
+}
+
+// processedTransaction is what an account remembers about a transaction it has counted towards its daily
+// total, so a retry of a failed action neither counts it again nor loses its spending alert.
+type processedTransaction struct {
+	alert    *monzorestclient.Params
+	actioned bool
+	done     map[string]bool
 }
 
-func (a *MonzoCustomisation) handleTransaction(transaction *monzorestclient.TransactionDetailsResponse, hasAccountLock bool, hasUserLock bool) {
-	if !hasAccountLock {
-		defer a.accountsLock.Unlock()
-		a.accountsLock.Lock()
+// actionRunner runs the named action for a transaction unless it has already succeeded.
+type actionRunner func(name string, action func() error) error
+
+// handleAccountTransaction must only run on the account's goroutine. The transaction is only marked as
+// actioned once every action has succeeded, otherwise the error is returned so a queued webhook is retried.
+// Each action that succeeds is recorded in the ledger, so a retry only runs the ones that failed.
+func (a *MonzoCustomisation) handleAccountTransaction(ctx context.Context, transaction *monzorestclient.TransactionDetailsResponse, account *Account) error {
+	var processed *processedTransaction
+	if value, found := account.processedTransactions.Load(transaction.Id); found {
+		processed = value.(*processedTransaction)
+		if processed.actioned {
+			log.Printf("Recieved duplicate webhook call: %v", transaction)
+			return nil
+		}
+	}
+
+	if err := a.recordTransaction(transaction); err != nil {
+		return err
+	}
+	actioned, err := a.transactionActioned(transaction.Id)
+	if err != nil {
+		return err
 	}
-	if account, found := a.accounts[transaction.AccountId]; found {
-		if _, found := account.processedTransactions.Load(transaction.Id); !found {
 
+	if processed == nil {
+		if actioned {
+			log.Printf("Transaction %s was already actioned before a restart, only counting it", transaction.Id)
+		} else {
 			log.Printf("New Tranasaction! %v", transaction)
+		}
+		processed = &processedTransaction{alert: a.countTransaction(transaction, account, actioned), done: map[string]bool{}}
+		account.processedTransactions.Store(transaction.Id, processed)
+	}
+	if actioned {
+		processed.actioned = true
+		return nil
+	}
+
+	run := func(name string, action func() error) error {
+		return a.runAction(transaction.Id, processed, name, action)
+	}
+	if err := a.actionTransaction(ctx, transaction, account, processed.alert, run); err != nil {
+		return err
+	}
+	if a.ledger != nil {
+		if err := a.ledger.MarkActioned(transaction.Id); err != nil {
+			return fmt.Errorf("marking transaction %s as actioned in the ledger: %v", transaction.Id, err)
+		}
+	}
+	processed.actioned = true
+	return nil
+}
 
-			account.processedTransactions.Store(transaction.Id, transaction)
-			//TODO: Check if this is a pot transfer before counting towards the daily total.
-			transCreated := timeToDate(transaction.Created)
+// countTransaction adds the transaction to the account's daily total and returns the spending alert to
+// send for it, if any. Transactions actioned before a restart are counted without an alert.
+func (a *MonzoCustomisation) countTransaction(transaction *monzorestclient.TransactionDetailsResponse, account *Account, actioned bool) *monzorestclient.Params {
+	counted := countsTowardsDailyTotal(transaction)
+	transCreated := timeToDate(transaction.Created)
 
-			dailyInfoI, found := account.dailyInfo.Load(transCreated)
-			var dailyInfo DailyInfo
+	dailyInfoI, found := account.dailyInfo.Load(transCreated)
+	var dailyInfo DailyInfo
 
-			if !found {
-				dailyInfo = DailyInfo{total: transaction.Amount, sent100QuidLimitNotification: false}
-			} else {
-				dailyInfo = dailyInfoI.(DailyInfo)
-				dailyInfo = DailyInfo{total: dailyInfo.total + transaction.Amount, sent100QuidLimitNotification: dailyInfo.sent100QuidLimitNotification}
-			}
+	if found {
+		dailyInfo = dailyInfoI.(DailyInfo)
+	}
+	if counted {
+		dailyInfo = DailyInfo{total: dailyInfo.total + transaction.Amount, sent100QuidLimitNotification: dailyInfo.sent100QuidLimitNotification}
+	} else {
+		log.Printf("Not counting %s transaction %s towards the daily total", ClassifyTransaction(transaction), transaction.Id)
+	}
 
-			var params *monzorestclient.Params
-
-			log.Printf("Current Daily Total: %d (%s)", dailyInfo.total, transCreated)
-
-			if dailyInfo.total < -5000 {
-				log.Println("Spent more than 50 at once! Chill")
-				spending := (dailyInfo.total / 100) * -1
-				params = &monzorestclient.Params{
-					Title:    "Spending a bit much aren't we?",
-					Body:     fmt.Sprintf("You swpnt more than £50! Daily spend is at £%d! Chill your spending!", spending),
-					ImageUrl: "https://d33wubrfki0l68.cloudfront.net/673084cc885831461ab2cdd1151ad577cda6a49a/92a4d/static/images/favicon.png",
-				}
-			} else if transaction.Amount < -10000 && !dailyInfo.sent100QuidLimitNotification {
-				log.Println("Spent more than 100 in a day! Big spender")
-				dailyInfo = DailyInfo{total: dailyInfo.total, sent100QuidLimitNotification: true}
-				spending := (dailyInfo.total / 100) * -1
-				params = &monzorestclient.Params{
-					Title:    "What the fuck is this Mr Big Spender!",
-					Body:     fmt.Sprintf("Daily spend is at %d! Chill your spending!", spending),
-					ImageUrl: "https://d33wubrfki0l68.cloudfront.net/673084cc885831461ab2cdd1151ad577cda6a49a/92a4d/static/images/favicon.png",
-				}
+	var params *monzorestclient.Params
+
+	log.Printf("Current Daily Total: %d (%s)", dailyInfo.total, transCreated)
+
+	// Alerts only go out for spending, and never again for a transaction actioned before a restart.
+	alert := !actioned && isSpending(transaction)
+	if alert && dailyInfo.total < -5000 {
+		log.Println("Spent more than 50 at once! Chill")
+		spending := (dailyInfo.total / 100) * -1
+		params = &monzorestclient.Params{
+			Title:    "Spending a bit much aren't we?",
+			Body:     fmt.Sprintf("You swpnt more than £50! Daily spend is at £%d! Chill your spending!", spending),
+			ImageUrl: a.config.FeedImageUrl,
+		}
+	} else if alert && transaction.Amount < -10000 && !dailyInfo.sent100QuidLimitNotification {
+		log.Println("Spent more than 100 in a day! Big spender")
+		dailyInfo = DailyInfo{total: dailyInfo.total, sent100QuidLimitNotification: true}
+		spending := (dailyInfo.total / 100) * -1
+		params = &monzorestclient.Params{
+			Title:    "What the fuck is this Mr Big Spender!",
+			Body:     fmt.Sprintf("Daily spend is at %d! Chill your spending!", spending),
+			ImageUrl: a.config.FeedImageUrl,
+		}
+	}
+
+	account.dailyInfo.Store(transCreated, dailyInfo)
+	return params
+}
+
+// actionTransaction runs every action for the transaction, returning the first failure once they have all run.
+func (a *MonzoCustomisation) actionTransaction(ctx context.Context, transaction *monzorestclient.TransactionDetailsResponse, account *Account, alert *monzorestclient.Params, run actionRunner) error {
+	errs := []error{
+		a.applyRules(ctx, transaction, account, run),
+		run("roundup", func() error { return a.roundUp(ctx, transaction, account) }),
+		run("budgets", func() error { return a.checkBudgets(ctx, transaction, account) }),
+	}
+
+	if alert != nil {
+		errs = append(errs, run("alert", func() error {
+			log.Println("Creating feed item.")
+			if err := a.createFeedItem(ctx, account, alert); err != nil {
+				log.Printf("Error creating feed item for transaction: %s", transaction.Id)
+				return fmt.Errorf("creating feed item for transaction %s: %v", transaction.Id, err)
 			}
+			return nil
+		}))
+	}
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// recordTransaction adds the transaction to the ledger, replacing any earlier copy of it.
+func (a *MonzoCustomisation) recordTransaction(transaction *monzorestclient.TransactionDetailsResponse) error {
+	if a.ledger == nil {
+		return nil
+	}
 
-			account.dailyInfo.Store(transCreated, dailyInfo)
-
-			if transaction.Merchant.Name == "Tfl Cycle Hire" {
-				log.Println("Boris Bikes!")
-				_, err := a.client.UpdateTransaction(transaction.Id, account.user.auth.AccessToken, map[string]string{"notes": "#cyceling"})
-				if err != nil {
-					log.Print("Updated Boris Bike transaction.")
-				}
-			} else if transaction.Merchant.Name == "Amoret Coffee" {
-				log.Println("Coffeeeee")
-				_, err := a.client.UpdateTransaction(transaction.Id, account.user.auth.AccessToken, map[string]string{"notes": "#coffee"})
-				if err != nil {
-					log.Print("Updated Amoret transaction")
-				}
+	if _, err := a.ledger.Record(transaction); err != nil {
+		return fmt.Errorf("recording transaction %s in the ledger: %v", transaction.Id, err)
+	}
+	return nil
+}
+
+// runAction runs the named action unless the ledger, or this process, has it down as already succeeded,
+// and records it once it has.
+func (a *MonzoCustomisation) runAction(transactionId string, processed *processedTransaction, name string, action func() error) error {
+	if processed.done[name] {
+		return nil
+	}
+	if a.ledger != nil {
+		done, err := a.ledger.ActionDone(transactionId, name)
+		if err != nil {
+			return fmt.Errorf("reading action %s for transaction %s from the ledger: %v", name, transactionId, err)
+		}
+		if done {
+			processed.done[name] = true
+			return nil
+		}
+	}
+
+	if err := action(); err != nil {
+		return err
+	}
+	if a.ledger != nil {
+		if err := a.ledger.MarkActionDone(transactionId, name); err != nil {
+			return fmt.Errorf("marking action %s for transaction %s as done in the ledger: %v", name, transactionId, err)
+		}
+	}
+	processed.done[name] = true
+	return nil
+}
+
+// transactionActioned reports whether the transaction was fully handled before the last restart.
+func (a *MonzoCustomisation) transactionActioned(transactionId string) (bool, error) {
+	if a.ledger == nil {
+		return false, nil
+	}
+
+	actioned, err := a.ledger.Actioned(transactionId)
+	if err != nil {
+		return false, fmt.Errorf("reading transaction %s from the ledger: %v", transactionId, err)
+	}
+	return actioned, nil
+}
+
+// applyRules updates the transaction's notes and sends each matched rule's feed item as separate actions, so
+// a retry doesn't send the feed items that already went out.
+func (a *MonzoCustomisation) applyRules(ctx context.Context, transaction *monzorestclient.TransactionDetailsResponse, account *Account, run actionRunner) error {
+	matched := a.rules.Evaluate(transaction, account.type_)
+	if len(matched) == 0 {
+		return nil
+	}
+
+	for _, rule := range matched {
+		log.Printf("Transaction %s matched rule %s", transaction.Id, rule.Name)
+	}
+
+	var failed error
+	metadata := ruleMetadata(matched, transaction.Notes)
+	if len(metadata) > 0 {
+		failed = run("rules", func() error {
+			updated, err := a.client.UpdateTransaction(ctx, transaction.Id, account.user.accessToken(), metadata)
+			if err != nil {
+				log.Printf("Error updating transaction %s from rules: %+v", transaction.Id, err)
+				a.checkApiError(account.user, err)
+				return fmt.Errorf("updating transaction %s from rules: %v", transaction.Id, err)
+			}
+			log.Printf("Updated transaction %s from rules", transaction.Id)
+			transaction.Notes = updated.Notes
+			if err := a.recordTransaction(transaction); err != nil {
+				log.Printf("Unable to record updated notes for transaction %s: %+v", transaction.Id, err)
 			}
+			return nil
+		})
+	}
 
-			if params != nil {
-				log.Println("Creating feed item.")
-				err := a.createFeedItem(transaction.AccountId, params, hasAccountLock, hasUserLock)
-				if err != nil {
-					log.Printf("Error creating feed item for transaction: %s", transaction.Id)
-				}
+	for _, rule := range matched {
+		if rule.Actions.FeedItem == nil {
+			continue
+		}
+		feedItem := rule.Actions.FeedItem
+		err := run("rule:"+rule.Name, func() error { return a.createFeedItem(ctx, account, feedItem) })
+		if err != nil {
+			log.Printf("Error creating feed item for rule %s: %+v", rule.Name, err)
+			if failed == nil {
+				failed = fmt.Errorf("creating feed item for rule %s: %v", rule.Name, err)
 			}
-			a.accounts[transaction.AccountId] = account
-		} else {
-			log.Printf("Recieved duplicate webhook call: %v", transaction)
 		}
-	} else {
-		log.Printf("Tried to process transaction for acount %s but account not found", transaction.AccountId)
 	}
+	return failed
 }
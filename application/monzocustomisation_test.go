@@ -1,185 +1,59 @@
 package application
 
 import (
+	"context"
+	"errors"
 	"net/http"
+	"net/http/httptest"
 	"reflect"
 	"sync"
 	"testing"
 	"time"
 
+	"github.com/tmilner/monzo-customisation/adapters/ledger"
 	"github.com/tmilner/monzo-customisation/adapters/monzorestclient"
-	"github.com/twinj/uuid"
 )
 
 func TestCreateMonzoApi(t *testing.T) {
-	type args struct {
-		config *Config
-		client *monzorestclient.MonzoRestClient
-	}
-
-	config := &Config{}
-	client := &monzorestclient.MonzoRestClient{}
-
-	tests := []struct {
-		name string
-		args args
-		want *MonzoCustomisation
-	}{
-		{
-			name: "Values are initialised correct",
-			args: args{
-				config: config,
-				client: client,
-			},
-			want: &MonzoCustomisation{
-				client:       client,
-				config:       config,
-				users:        map[string]*User{},
-				usersLock:    sync.RWMutex{},
-				accounts:     map[string]*Account{},
-				accountsLock: sync.RWMutex{},
-				ticker:       time.NewTicker(2 * time.Hour),
-				stateToken:   uuid.NewV4().String(),
-			},
-		},
-	}
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			got := CreateMonzoCustomisation(tt.args.client, tt.args.config)
-			got.stateToken = tt.want.stateToken
-			got.ticker = tt.want.ticker
-			if !reflect.DeepEqual(got, tt.want) {
-				t.Errorf("CreateMonzoCustomisation() = %v, want %v", got, tt.want)
-			}
-		})
-	}
-}
+	config := &Config{ClientId: "client", MonzoAuthUrl: "https://auth.example.com", RedirectUri: "http://localhost/auth_return"}
+	client := &fakeFeedClient{}
+	rules := &RuleSet{}
+	now := func() time.Time { return time.Date(2019, time.March, 12, 9, 0, 0, 0, time.UTC) }
 
-func TestMonzoApi_findUserForAccount(t *testing.T) {
-	type fields struct {
-		url          string
-		client       *monzorestclient.MonzoRestClient
-		clientConfig *Config
-		users        map[string]*User
-		usersLock    sync.RWMutex
-		accounts     map[string]*Account
-		accountsLock sync.RWMutex
-	}
-	type args struct {
-		accountId string
-	}
-
-	accountId := "12345"
-	user := &User{}
-	account := &Account{
-		id:   accountId,
-		user: user,
-	}
-
-	tests := []struct {
-		name    string
-		fields  fields
-		args    args
-		want    *User
-		wantErr bool
-	}{
-		{
-			name: "Return the user details when an account is found",
-			fields: fields{
-				accountsLock: sync.RWMutex{},
-				accounts: map[string]*Account{
-					accountId: account,
-				},
-			},
-			args:    args{accountId: accountId},
-			want:    user,
-			wantErr: false,
-		},
-		{
-			name: "Returns an error when the account ID cannot be found",
-			fields: fields{
-				accountsLock: sync.RWMutex{},
-				accounts:     map[string]*Account{},
-			},
-			args:    args{accountId: accountId},
-			want:    nil,
-			wantErr: true,
-		},
+	got := CreateMonzoCustomisation(client, config, rules, nil, nil).WithClock(now)
+	if got.client != client || got.config != config || got.rules != rules || len(got.users) != 0 || len(got.accounts) != 0 {
+		t.Errorf("CreateMonzoCustomisation() = %+v", got)
 	}
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			a := &MonzoCustomisation{
-				client:       tt.fields.client,
-				config:       tt.fields.clientConfig,
-				users:        tt.fields.users,
-				usersLock:    tt.fields.usersLock,
-				accounts:     tt.fields.accounts,
-				accountsLock: tt.fields.accountsLock,
-			}
-			got, err := a.findUserForAccount(tt.args.accountId)
-			if (err != nil) != tt.wantErr {
-				t.Errorf("MonzoCustomisation.findUserForAccount() error = %v, wantErr %v", err, tt.wantErr)
-				return
-			}
-			if !reflect.DeepEqual(got, tt.want) {
-				t.Errorf("MonzoCustomisation.findUserForAccount() = %v, want %v", got, tt.want)
-			}
-		})
+	if got.now() != now() || got.tokenManager.now() != now() {
+		t.Error("WithClock() did not replace the clock")
 	}
-}
-
-/*func TestMonzoApi_runBasicInfo(t *testing.T) {
-	ctrl := gomock.NewController(t)
-	defer ctrl.Finish()
 
-	type fields struct {
-		client       *monzorestclient.MonzoRestClient
-		config       *Config
-		users        map[string]*User
-		usersLock    sync.RWMutex
-		accounts     map[string]*Account
-		accountsLock sync.RWMutex
-	}
-	type args struct {
-		userId string
-	}
 	tests := []struct {
-		name   string
-		fields fields
-		args   args
+		name       string
+		method     string
+		path       string
+		wantStatus int
 	}{
-		{
-			name:   "",
-			fields: fields{
-				client:
-			},
-			args:   args{
-				userId: "23232",
-			},
-		},
+		{"Auth start redirects to Monzo", "GET", "/auth_start", http.StatusSeeOther},
+		{"Admin API is off without a token", "GET", "/admin/budgets/user_1", http.StatusNotFound},
+		{"Webhooks must be posted", "GET", "/webhook/token", http.StatusMethodNotAllowed},
+		{"Webhooks need a token", "POST", "/webhook", http.StatusNotFound},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			a := &MonzoCustomisation{
-				client:       tt.fields.client,
-				config:       tt.fields.config,
-				users:        tt.fields.users,
-				usersLock:    tt.fields.usersLock,
-				accounts:     tt.fields.accounts,
-				accountsLock: tt.fields.accountsLock,
+			w := httptest.NewRecorder()
+			got.ServeHTTP(w, httptest.NewRequest(tt.method, tt.path, nil))
+			if w.Code != tt.wantStatus {
+				t.Errorf("ServeHTTP(%s %s) status = %d, want %d", tt.method, tt.path, w.Code, tt.wantStatus)
 			}
-			a.runBasicInfo(tt.args.userId)
 		})
 	}
 }
-*/
 
 func TestMonzoCustomisation_handleTransaction(t *testing.T) {
 	type fields struct {
-		users        map[string]*User
-		usersLock    sync.RWMutex
-		accounts     map[string]*Account
-		accountsLock sync.RWMutex
+		users    map[string]*User
+		accounts map[string]*Account
 	}
 	type args struct {
 		transaction    *monzorestclient.TransactionDetailsResponse
@@ -194,12 +68,12 @@ func TestMonzoCustomisation_handleTransaction(t *testing.T) {
 		WebhookURI:   "",
 	}
 	var account *Account
-	user := &User{"User123", nil, []*Account{account}}
+	user := &User{id: "User123", accounts: []*Account{account}}
 	dateWithExistingTransactions := time.Date(1991, time.December, 04, 12, 04, 12, 0, time.UTC)
 	account = &Account{
-		id: "12345",
+		id:                    "12345",
 		processedTransactions: sync.Map{},
-		dailyTotal:            sync.Map{},
+		dailyInfo:             sync.Map{},
 		closed:                false,
 		description:           "",
 		created:               "",
@@ -209,7 +83,7 @@ func TestMonzoCustomisation_handleTransaction(t *testing.T) {
 		owners:                []Owner{{user.id, "123", "12"}},
 		user:                  user,
 	}
-	account.dailyTotal.Store(timeToDate(dateWithExistingTransactions), int64(-500))
+	account.dailyInfo.Store(timeToDate(dateWithExistingTransactions), DailyInfo{total: -500})
 	tests := []struct {
 		name   string
 		fields fields
@@ -221,11 +95,9 @@ func TestMonzoCustomisation_handleTransaction(t *testing.T) {
 				users: map[string]*User{
 					user.id: user,
 				},
-				usersLock: sync.RWMutex{},
 				accounts: map[string]*Account{
 					account.id: account,
 				},
-				accountsLock: sync.RWMutex{},
 			},
 			args: args{
 				transaction: &monzorestclient.TransactionDetailsResponse{
@@ -247,11 +119,9 @@ func TestMonzoCustomisation_handleTransaction(t *testing.T) {
 				users: map[string]*User{
 					user.id: user,
 				},
-				usersLock: sync.RWMutex{},
 				accounts: map[string]*Account{
 					account.id: account,
 				},
-				accountsLock: sync.RWMutex{},
 			},
 			args: args{
 				transaction: &monzorestclient.TransactionDetailsResponse{
@@ -271,23 +141,275 @@ func TestMonzoCustomisation_handleTransaction(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			a := &MonzoCustomisation{
-				client:       monzoclient,
-				config:       config,
-				users:        tt.fields.users,
-				usersLock:    tt.fields.usersLock,
-				accounts:     tt.fields.accounts,
-				accountsLock: tt.fields.accountsLock,
-				ticker:       time.NewTicker(2 * time.Hour),
-				stateToken:   uuid.NewV4().String(),
+				now:      time.Now,
+				executor: startedExecutor(1),
+				client:   monzoclient,
+				config:   config,
+				users:    tt.fields.users,
+				accounts: tt.fields.accounts,
 			}
-			a.handleTransaction(tt.args.transaction)
-			total, found := tt.fields.accounts[account.id].dailyTotal.Load(timeToDate(tt.args.transaction.Created))
+			a.handleTransaction(context.Background(), tt.args.transaction)
+			info, found := tt.fields.accounts[account.id].dailyInfo.Load(timeToDate(tt.args.transaction.Created))
 			if !found {
-				t.Error("Did not store an amount for today!")
+				t.Fatal("Did not store an amount for today!")
 			}
-			if total.(int64) != tt.args.expectedAmount {
-				t.Errorf("daily total is inocrrect! Should be %d, is %d", tt.args.expectedAmount, total.(int64))
+			if total := info.(DailyInfo).total; total != tt.args.expectedAmount {
+				t.Errorf("daily total is inocrrect! Should be %d, is %d", tt.args.expectedAmount, total)
 			}
 		})
 	}
 }
+
+type fakeLedger struct {
+	recorded map[string]bool
+	actioned map[string]bool
+	actions  map[string]bool
+	backfill map[string]*ledger.BackfillState
+	roundUps map[string]*ledger.RoundUp
+	alerts   map[string]bool
+}
+
+func (f *fakeLedger) Record(transaction *monzorestclient.TransactionDetailsResponse) (bool, error) {
+	isNew := !f.recorded[transaction.Id]
+	f.recorded[transaction.Id] = true
+	return isNew, nil
+}
+
+func (f *fakeLedger) MarkActioned(transactionId string) error {
+	if f.actioned == nil {
+		f.actioned = map[string]bool{}
+	}
+	f.actioned[transactionId] = true
+	return nil
+}
+
+func (f *fakeLedger) Actioned(transactionId string) (bool, error) {
+	return f.actioned[transactionId], nil
+}
+
+func (f *fakeLedger) MarkActionDone(transactionId string, action string) error {
+	if f.actions == nil {
+		f.actions = map[string]bool{}
+	}
+	f.actions[transactionId+"\x00"+action] = true
+	return nil
+}
+
+func (f *fakeLedger) ActionDone(transactionId string, action string) (bool, error) {
+	return f.actions[transactionId+"\x00"+action], nil
+}
+
+func (f *fakeLedger) Query(accountId string, from time.Time, to time.Time) ([]*monzorestclient.TransactionDetailsResponse, error) {
+	return nil, nil
+}
+
+func (f *fakeLedger) BackfillState(accountId string) (*ledger.BackfillState, error) {
+	return f.backfill[accountId], nil
+}
+
+func (f *fakeLedger) SaveBackfillState(accountId string, state *ledger.BackfillState) error {
+	saved := *state
+	f.backfill[accountId] = &saved
+	return nil
+}
+
+func (f *fakeLedger) SaveRoundUp(roundUp *ledger.RoundUp) error {
+	saved := *roundUp
+	f.roundUps[roundUp.TransactionId] = &saved
+	return nil
+}
+
+func (f *fakeLedger) SaveRoundUps(roundUps []*ledger.RoundUp) error {
+	for _, roundUp := range roundUps {
+		_ = f.SaveRoundUp(roundUp)
+	}
+	return nil
+}
+
+func (f *fakeLedger) RoundUp(accountId string, transactionId string) (*ledger.RoundUp, error) {
+	if roundUp, found := f.roundUps[transactionId]; found && roundUp.AccountId == accountId {
+		saved := *roundUp
+		return &saved, nil
+	}
+	return nil, nil
+}
+
+func (f *fakeLedger) ClearBudgetAlert(key string) error {
+	delete(f.alerts, key)
+	return nil
+}
+
+func (f *fakeLedger) MarkBudgetAlert(key string, sent time.Time) (bool, error) {
+	isNew := !f.alerts[key]
+	f.alerts[key] = true
+	return isNew, nil
+}
+
+func (f *fakeLedger) RoundUps(accountId string) ([]*ledger.RoundUp, error) {
+	roundUps := make([]*ledger.RoundUp, 0)
+	for _, roundUp := range f.roundUps {
+		if roundUp.AccountId == accountId {
+			saved := *roundUp
+			roundUps = append(roundUps, &saved)
+		}
+	}
+	return roundUps, nil
+}
+
+type fakeUpdateClient struct {
+	MonzoClient
+	updated []string
+}
+
+func (f *fakeUpdateClient) UpdateTransaction(ctx context.Context, transactionId string, authToken string, metadata map[string]string) (*monzorestclient.TransactionDetailsResponse, error) {
+	f.updated = append(f.updated, transactionId)
+	return &monzorestclient.TransactionDetailsResponse{Id: transactionId, Notes: metadata["notes"]}, nil
+}
+
+func TestMonzoCustomisation_handleTransaction_ledger(t *testing.T) {
+	user := &User{id: "User123", auth: &Auth{AccessToken: "token"}}
+	account := &Account{id: "12345", type_: "uk_retail", user: user}
+	user.accounts = []*Account{account}
+
+	rules, _ := CreateRuleSet([]*Rule{{Name: "Coffee", Actions: RuleActions{AddHashtags: []string{"#coffee"}}}})
+	client := &fakeUpdateClient{}
+	transactions := &fakeLedger{recorded: map[string]bool{"before-restart": true}, actioned: map[string]bool{"before-restart": true}}
+
+	a := &MonzoCustomisation{
+		now:      time.Now,
+		executor: startedExecutor(1),
+		client:   client,
+		config:   &Config{},
+		users:    map[string]*User{user.id: user},
+		accounts: map[string]*Account{account.id: account},
+		rules:    rules,
+		ledger:   transactions,
+	}
+
+	created := time.Date(2019, time.March, 12, 9, 0, 0, 0, time.UTC)
+	a.handleTransaction(context.Background(), &monzorestclient.TransactionDetailsResponse{AccountId: account.id, Id: "before-restart", Amount: -300, Created: created})
+	a.handleTransaction(context.Background(), &monzorestclient.TransactionDetailsResponse{AccountId: account.id, Id: "after-restart", Amount: -200, Created: created})
+
+	if !reflect.DeepEqual(client.updated, []string{"after-restart"}) {
+		t.Errorf("Updated transactions = %v, want only the new transaction", client.updated)
+	}
+	if !transactions.recorded["after-restart"] || !transactions.actioned["after-restart"] {
+		t.Error("New transaction was not recorded and marked actioned in the ledger")
+	}
+
+	info, _ := account.dailyInfo.Load(timeToDate(created))
+	if total := info.(DailyInfo).total; total != -500 {
+		t.Errorf("Daily total = %d, want -500", total)
+	}
+}
+
+// flakyUpdateClient fails the first few updates, then behaves like fakeUpdateClient.
+type flakyUpdateClient struct {
+	fakeUpdateClient
+	failures  int
+	feedItems int
+}
+
+func (f *flakyUpdateClient) CreateFeedItem(ctx context.Context, item *monzorestclient.FeedItem, authToken string) error {
+	f.feedItems++
+	return nil
+}
+
+func (f *flakyUpdateClient) UpdateTransaction(ctx context.Context, transactionId string, authToken string, metadata map[string]string) (*monzorestclient.TransactionDetailsResponse, error) {
+	if f.failures > 0 {
+		f.failures--
+		return nil, errors.New("connection reset")
+	}
+	return f.fakeUpdateClient.UpdateTransaction(ctx, transactionId, authToken, metadata)
+}
+
+func TestMonzoCustomisation_handleTransaction_retriesFailedActions(t *testing.T) {
+	user := &User{id: "User123", auth: &Auth{AccessToken: "token"}}
+	account := &Account{id: "12345", type_: "uk_retail", user: user}
+	user.accounts = []*Account{account}
+
+	rules, _ := CreateRuleSet([]*Rule{{Name: "Coffee", Actions: RuleActions{AddHashtags: []string{"#coffee"}}}})
+	client := &flakyUpdateClient{failures: 1}
+	transactions := &fakeLedger{recorded: map[string]bool{}}
+
+	a := &MonzoCustomisation{
+		now:      time.Now,
+		executor: startedExecutor(1),
+		client:   client,
+		config:   &Config{},
+		users:    map[string]*User{user.id: user},
+		accounts: map[string]*Account{account.id: account},
+		rules:    rules,
+		ledger:   transactions,
+	}
+
+	created := time.Date(2019, time.March, 12, 9, 0, 0, 0, time.UTC)
+	transaction := monzorestclient.TransactionDetailsResponse{AccountId: account.id, Id: "tx_1", Amount: -300, Created: created}
+
+	retry := transaction
+	if err := a.handleTransaction(context.Background(), &retry); err == nil {
+		t.Fatal("handleTransaction() error = nil when the rules could not be applied")
+	}
+	if transactions.actioned["tx_1"] {
+		t.Error("Transaction marked actioned when the rules could not be applied")
+	}
+
+	for i := 0; i < 2; i++ {
+		retry = transaction
+		if err := a.handleTransaction(context.Background(), &retry); err != nil {
+			t.Fatalf("handleTransaction() attempt %d error = %v", i, err)
+		}
+	}
+	if !transactions.actioned["tx_1"] || !reflect.DeepEqual(client.updated, []string{"tx_1"}) {
+		t.Errorf("Actioned = %v with updates %v, want the retry to apply the rules once", transactions.actioned["tx_1"], client.updated)
+	}
+
+	info, _ := account.dailyInfo.Load(timeToDate(created))
+	if total := info.(DailyInfo).total; total != -300 {
+		t.Errorf("Daily total = %d, want the transaction counted once", total)
+	}
+}
+
+func TestMonzoCustomisation_handleTransaction_skipsDoneActions(t *testing.T) {
+	rules, _ := CreateRuleSet([]*Rule{{
+		Name:    "Coffee",
+		Actions: RuleActions{AddHashtags: []string{"#coffee"}, FeedItem: &monzorestclient.Params{Title: "Coffee"}},
+	}})
+	client := &flakyUpdateClient{failures: 1}
+	transactions := &fakeLedger{recorded: map[string]bool{}}
+	created := time.Date(2019, time.March, 12, 9, 0, 0, 0, time.UTC)
+
+	// Each attempt starts from a fresh account, as it would after a restart, so only the ledger remembers
+	// which actions succeeded.
+	attempt := func() error {
+		user := &User{id: "User123", auth: &Auth{AccessToken: "token"}}
+		account := &Account{id: "12345", type_: "uk_retail", user: user}
+		user.accounts = []*Account{account}
+		a := &MonzoCustomisation{
+			now:      time.Now,
+			executor: startedExecutor(1),
+			client:   client,
+			config:   &Config{},
+			users:    map[string]*User{user.id: user},
+			accounts: map[string]*Account{account.id: account},
+			rules:    rules,
+			ledger:   transactions,
+		}
+		defer a.executor.stop()
+		return a.handleTransaction(context.Background(), &monzorestclient.TransactionDetailsResponse{AccountId: account.id, Id: "tx_1", Amount: -300, Created: created})
+	}
+
+	if err := attempt(); err == nil {
+		t.Fatal("handleTransaction() error = nil when the notes could not be updated")
+	}
+	if err := attempt(); err != nil {
+		t.Fatalf("handleTransaction() retry error = %v", err)
+	}
+
+	if client.feedItems != 1 {
+		t.Errorf("Sent %d rule feed items, want the retry to skip the one already sent", client.feedItems)
+	}
+	if !reflect.DeepEqual(client.updated, []string{"tx_1"}) || !transactions.actioned["tx_1"] {
+		t.Errorf("Updates %v, actioned %v, want the retry to update the notes and finish", client.updated, transactions.actioned["tx_1"])
+	}
+}
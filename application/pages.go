@@ -0,0 +1,46 @@
+package application
+
+import (
+	"html/template"
+	"log"
+	"net/http"
+)
+
+// page is a minimal HTML page shown to a user in their browser during sign in.
+type page struct {
+	Title    string
+	Message  string
+	LinkText string
+	LinkUrl  string
+	// Refresh reloads the page after this many seconds, for pages waiting on something to happen.
+	Refresh int
+}
+
+var pageTemplate = template.Must(template.New("page").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+{{if .Refresh}}<meta http-equiv="refresh" content="{{.Refresh}}">{{end}}
+<title>{{.Title}}</title>
+<style>
+body { font-family: -apple-system, BlinkMacSystemFont, "Segoe UI", sans-serif; max-width: 32em; margin: 4em auto; padding: 0 1em; color: #14233c; }
+a { color: #ff4f40; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<p>{{.Message}}</p>
+{{if .LinkUrl}}<p><a href="{{.LinkUrl}}">{{.LinkText}}</a></p>{{end}}
+</body>
+</html>
+`))
+
+func writePage(w http.ResponseWriter, status int, p page) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	if err := pageTemplate.Execute(w, p); err != nil {
+		log.Printf("Unable to write %q page: %v", p.Title, err)
+	}
+}
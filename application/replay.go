@@ -0,0 +1,72 @@
+package application
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+)
+
+const transactionCreated = "transaction.created"
+
+// isHandledWebhook reports whether the webhook is of a type that is handled, logging the ones that are skipped.
+func isHandledWebhook(webhook *WebhookResponse) bool {
+	if webhook.TransactionType != transactionCreated {
+		log.Printf("Skipping %s webhook", webhook.TransactionType)
+		return false
+	}
+	return true
+}
+
+// ReadWebhooks decodes webhook payloads, as Monzo posts them, one after another from r.
+// Pretty printed payloads and one payload per line both work.
+func ReadWebhooks(r io.Reader) ([]*WebhookResponse, error) {
+	decoder := json.NewDecoder(r)
+	webhooks := make([]*WebhookResponse, 0)
+	for {
+		var webhook WebhookResponse
+		err := decoder.Decode(&webhook)
+		if err == io.EOF {
+			return webhooks, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		webhooks = append(webhooks, &webhook)
+	}
+}
+
+// Replay feeds recorded webhooks through the same handling as the live webhook endpoint, for the accounts
+// of every user in the token store. Nothing is served and tokens are not refreshed, so stored tokens must
+// still be valid. It returns the number of transactions handled.
+func Replay(ctx context.Context, client MonzoClient, config *Config, rules *RuleSet, tokens TokenStore, transactionLedger TransactionLedger, webhooks []*WebhookResponse) (int, error) {
+	monzo := CreateMonzoCustomisation(client, config, rules, nil, transactionLedger)
+	monzo.executor.start()
+	defer monzo.executor.stop()
+
+	stored, err := tokens.LoadAll()
+	if err != nil {
+		return 0, err
+	}
+	for _, token := range stored {
+		auth := Auth(*token)
+		user := &User{id: auth.UserId, auth: &auth, accounts: make([]*Account, 0)}
+		if err := monzo.loadAccounts(ctx, user); err != nil {
+			return 0, err
+		}
+		monzo.addUser(user)
+	}
+
+	handled := 0
+	for _, webhook := range webhooks {
+		if !isHandledWebhook(webhook) {
+			continue
+		}
+		if err := monzo.handleTransaction(ctx, &webhook.Data); err != nil {
+			log.Printf("Unable to replay transaction %s: %+v", webhook.Data.Id, err)
+			continue
+		}
+		handled++
+	}
+	return handled, nil
+}
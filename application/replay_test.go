@@ -0,0 +1,101 @@
+package application
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/tmilner/monzo-customisation/adapters/monzorestclient"
+	"github.com/tmilner/monzo-customisation/adapters/tokenstore"
+)
+
+type fakeReplayClient struct {
+	fakeFeedClient
+}
+
+func (f *fakeReplayClient) ListAccounts(ctx context.Context, authToken string) (*monzorestclient.AccountListResponse, error) {
+	return &monzorestclient.AccountListResponse{Accounts: []monzorestclient.AccountResponse{
+		{Id: "acc_00008gju41AHyfLUzBUk8A", Type: "uk_retail"},
+	}}, nil
+}
+
+type fakeTokenStore struct {
+	tokens []*tokenstore.Token
+}
+
+func (f *fakeTokenStore) Save(token *tokenstore.Token) error { return nil }
+
+func (f *fakeTokenStore) Load(userId string) (*tokenstore.Token, error) {
+	return nil, tokenstore.ErrNotFound
+}
+
+func (f *fakeTokenStore) LoadAll() ([]*tokenstore.Token, error) { return f.tokens, nil }
+
+func (f *fakeTokenStore) Delete(userId string) error { return nil }
+
+func TestReadWebhooks(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    []string
+		wantErr bool
+	}{
+		{"One per line", `{"type":"transaction.created","data":{"id":"tx_1"}}` + "\n" + `{"type":"transaction.created","data":{"id":"tx_2"}}`, []string{"tx_1", "tx_2"}, false},
+		{"Pretty printed", "{\n  \"type\": \"transaction.created\",\n  \"data\": {\"id\": \"tx_1\"}\n}\n", []string{"tx_1"}, false},
+		{"Empty", "", []string{}, false},
+		{"Truncated", `{"type":"transaction.created","data":{"id":`, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ReadWebhooks(strings.NewReader(tt.input))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ReadWebhooks() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("ReadWebhooks() returned %d webhooks, want %d", len(got), len(tt.want))
+			}
+			for i, webhook := range got {
+				if webhook.Data.Id != tt.want[i] {
+					t.Errorf("ReadWebhooks()[%d] = %s, want %s", i, webhook.Data.Id, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestReplay(t *testing.T) {
+	file, err := os.Open(filepath.Join("testdata", "webhooks", "pot_transfer_deposit.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	webhooks, err := ReadWebhooks(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bigSpend := *loadWebhookFixture(t, "card_spend.json")
+	bigSpend.Id = "tx_big"
+	bigSpend.Amount = -12000
+	webhooks = append(webhooks,
+		&WebhookResponse{TransactionType: "transaction.created", Data: bigSpend},
+		&WebhookResponse{TransactionType: "account.updated"},
+	)
+
+	client := &fakeReplayClient{}
+	tokens := &fakeTokenStore{tokens: []*tokenstore.Token{{UserId: "user_1", AccessToken: "token"}}}
+	rules, _ := CreateRuleSet(nil)
+
+	handled, err := Replay(context.Background(), client, &Config{}, rules, tokens, nil, webhooks)
+	if err != nil {
+		t.Fatalf("Replay() error = %v", err)
+	}
+	if handled != 2 {
+		t.Errorf("Replay() handled %d transactions, want 2", handled)
+	}
+	if len(client.items) != 1 {
+		t.Errorf("Feed items = %d, want a single spending alert for the card payment", len(client.items))
+	}
+}
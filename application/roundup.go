@@ -0,0 +1,287 @@
+package application
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/tmilner/monzo-customisation/adapters/ledger"
+	"github.com/tmilner/monzo-customisation/adapters/monzorestclient"
+)
+
+// RoundUpConfig saves the difference between each card payment and the next multiple of RoundTo pence
+// into the named pot, multiplied by Multiplier. With BatchDaily set the round ups for a day are added
+// together and deposited in one go after midnight rather than one deposit per payment.
+type RoundUpConfig struct {
+	AccountId   string `json:"account_id,omitempty"`
+	AccountType string `json:"account_type,omitempty"`
+	PotName     string `json:"pot_name"`
+	RoundTo     int64  `json:"round_to"`
+	Multiplier  int64  `json:"multiplier"`
+	BatchDaily  bool   `json:"batch_daily"`
+}
+
+var errPotNotFound = errors.New("no pot with that name")
+
+func LoadRoundUps(path string) ([]*RoundUpConfig, error) {
+	body, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var roundUps []*RoundUpConfig
+	if err = json.Unmarshal(body, &roundUps); err != nil {
+		return nil, fmt.Errorf("unable to parse round up file %s: %v", path, err)
+	}
+
+	for index, roundUp := range roundUps {
+		if err = roundUp.validate(); err != nil {
+			return nil, fmt.Errorf("round up %d: %v", index, err)
+		}
+	}
+	return roundUps, nil
+}
+
+func (r *RoundUpConfig) validate() error {
+	if r.PotName == "" {
+		return errors.New("pot_name is required")
+	}
+	if r.RoundTo == 0 {
+		r.RoundTo = 100
+	}
+	if r.Multiplier == 0 {
+		r.Multiplier = 1
+	}
+	if r.RoundTo < 0 || r.Multiplier < 0 {
+		return errors.New("round_to and multiplier must be positive")
+	}
+	return nil
+}
+
+func (r *RoundUpConfig) appliesTo(account *Account) bool {
+	if r.AccountId != "" && r.AccountId != account.id {
+		return false
+	}
+	if r.AccountType != "" && r.AccountType != account.type_ {
+		return false
+	}
+	return true
+}
+
+// amount is how much to save for a payment of spent pence, spending is negative as it is in the Monzo API.
+func (r *RoundUpConfig) amount(spent int64) int64 {
+	remainder := (-spent) % r.RoundTo
+	if remainder == 0 {
+		return 0
+	}
+	return (r.RoundTo - remainder) * r.Multiplier
+}
+
+// isCardSpend reports whether the transaction is a payment to a merchant, the only kind that is rounded up.
+func isCardSpend(transaction *monzorestclient.TransactionDetailsResponse) bool {
+	return transaction.DeclineReason == "" && ClassifyTransaction(transaction) == KindCardSpend
+}
+
+// roundUp returns the first Monzo or ledger failure, once every round up has been tried, so the transaction is
+// retried. A pot that does not exist is a configuration problem that retrying will not fix, so it is only logged.
+func (a *MonzoCustomisation) roundUp(ctx context.Context, transaction *monzorestclient.TransactionDetailsResponse, account *Account) error {
+	if len(a.config.RoundUps) == 0 || !isCardSpend(transaction) {
+		return nil
+	}
+
+	var failed error
+	fail := func(err error) {
+		if failed == nil {
+			failed = fmt.Errorf("rounding up transaction %s: %v", transaction.Id, err)
+		}
+	}
+
+	for _, config := range a.config.RoundUps {
+		if !config.appliesTo(account) {
+			continue
+		}
+
+		amount := config.amount(transaction.Amount)
+		if amount == 0 {
+			continue
+		}
+
+		authToken := account.user.accessToken()
+		potId, err := a.findPot(ctx, authToken, config.PotName)
+		if err != nil {
+			log.Printf("Unable to round up transaction %s: %+v", transaction.Id, err)
+			if !errors.Is(err, errPotNotFound) {
+				a.checkApiError(account.user, err)
+				fail(err)
+			}
+			continue
+		}
+
+		record := &ledger.RoundUp{
+			TransactionId: transaction.Id,
+			AccountId:     account.id,
+			PotId:         potId,
+			Amount:        amount,
+			Created:       transaction.Created,
+		}
+
+		if !config.BatchDaily {
+			dedupeId := monzorestclient.PotDedupeId(transaction.Id, potId, "roundup")
+			if _, err = a.client.DepositIntoPot(ctx, potId, account.id, amount, dedupeId, authToken); err != nil {
+				log.Printf("Error depositing round up for transaction %s: %+v", transaction.Id, err)
+				a.checkApiError(account.user, err)
+				fail(err)
+				continue
+			}
+			log.Printf("Rounded up transaction %s, saved %d into %s", transaction.Id, amount, config.PotName)
+			record.DepositId = dedupeId
+			record.Deposited = a.now()
+		} else if a.ledger != nil {
+			// A retry must not turn a round up that has already been deposited back into a pending one.
+			existing, err := a.ledger.RoundUp(account.id, transaction.Id)
+			if err != nil {
+				fail(err)
+				continue
+			}
+			if existing != nil && existing.DepositId != "" {
+				continue
+			}
+		}
+
+		if err := a.saveRoundUp(record); err != nil {
+			fail(err)
+		}
+	}
+	return failed
+}
+
+func (a *MonzoCustomisation) findPot(ctx context.Context, authToken string, name string) (string, error) {
+	pots, err := a.client.GetPots(ctx, authToken)
+	if err != nil {
+		return "", err
+	}
+
+	for _, pot := range pots.Pots {
+		if !pot.Deleted && strings.EqualFold(pot.Name, name) {
+			return pot.Id, nil
+		}
+	}
+	return "", fmt.Errorf("%w: %s", errPotNotFound, name)
+}
+
+func (a *MonzoCustomisation) saveRoundUp(roundUp *ledger.RoundUp) error {
+	if a.ledger == nil {
+		return nil
+	}
+	err := a.ledger.SaveRoundUp(roundUp)
+	if err != nil {
+		log.Printf("Unable to record round up for transaction %s: %+v", roundUp.TransactionId, err)
+	}
+	return err
+}
+
+// depositBatchedRoundUps deposits the pending round ups made before the start of today, one deposit per
+// account, pot and day. Round ups that arrive after a day's batch was deposited make a second batch, so the
+// dedupe ID comes from the transactions in the batch rather than the day. Each batch is saved with its dedupe
+// ID before depositing, so a deposit that fails, or whose result is lost, is retried with the same ID.
+func (a *MonzoCustomisation) depositBatchedRoundUps(ctx context.Context) {
+	if a.ledger == nil {
+		return
+	}
+
+	accounts := a.allAccounts()
+
+	now := a.now()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+
+	for _, account := range accounts {
+		if account.user.needsReauth() {
+			continue
+		}
+		roundUps, err := a.ledger.RoundUps(account.id)
+		if err != nil {
+			log.Printf("Unable to read round ups for account %s: %+v", account.id, err)
+			continue
+		}
+
+		// Batches that were saved but not deposited are keyed by their dedupe ID, new ones by pot and day.
+		started := map[string][]*ledger.RoundUp{}
+		batches := map[string][]*ledger.RoundUp{}
+		for _, roundUp := range roundUps {
+			switch {
+			case !roundUp.Deposited.IsZero():
+			case roundUp.DepositId != "":
+				started[roundUp.DepositId] = append(started[roundUp.DepositId], roundUp)
+			case roundUp.Created.Before(today):
+				day := roundUp.Created.In(now.Location()).Format("2006-01-02")
+				key := roundUp.PotId + "/" + day
+				batches[key] = append(batches[key], roundUp)
+			}
+		}
+
+		for key, batch := range batches {
+			transactionIds := make([]string, 0, len(batch))
+			for _, roundUp := range batch {
+				transactionIds = append(transactionIds, roundUp.TransactionId)
+			}
+			sort.Strings(transactionIds)
+
+			dedupeId := monzorestclient.PotDedupeId(append([]string{account.id, key, "roundup-batch"}, transactionIds...)...)
+			for _, roundUp := range batch {
+				roundUp.DepositId = dedupeId
+			}
+			if err := a.ledger.SaveRoundUps(batch); err != nil {
+				log.Printf("Unable to save batched round ups for account %s: %+v", account.id, err)
+				continue
+			}
+			started[dedupeId] = batch
+		}
+
+		for dedupeId, batch := range started {
+			a.depositRoundUpBatch(ctx, account, dedupeId, batch, now)
+		}
+	}
+}
+
+// depositRoundUpBatch makes the deposit for a saved batch and marks every round up in it deposited together.
+func (a *MonzoCustomisation) depositRoundUpBatch(ctx context.Context, account *Account, dedupeId string, batch []*ledger.RoundUp, now time.Time) {
+	var total int64
+	for _, roundUp := range batch {
+		total += roundUp.Amount
+	}
+
+	if _, err := a.client.DepositIntoPot(ctx, batch[0].PotId, account.id, total, dedupeId, a.accessToken(account.user.id)); err != nil {
+		log.Printf("Error depositing batched round ups for account %s: %+v", account.id, err)
+		a.checkApiError(account.user, err)
+		return
+	}
+	log.Printf("Deposited %d batched round ups for account %s, saved %d", len(batch), account.id, total)
+
+	for _, roundUp := range batch {
+		roundUp.Deposited = now
+	}
+	if err := a.ledger.SaveRoundUps(batch); err != nil {
+		log.Printf("Unable to record batched round up deposit for account %s: %+v", account.id, err)
+	}
+}
+
+// runDailyRoundUps deposits batched round ups now and then just after every midnight until ctx is done.
+func (a *MonzoCustomisation) runDailyRoundUps(ctx context.Context) {
+	for {
+		a.depositBatchedRoundUps(ctx)
+
+		now := a.now()
+		tomorrow := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 5, 0, 0, now.Location())
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(tomorrow.Sub(now)):
+		}
+	}
+}
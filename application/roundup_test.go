@@ -0,0 +1,177 @@
+package application
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/tmilner/monzo-customisation/adapters/ledger"
+	"github.com/tmilner/monzo-customisation/adapters/monzorestclient"
+)
+
+type fakePotClient struct {
+	MonzoClient
+	deposits map[string]int64
+	// failures is how many deposits fail before they start working, failed holds their dedupe IDs.
+	failures int
+	failed   []string
+}
+
+func (f *fakePotClient) GetPots(ctx context.Context, authToken string) (*monzorestclient.PotsResponse, error) {
+	return &monzorestclient.PotsResponse{Pots: []monzorestclient.PotResponse{
+		{Id: "pot_old", Name: "Savings", Deleted: true},
+		{Id: "pot_1", Name: "Savings"},
+	}}, nil
+}
+
+func (f *fakePotClient) DepositIntoPot(ctx context.Context, potId string, sourceAccountId string, amount int64, dedupeId string, authToken string) (*monzorestclient.PotResponse, error) {
+	if f.failures > 0 {
+		f.failures--
+		f.failed = append(f.failed, dedupeId)
+		return nil, errors.New("connection reset")
+	}
+	f.deposits[dedupeId] += amount
+	return &monzorestclient.PotResponse{Id: potId}, nil
+}
+
+func TestRoundUpConfig_amount(t *testing.T) {
+	tests := []struct {
+		name   string
+		config RoundUpConfig
+		spent  int64
+		want   int64
+	}{
+		{"Nearest pound", RoundUpConfig{RoundTo: 100, Multiplier: 1}, -365, 35},
+		{"Whole pounds are not rounded", RoundUpConfig{RoundTo: 100, Multiplier: 1}, -400, 0},
+		{"Nearest five pounds", RoundUpConfig{RoundTo: 500, Multiplier: 1}, -365, 135},
+		{"Multiplier", RoundUpConfig{RoundTo: 100, Multiplier: 2}, -365, 70},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.config.amount(tt.spent); got != tt.want {
+				t.Errorf("RoundUpConfig.amount() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMonzoCustomisation_roundUp(t *testing.T) {
+	spend := func(id string, amount int64, created time.Time) *monzorestclient.TransactionDetailsResponse {
+		return &monzorestclient.TransactionDetailsResponse{
+			Id:        id,
+			AccountId: "acc_1",
+			Amount:    amount,
+			Created:   created,
+			Merchant:  monzorestclient.MerchantResponse{Id: "merch_1"},
+		}
+	}
+	yesterday := time.Now().AddDate(0, 0, -1)
+
+	tests := []struct {
+		name         string
+		batch        bool
+		transactions []*monzorestclient.TransactionDetailsResponse
+		// late arrive after the first batch has been deposited.
+		late         []*monzorestclient.TransactionDetailsResponse
+		failures     int
+		wantDeposits int
+		wantTotal    int64
+	}{
+		{
+			name:         "Each payment is deposited straight away",
+			transactions: []*monzorestclient.TransactionDetailsResponse{spend("tx_1", -365, yesterday), spend("tx_2", -180, yesterday)},
+			wantDeposits: 2,
+			wantTotal:    55,
+		},
+		{
+			name:         "Retried transactions use the same dedupe ID",
+			transactions: []*monzorestclient.TransactionDetailsResponse{spend("tx_1", -365, yesterday), spend("tx_1", -365, yesterday)},
+			wantDeposits: 1,
+			wantTotal:    70,
+		},
+		{
+			name: "Refunds and pot transfers are skipped",
+			transactions: []*monzorestclient.TransactionDetailsResponse{
+				{Id: "refund", AccountId: "acc_1", Amount: 365, Merchant: monzorestclient.MerchantResponse{Id: "merch_1"}},
+				{Id: "pot", AccountId: "acc_1", Amount: -365, Description: "pot_1"},
+			},
+			wantDeposits: 0,
+		},
+		{
+			name:         "Batched payments are deposited together the next day",
+			batch:        true,
+			transactions: []*monzorestclient.TransactionDetailsResponse{spend("tx_1", -365, yesterday), spend("tx_2", -180, yesterday), spend("tx_3", -150, time.Now())},
+			wantDeposits: 1,
+			wantTotal:    55,
+		},
+		{
+			name:         "Late payments make a second batch for the same day",
+			batch:        true,
+			transactions: []*monzorestclient.TransactionDetailsResponse{spend("tx_1", -365, yesterday)},
+			late:         []*monzorestclient.TransactionDetailsResponse{spend("tx_2", -180, yesterday)},
+			wantDeposits: 2,
+			wantTotal:    55,
+		},
+		{
+			name:         "A failed batch is retried with the same dedupe ID",
+			batch:        true,
+			transactions: []*monzorestclient.TransactionDetailsResponse{spend("tx_1", -365, yesterday), spend("tx_2", -180, yesterday)},
+			late:         []*monzorestclient.TransactionDetailsResponse{spend("tx_4", -150, yesterday)},
+			failures:     1,
+			wantDeposits: 2,
+			wantTotal:    105,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			user := &User{id: "user_1", auth: &Auth{AccessToken: "token"}}
+			account := &Account{id: "acc_1", type_: "uk_retail", user: user}
+			client := &fakePotClient{deposits: map[string]int64{}, failures: tt.failures}
+			store := &fakeLedger{recorded: map[string]bool{}, roundUps: map[string]*ledger.RoundUp{}}
+
+			a := &MonzoCustomisation{
+				now:      time.Now,
+				client:   client,
+				config:   &Config{RoundUps: []*RoundUpConfig{{PotName: "savings", RoundTo: 100, Multiplier: 1, BatchDaily: tt.batch}}},
+				users:    map[string]*User{user.id: user},
+				accounts: map[string]*Account{account.id: account},
+				ledger:   store,
+			}
+
+			for _, transaction := range tt.transactions {
+				a.roundUp(context.Background(), transaction, account)
+			}
+			a.depositBatchedRoundUps(context.Background())
+			for _, transaction := range tt.late {
+				a.roundUp(context.Background(), transaction, account)
+			}
+			a.depositBatchedRoundUps(context.Background())
+
+			var total int64
+			for _, amount := range client.deposits {
+				total += amount
+			}
+			if len(client.deposits) != tt.wantDeposits || total != tt.wantTotal {
+				t.Errorf("Deposits = %v, want %d deposits totalling %d", client.deposits, tt.wantDeposits, tt.wantTotal)
+			}
+			for _, dedupeId := range client.failed {
+				if _, found := client.deposits[dedupeId]; !found {
+					t.Errorf("Failed deposit %s was not retried with the same dedupe ID, deposits = %v", dedupeId, client.deposits)
+				}
+			}
+
+			for _, roundUp := range store.roundUps {
+				if roundUp.PotId != "pot_1" {
+					t.Errorf("Round up recorded against pot %s, want pot_1", roundUp.PotId)
+				}
+				if roundUp.TransactionId != "tx_3" && roundUp.Deposited.IsZero() {
+					t.Errorf("Round up for %s was not deposited", roundUp.TransactionId)
+				}
+			}
+			if pending, found := store.roundUps["tx_3"]; found && pending.DepositId != "" {
+				t.Error("Today's round up should still be waiting for the batch")
+			}
+		})
+	}
+}
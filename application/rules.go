@@ -0,0 +1,221 @@
+package application
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/tmilner/monzo-customisation/adapters/monzorestclient"
+)
+
+// Rule describes a set of match conditions and the actions to run when a transaction meets all of them.
+// Rules are evaluated in ascending Priority order, ties keep the order they were declared in.
+type Rule struct {
+	Name        string      `json:"name"`
+	Priority    int         `json:"priority"`
+	StopOnMatch bool        `json:"stop_on_match"`
+	Match       RuleMatch   `json:"match"`
+	Actions     RuleActions `json:"actions"`
+
+	description *regexp.Regexp
+	timeFrom    int
+	timeTo      int
+	hasTime     bool
+}
+
+// RuleMatch holds the conditions of a rule. Empty conditions always match.
+// Amounts are in pence and are inclusive, spending is negative as it is in the Monzo API.
+// TimeFrom and TimeTo are "15:04" formatted, in the rule set's location, and may wrap around midnight.
+type RuleMatch struct {
+	MerchantName     string `json:"merchant_name,omitempty"`
+	MerchantId       string `json:"merchant_id,omitempty"`
+	Category         string `json:"category,omitempty"`
+	MinAmount        *int64 `json:"min_amount,omitempty"`
+	MaxAmount        *int64 `json:"max_amount,omitempty"`
+	DescriptionRegex string `json:"description_regex,omitempty"`
+	AccountType      string `json:"account_type,omitempty"`
+	TimeFrom         string `json:"time_from,omitempty"`
+	TimeTo           string `json:"time_to,omitempty"`
+}
+
+type RuleActions struct {
+	SetNotes    string                  `json:"set_notes,omitempty"`
+	AddHashtags []string                `json:"add_hashtags,omitempty"`
+	FeedItem    *monzorestclient.Params `json:"feed_item,omitempty"`
+	Metadata    map[string]string       `json:"metadata,omitempty"`
+}
+
+type RuleSet struct {
+	rules    []*Rule
+	location *time.Location
+}
+
+func LoadRules(path string) (*RuleSet, error) {
+	body, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var rules []*Rule
+	if err = json.Unmarshal(body, &rules); err != nil {
+		return nil, fmt.Errorf("unable to parse rules file %s: %v", path, err)
+	}
+
+	return CreateRuleSet(rules)
+}
+
+func CreateRuleSet(rules []*Rule) (*RuleSet, error) {
+	for index, rule := range rules {
+		if err := rule.compile(); err != nil {
+			return nil, fmt.Errorf("rule %d (%s): %v", index, rule.Name, err)
+		}
+	}
+
+	sorted := make([]*Rule, len(rules))
+	copy(sorted, rules)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Priority < sorted[j].Priority
+	})
+
+	return &RuleSet{rules: sorted, location: time.UTC}, nil
+}
+
+// WithLocation sets where transaction times are read for time_from and time_to, UTC unless set.
+func (s *RuleSet) WithLocation(location *time.Location) *RuleSet {
+	s.location = location
+	return s
+}
+
+// Len is the number of rules in the set.
+func (s *RuleSet) Len() int {
+	if s == nil {
+		return 0
+	}
+	return len(s.rules)
+}
+
+func (r *Rule) compile() error {
+	if r.Match.DescriptionRegex != "" {
+		description, err := regexp.Compile(r.Match.DescriptionRegex)
+		if err != nil {
+			return err
+		}
+		r.description = description
+	}
+
+	if r.Match.MinAmount != nil && r.Match.MaxAmount != nil && *r.Match.MinAmount > *r.Match.MaxAmount {
+		return errors.New("min_amount is greater than max_amount")
+	}
+
+	if r.Match.TimeFrom != "" || r.Match.TimeTo != "" {
+		if r.Match.TimeFrom == "" || r.Match.TimeTo == "" {
+			return errors.New("time_from and time_to must be set together")
+		}
+		from, err := parseTimeOfDay(r.Match.TimeFrom)
+		if err != nil {
+			return err
+		}
+		to, err := parseTimeOfDay(r.Match.TimeTo)
+		if err != nil {
+			return err
+		}
+		r.timeFrom, r.timeTo, r.hasTime = from, to, true
+	}
+
+	return nil
+}
+
+func parseTimeOfDay(value string) (int, error) {
+	parsed, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q", value)
+	}
+	return parsed.Hour()*60 + parsed.Minute(), nil
+}
+
+// Evaluate returns the rules matching the transaction in the order their actions should be applied.
+func (s *RuleSet) Evaluate(transaction *monzorestclient.TransactionDetailsResponse, accountType string) []*Rule {
+	if s == nil {
+		return nil
+	}
+
+	matched := make([]*Rule, 0)
+	for _, rule := range s.rules {
+		if rule.matches(transaction, accountType, s.location) {
+			matched = append(matched, rule)
+			if rule.StopOnMatch {
+				break
+			}
+		}
+	}
+	return matched
+}
+
+func (r *Rule) matches(transaction *monzorestclient.TransactionDetailsResponse, accountType string, location *time.Location) bool {
+	match := r.Match
+
+	if match.MerchantName != "" && !strings.EqualFold(match.MerchantName, transaction.Merchant.Name) {
+		return false
+	}
+	if match.MerchantId != "" && match.MerchantId != transaction.Merchant.Id {
+		return false
+	}
+	if match.Category != "" && match.Category != transaction.Category {
+		return false
+	}
+	if match.MinAmount != nil && transaction.Amount < *match.MinAmount {
+		return false
+	}
+	if match.MaxAmount != nil && transaction.Amount > *match.MaxAmount {
+		return false
+	}
+	if r.description != nil && !r.description.MatchString(transaction.Description) {
+		return false
+	}
+	if match.AccountType != "" && match.AccountType != accountType {
+		return false
+	}
+	if r.hasTime {
+		if location == nil {
+			location = time.UTC
+		}
+		created := transaction.Created.In(location)
+		minute := created.Hour()*60 + created.Minute()
+		if r.timeFrom <= r.timeTo {
+			if minute < r.timeFrom || minute > r.timeTo {
+				return false
+			}
+		} else if minute < r.timeFrom && minute > r.timeTo {
+			return false
+		}
+	}
+
+	return true
+}
+
+// ruleMetadata merges the metadata, notes and hashtag actions of the given rules into a single update.
+// Hashtags are appended to the notes already on the transaction unless a rule replaces them.
+func ruleMetadata(rules []*Rule, existingNotes string) map[string]string {
+	metadata := map[string]string{}
+	notes := existingNotes
+
+	for _, rule := range rules {
+		for key, value := range rule.Actions.Metadata {
+			metadata[key] = value
+		}
+		if rule.Actions.SetNotes != "" {
+			notes = rule.Actions.SetNotes
+		}
+		notes = monzorestclient.AppendHashtags(notes, rule.Actions.AddHashtags...)
+	}
+
+	if notes != existingNotes {
+		metadata["notes"] = notes
+	}
+	return metadata
+}
@@ -0,0 +1,281 @@
+package application
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/tmilner/monzo-customisation/adapters/monzorestclient"
+)
+
+func amount(value int64) *int64 {
+	return &value
+}
+
+func TestRule_matches(t *testing.T) {
+	transaction := &monzorestclient.TransactionDetailsResponse{
+		Amount:      -350,
+		Created:     time.Date(2019, time.March, 12, 23, 30, 0, 0, time.UTC),
+		Description: "AMORET COFFEE LONDON",
+		Category:    "eating_out",
+		Merchant: monzorestclient.MerchantResponse{
+			Id:   "merch_123",
+			Name: "Amoret Coffee",
+		},
+	}
+
+	tests := []struct {
+		name        string
+		match       RuleMatch
+		accountType string
+		want        bool
+	}{
+		{
+			name:  "Empty conditions match everything",
+			match: RuleMatch{},
+			want:  true,
+		},
+		{
+			name:  "Merchant name matches ignoring case",
+			match: RuleMatch{MerchantName: "amoret coffee"},
+			want:  true,
+		},
+		{
+			name:  "Different merchant name does not match",
+			match: RuleMatch{MerchantName: "Tfl Cycle Hire"},
+			want:  false,
+		},
+		{
+			name:  "Merchant ID matches",
+			match: RuleMatch{MerchantId: "merch_123"},
+			want:  true,
+		},
+		{
+			name:  "Category must match exactly",
+			match: RuleMatch{Category: "groceries"},
+			want:  false,
+		},
+		{
+			name:  "Amount within an inclusive range matches",
+			match: RuleMatch{MinAmount: amount(-350), MaxAmount: amount(-100)},
+			want:  true,
+		},
+		{
+			name:  "Amount outside the range does not match",
+			match: RuleMatch{MaxAmount: amount(-500)},
+			want:  false,
+		},
+		{
+			name:  "Description regex matches",
+			match: RuleMatch{DescriptionRegex: "(?i)^amoret"},
+			want:  true,
+		},
+		{
+			name:        "Account type must match",
+			match:       RuleMatch{AccountType: "uk_retail_joint"},
+			accountType: "uk_retail",
+			want:        false,
+		},
+		{
+			name:  "Time of day within a window wrapping midnight matches",
+			match: RuleMatch{TimeFrom: "22:00", TimeTo: "03:00"},
+			want:  true,
+		},
+		{
+			name:  "Time of day outside a window does not match",
+			match: RuleMatch{TimeFrom: "07:00", TimeTo: "10:00"},
+			want:  false,
+		},
+		{
+			name:  "All conditions must match",
+			match: RuleMatch{MerchantName: "Amoret Coffee", Category: "groceries"},
+			want:  false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rule := &Rule{Name: tt.name, Match: tt.match}
+			if err := rule.compile(); err != nil {
+				t.Fatalf("Rule.compile() error = %v", err)
+			}
+			if got := rule.matches(transaction, tt.accountType, time.UTC); got != tt.want {
+				t.Errorf("Rule.matches() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRule_matches_location(t *testing.T) {
+	london, err := time.LoadLocation("Europe/London")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		created  time.Time
+		location *time.Location
+		from, to string
+		want     bool
+	}{
+		{"Summer evening in London", time.Date(2019, time.July, 1, 21, 30, 0, 0, time.UTC), london, "22:00", "23:00", true},
+		{"Summer evening in UTC", time.Date(2019, time.July, 1, 21, 30, 0, 0, time.UTC), time.UTC, "22:00", "23:00", false},
+		{"Summer morning in London", time.Date(2019, time.July, 1, 7, 30, 0, 0, time.UTC), london, "08:00", "09:00", true},
+		{"Winter evening in London", time.Date(2019, time.January, 1, 22, 30, 0, 0, time.UTC), london, "22:00", "23:00", true},
+		{"Summer window wrapping midnight in London", time.Date(2019, time.July, 1, 23, 30, 0, 0, time.UTC), london, "22:00", "00:15", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rule := &Rule{Name: tt.name, Match: RuleMatch{TimeFrom: tt.from, TimeTo: tt.to}}
+			if err := rule.compile(); err != nil {
+				t.Fatalf("Rule.compile() error = %v", err)
+			}
+			transaction := &monzorestclient.TransactionDetailsResponse{Created: tt.created}
+			if got := rule.matches(transaction, "", tt.location); got != tt.want {
+				t.Errorf("Rule.matches() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRuleSet_Evaluate(t *testing.T) {
+	transaction := &monzorestclient.TransactionDetailsResponse{
+		Amount:   -200,
+		Category: "transport",
+		Merchant: monzorestclient.MerchantResponse{Name: "Tfl Cycle Hire"},
+	}
+
+	tests := []struct {
+		name  string
+		rules []*Rule
+		want  []string
+	}{
+		{
+			name: "Rules are returned in priority order",
+			rules: []*Rule{
+				{Name: "second", Priority: 20},
+				{Name: "first", Priority: 10},
+				{Name: "third", Priority: 20},
+			},
+			want: []string{"first", "second", "third"},
+		},
+		{
+			name: "Stop on match prevents later rules from running",
+			rules: []*Rule{
+				{Name: "transport", Priority: 10, StopOnMatch: true, Match: RuleMatch{Category: "transport"}},
+				{Name: "catch all", Priority: 20},
+			},
+			want: []string{"transport"},
+		},
+		{
+			name: "Stop on match only applies when the rule matches",
+			rules: []*Rule{
+				{Name: "groceries", Priority: 10, StopOnMatch: true, Match: RuleMatch{Category: "groceries"}},
+				{Name: "catch all", Priority: 20},
+			},
+			want: []string{"catch all"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			set, err := CreateRuleSet(tt.rules)
+			if err != nil {
+				t.Fatalf("CreateRuleSet() error = %v", err)
+			}
+			got := make([]string, 0)
+			for _, rule := range set.Evaluate(transaction, "uk_retail") {
+				got = append(got, rule.Name)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("RuleSet.Evaluate() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCreateRuleSet_invalid(t *testing.T) {
+	tests := []struct {
+		name string
+		rule *Rule
+	}{
+		{"Invalid regex", &Rule{Match: RuleMatch{DescriptionRegex: "("}}},
+		{"Inverted amount range", &Rule{Match: RuleMatch{MinAmount: amount(10), MaxAmount: amount(-10)}}},
+		{"Only one side of a time window", &Rule{Match: RuleMatch{TimeFrom: "10:00"}}},
+		{"Invalid time", &Rule{Match: RuleMatch{TimeFrom: "25:00", TimeTo: "26:00"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := CreateRuleSet([]*Rule{tt.rule}); err == nil {
+				t.Error("CreateRuleSet() expected an error")
+			}
+		})
+	}
+}
+
+func Test_ruleMetadata(t *testing.T) {
+	tests := []struct {
+		name          string
+		rules         []*Rule
+		existingNotes string
+		want          map[string]string
+	}{
+		{
+			name:  "Hashtags are added to empty notes",
+			rules: []*Rule{{Actions: RuleActions{AddHashtags: []string{"#coffee", "treat"}}}},
+			want:  map[string]string{"notes": "#coffee #treat"},
+		},
+		{
+			name:          "Hashtags are appended to existing notes without duplicates",
+			rules:         []*Rule{{Actions: RuleActions{AddHashtags: []string{"#coffee", "#treat"}}}},
+			existingNotes: "with Sam #coffee",
+			want:          map[string]string{"notes": "with Sam #coffee #treat"},
+		},
+		{
+			name: "Set notes replaces existing notes and later hashtags are appended",
+			rules: []*Rule{
+				{Actions: RuleActions{SetNotes: "Cycling"}},
+				{Actions: RuleActions{AddHashtags: []string{"#cyceling"}, Metadata: map[string]string{"source": "rules"}}},
+			},
+			existingNotes: "old",
+			want:          map[string]string{"notes": "Cycling #cyceling", "source": "rules"},
+		},
+		{
+			name:          "Notes are untouched when no rule changes them",
+			rules:         []*Rule{{Actions: RuleActions{AddHashtags: []string{"#coffee"}}}},
+			existingNotes: "#coffee",
+			want:          map[string]string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ruleMetadata(tt.rules, tt.existingNotes); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ruleMetadata() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadRules(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rules")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "rules.json")
+	body := `[{"name": "Coffee", "priority": 1, "match": {"merchant_name": "Amoret Coffee"}, "actions": {"add_hashtags": ["#coffee"]}}]`
+	if err := ioutil.WriteFile(path, []byte(body), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	set, err := LoadRules(path)
+	if err != nil {
+		t.Fatalf("LoadRules() error = %v", err)
+	}
+	if len(set.rules) != 1 || set.rules[0].Actions.AddHashtags[0] != "#coffee" {
+		t.Errorf("LoadRules() = %+v", set.rules)
+	}
+}
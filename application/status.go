@@ -0,0 +1,46 @@
+package application
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// UserStatus is what the admin status endpoint reports about each signed in user.
+type UserStatus struct {
+	UserId         string    `json:"user_id"`
+	Accounts       []string  `json:"accounts"`
+	TokenExpiresAt time.Time `json:"token_expires_at"`
+	NeedsReauth    bool      `json:"needs_reauth"`
+}
+
+// UserStatuses reports every user, ordered by ID.
+func (a *MonzoCustomisation) UserStatuses() []*UserStatus {
+	a.directory.RLock()
+	users := make([]*User, 0, len(a.users))
+	for _, user := range a.users {
+		users = append(users, user)
+	}
+	a.directory.RUnlock()
+
+	statuses := make([]*UserStatus, 0, len(users))
+	for _, user := range users {
+		status := &UserStatus{UserId: user.id, Accounts: make([]string, 0, len(user.accounts))}
+		for _, account := range user.accounts {
+			status.Accounts = append(status.Accounts, account.id)
+		}
+		if auth := user.currentAuth(); auth != nil {
+			status.TokenExpiresAt = auth.ExpiresAt
+			status.NeedsReauth = auth.NeedsReauth
+		}
+		statuses = append(statuses, status)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].UserId < statuses[j].UserId })
+	return statuses
+}
+
+func (a *MonzoCustomisation) statusHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(a.UserStatuses())
+}
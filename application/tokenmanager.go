@@ -0,0 +1,208 @@
+package application
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/tmilner/monzo-customisation/adapters/monzorestclient"
+)
+
+const (
+	refreshLead     = 10 * time.Minute
+	refreshRetryMin = 5 * time.Second
+	refreshRetryMax = 10 * time.Minute
+)
+
+// tokenManager refreshes each user's access token shortly before it expires.
+// Every user has their own timer so a failure for one user never delays another.
+type tokenManager struct {
+	ctx         context.Context
+	cancel      context.CancelFunc
+	client      MonzoClient
+	config      *Config
+	now         func() time.Time
+	retryMin    time.Duration
+	retryMax    time.Duration
+	onRefreshed func(auth *Auth)
+	onRejected  func(userId string)
+	timers      map[string]*time.Timer
+	generations map[string]int
+	rejected    map[string]string
+	timersLock  sync.Mutex
+}
+
+func createTokenManager(client MonzoClient, config *Config, onRefreshed func(auth *Auth), onRejected func(userId string)) *tokenManager {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &tokenManager{
+		ctx:         ctx,
+		cancel:      cancel,
+		client:      client,
+		config:      config,
+		now:         time.Now,
+		retryMin:    refreshRetryMin,
+		retryMax:    refreshRetryMax,
+		onRefreshed: onRefreshed,
+		onRejected:  onRejected,
+		timers:      map[string]*time.Timer{},
+		generations: map[string]int{},
+		rejected:    map[string]string{},
+	}
+}
+
+// AuthFromResponse converts Monzo's token response, working out when the access token expires from now.
+func AuthFromResponse(res *monzorestclient.AuthResponse, now time.Time) *Auth {
+	return &Auth{
+		AccessToken:  res.AccessToken,
+		ClientId:     res.ClientId,
+		Expiry:       res.Expiry,
+		ExpiresAt:    now.Add(time.Duration(res.Expiry) * time.Second),
+		RefreshToken: res.RefreshToken,
+		TokenType:    res.TokenType,
+		UserId:       res.UserId,
+	}
+}
+
+// refreshDelay is how long to wait before refreshing, leaving refreshLead before expiry or half the
+// remaining lifetime for short lived tokens. Tokens without a known expiry are refreshed straight away.
+func refreshDelay(auth *Auth, now time.Time) time.Duration {
+	if auth.ExpiresAt.IsZero() {
+		return 0
+	}
+
+	remaining := auth.ExpiresAt.Sub(now)
+	if remaining <= 0 {
+		return 0
+	}
+	if remaining < 2*refreshLead {
+		return remaining / 2
+	}
+	return remaining - refreshLead
+}
+
+func retryDelay(attempt int, min time.Duration, max time.Duration) time.Duration {
+	delay := min
+	for i := 0; i < attempt && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		return max
+	}
+	return delay
+}
+
+// schedule replaces any pending refresh for the user with one based on the given auth.
+func (m *tokenManager) schedule(auth *Auth) {
+	m.scheduleAfter(auth, refreshDelay(auth, m.now()), 0)
+}
+
+func (m *tokenManager) scheduleAfter(auth *Auth, delay time.Duration, attempt int) {
+	m.timersLock.Lock()
+	defer m.timersLock.Unlock()
+
+	if timer, found := m.timers[auth.UserId]; found {
+		timer.Stop()
+	}
+	m.generations[auth.UserId]++
+	generation := m.generations[auth.UserId]
+
+	log.Printf("Refreshing token for user %s in %v", auth.UserId, delay)
+	m.timers[auth.UserId] = time.AfterFunc(delay, func() {
+		m.refresh(auth, attempt, generation)
+	})
+}
+
+// refreshNow refreshes straight away after Monzo rejected the access token. Calls that failed with the
+// same token while that refresh is running do not start another.
+func (m *tokenManager) refreshNow(auth *Auth) {
+	m.timersLock.Lock()
+	if m.rejected[auth.UserId] == auth.AccessToken {
+		m.timersLock.Unlock()
+		return
+	}
+	m.rejected[auth.UserId] = auth.AccessToken
+	m.timersLock.Unlock()
+
+	m.scheduleAfter(auth, 0, 0)
+}
+
+func (m *tokenManager) stop(userId string) {
+	m.timersLock.Lock()
+	defer m.timersLock.Unlock()
+
+	if timer, found := m.timers[userId]; found {
+		timer.Stop()
+		delete(m.timers, userId)
+	}
+	m.generations[userId]++
+}
+
+// stopAll stops every scheduled refresh and cancels any in progress, the manager cannot be used afterwards.
+func (m *tokenManager) stopAll() {
+	m.cancel()
+
+	m.timersLock.Lock()
+	defer m.timersLock.Unlock()
+
+	for userId, timer := range m.timers {
+		timer.Stop()
+		delete(m.timers, userId)
+		m.generations[userId]++
+	}
+}
+
+// current reports whether a timer is still the latest one scheduled for the user, so a refresh
+// that raced with a re-authentication does not overwrite the newer token.
+func (m *tokenManager) current(userId string, generation int) bool {
+	m.timersLock.Lock()
+	defer m.timersLock.Unlock()
+
+	return m.generations[userId] == generation
+}
+
+func (m *tokenManager) refresh(auth *Auth, attempt int, generation int) {
+	if !m.current(auth.UserId, generation) {
+		return
+	}
+
+	if auth.RefreshToken == "" {
+		log.Printf("User %s has no refresh token, they need to authenticate again", auth.UserId)
+		m.stop(auth.UserId)
+		m.onRejected(auth.UserId)
+		return
+	}
+
+	res, err := m.client.RefreshAuth(m.ctx, auth.RefreshToken, m.config.ClientId, m.config.ClientSecret)
+	if err != nil {
+		if errors.Is(err, monzorestclient.ErrAuthRejected) {
+			log.Printf("Refresh token for user %s was rejected, they need to authenticate again", auth.UserId)
+			m.stop(auth.UserId)
+			m.onRejected(auth.UserId)
+			return
+		}
+
+		delay := retryDelay(attempt, m.retryMin, m.retryMax)
+		log.Printf("Error refreshing token for user %s (attempt %d), retrying in %v: %+v", auth.UserId, attempt+1, delay, err)
+		if m.current(auth.UserId, generation) {
+			m.scheduleAfter(auth, delay, attempt+1)
+		}
+		return
+	}
+
+	refreshed := AuthFromResponse(res, m.now())
+	if refreshed.UserId == "" {
+		refreshed.UserId = auth.UserId
+	}
+	if refreshed.RefreshToken == "" {
+		refreshed.RefreshToken = auth.RefreshToken
+	}
+
+	if !m.current(auth.UserId, generation) {
+		return
+	}
+	log.Printf("Refreshed token for user %s", auth.UserId)
+	m.onRefreshed(refreshed)
+	m.schedule(refreshed)
+}
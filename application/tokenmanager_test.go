@@ -0,0 +1,223 @@
+package application
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/tmilner/monzo-customisation/adapters/monzorestclient"
+	"github.com/tmilner/monzo-customisation/adapters/tokenstore"
+)
+
+type fakeRefreshClient struct {
+	MonzoClient
+	refresh func(refreshToken string) (*monzorestclient.AuthResponse, error)
+}
+
+func (f *fakeRefreshClient) RefreshAuth(ctx context.Context, auth string, clientId string, clientSecret string) (*monzorestclient.AuthResponse, error) {
+	return f.refresh(auth)
+}
+
+func Test_refreshDelay(t *testing.T) {
+	now := time.Date(2019, time.March, 12, 10, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name      string
+		expiresAt time.Time
+		want      time.Duration
+	}{
+		{"Unknown expiry refreshes straight away", time.Time{}, 0},
+		{"Expired token refreshes straight away", now.Add(-time.Minute), 0},
+		{"Long lived token refreshes ahead of expiry", now.Add(6 * time.Hour), 6*time.Hour - refreshLead},
+		{"Short lived token refreshes half way", now.Add(10 * time.Minute), 5 * time.Minute},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := refreshDelay(&Auth{ExpiresAt: tt.expiresAt}, now); got != tt.want {
+				t.Errorf("refreshDelay() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_retryDelay(t *testing.T) {
+	tests := []struct {
+		attempt int
+		want    time.Duration
+	}{
+		{0, time.Second},
+		{1, 2 * time.Second},
+		{3, 8 * time.Second},
+		{10, 30 * time.Second},
+	}
+	for _, tt := range tests {
+		if got := retryDelay(tt.attempt, time.Second, 30*time.Second); got != tt.want {
+			t.Errorf("retryDelay(%d) = %v, want %v", tt.attempt, got, tt.want)
+		}
+	}
+}
+
+func TestTokenManager_refresh(t *testing.T) {
+	tests := []struct {
+		name         string
+		responses    []error
+		wantRejected bool
+		wantCalls    int
+	}{
+		{
+			name:      "Refreshes using the refresh token",
+			responses: []error{nil},
+			wantCalls: 1,
+		},
+		{
+			name:      "Retries transient failures",
+			responses: []error{errors.New("timeout"), errors.New("timeout"), nil},
+			wantCalls: 3,
+		},
+		{
+			name:         "Marks the user for re-auth when the refresh token is rejected",
+			responses:    []error{monzorestclient.ErrAuthRejected},
+			wantRejected: true,
+			wantCalls:    1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			client := &fakeRefreshClient{refresh: func(refreshToken string) (*monzorestclient.AuthResponse, error) {
+				if refreshToken != "refresh-1" {
+					t.Errorf("RefreshAuth() called with %s, want refresh-1", refreshToken)
+				}
+				err := tt.responses[calls]
+				calls++
+				if err != nil {
+					return nil, err
+				}
+				return &monzorestclient.AuthResponse{AccessToken: "access-2", RefreshToken: "refresh-2", Expiry: 21600, UserId: "user_1"}, nil
+			}}
+
+			done := make(chan *Auth, 1)
+			rejected := make(chan string, 1)
+			manager := createTokenManager(client, &Config{}, func(auth *Auth) {
+				done <- auth
+			}, func(userId string) {
+				rejected <- userId
+			})
+			manager.retryMin = time.Millisecond
+			manager.retryMax = 5 * time.Millisecond
+			defer manager.stopAll()
+
+			manager.schedule(&Auth{AccessToken: "access-1", RefreshToken: "refresh-1", UserId: "user_1"})
+
+			select {
+			case auth := <-done:
+				if tt.wantRejected {
+					t.Fatal("Expected the user to be rejected")
+				}
+				if auth.AccessToken != "access-2" || auth.ExpiresAt.IsZero() {
+					t.Errorf("Refreshed auth = %+v", auth)
+				}
+			case userId := <-rejected:
+				if !tt.wantRejected || userId != "user_1" {
+					t.Fatalf("Unexpected rejection for %s", userId)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("Timed out waiting for refresh")
+			}
+
+			if calls != tt.wantCalls {
+				t.Errorf("RefreshAuth() called %d times, want %d", calls, tt.wantCalls)
+			}
+		})
+	}
+}
+
+// unauthorizedClient rejects every feed item as Monzo does once an access token has been revoked.
+type unauthorizedClient struct {
+	fakeRefreshClient
+}
+
+func (f *unauthorizedClient) CreateFeedItem(ctx context.Context, item *monzorestclient.FeedItem, authToken string) error {
+	return &monzorestclient.APIError{StatusCode: 401, Code: "unauthorized.bad_access_token", Method: "POST", Path: "/feed"}
+}
+
+func TestMonzoCustomisation_checkApiError(t *testing.T) {
+	refreshed := make(chan string, 10)
+	client := &unauthorizedClient{fakeRefreshClient{refresh: func(refreshToken string) (*monzorestclient.AuthResponse, error) {
+		refreshed <- refreshToken
+		return &monzorestclient.AuthResponse{AccessToken: "access-2", RefreshToken: "refresh-2", Expiry: 21600, UserId: "user_1"}, nil
+	}}}
+	a := CreateMonzoCustomisation(client, &Config{}, &RuleSet{}, nil, nil)
+	defer a.tokenManager.stopAll()
+
+	user := &User{id: "user_1", auth: &Auth{AccessToken: "access-1", RefreshToken: "refresh-1", UserId: "user_1", ExpiresAt: time.Now().Add(time.Hour)}}
+	account := &Account{id: "acc_1", user: user}
+	user.accounts = []*Account{account}
+	a.addUser(user)
+
+	// Several calls failing with the same token start a single refresh.
+	for i := 0; i < 3; i++ {
+		if err := a.createFeedItem(context.Background(), account, &monzorestclient.Params{}); !monzorestclient.IsUnauthorized(err) {
+			t.Fatalf("createFeedItem() error = %v, want a 401", err)
+		}
+	}
+	select {
+	case refreshToken := <-refreshed:
+		if refreshToken != "refresh-1" {
+			t.Errorf("RefreshAuth() called with %s, want refresh-1", refreshToken)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for the rejected token to be refreshed")
+	}
+	waitFor(t, "the refreshed token to be used", func() bool { return user.accessToken() == "access-2" })
+	select {
+	case <-refreshed:
+		t.Error("Refreshed more than once for the same rejected token")
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+func TestMonzoCustomisation_markNeedsReauth(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tokens")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tokens, err := tokenstore.CreateFileTokenStore(filepath.Join(dir, "tokens.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = tokens.Save(&tokenstore.Token{UserId: "user_1", AccessToken: "token", RefreshToken: "refresh"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The client has no methods, so any call to Monzo for the flagged user panics.
+	config := &Config{AdminToken: "admin"}
+	a := CreateMonzoCustomisation(&fakeRefreshClient{}, config, &RuleSet{}, tokens, nil)
+	a.addUser(&User{id: "user_1", auth: &Auth{UserId: "user_1", AccessToken: "token", RefreshToken: "refresh"}})
+	a.markNeedsReauth("user_1")
+
+	if stored, err := tokens.Load("user_1"); err != nil || !stored.NeedsReauth || stored.RefreshToken != "refresh" {
+		t.Fatalf("Stored token = %+v, %v, want it flagged as needing re-auth", stored, err)
+	}
+
+	restarted := CreateMonzoCustomisation(&fakeRefreshClient{}, config, &RuleSet{}, tokens, nil)
+	restarted.restoreUsers(context.Background())
+	restarted.processTodaysTransactions(context.Background(), "user_1")
+	restarted.runBasicInfo(context.Background(), "user_1")
+	restarted.reconcileUserWebhooks(context.Background(), "user_1")
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/admin/status", nil)
+	r.Header.Set("Authorization", "Bearer admin")
+	restarted.ServeHTTP(w, r)
+	var statuses []*UserStatus
+	if err := json.Unmarshal(w.Body.Bytes(), &statuses); err != nil || len(statuses) != 1 || !statuses[0].NeedsReauth {
+		t.Errorf("Status = %s, want user_1 needing re-auth", w.Body)
+	}
+}
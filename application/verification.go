@@ -0,0 +1,83 @@
+package application
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/tmilner/monzo-customisation/adapters/monzorestclient"
+)
+
+// VerificationStats counts what checking webhooks against the API found. A webhook for a transaction that
+// does not exist, or is on a different account, is discarded. One whose amount or currency differs from
+// Monzo's copy is handled using Monzo's copy.
+type VerificationStats struct {
+	Verified        int64 `json:"verified"`
+	NotFound        int64 `json:"not_found"`
+	AccountMismatch int64 `json:"account_mismatch"`
+	ContentMismatch int64 `json:"content_mismatch"`
+}
+
+// VerificationStats returns the counts since the service started.
+func (a *MonzoCustomisation) VerificationStats() VerificationStats {
+	return VerificationStats{
+		Verified:        atomic.LoadInt64(&a.verification.Verified),
+		NotFound:        atomic.LoadInt64(&a.verification.NotFound),
+		AccountMismatch: atomic.LoadInt64(&a.verification.AccountMismatch),
+		ContentMismatch: atomic.LoadInt64(&a.verification.ContentMismatch),
+	}
+}
+
+// handleWebhookTransaction handles a transaction posted to the webhook. Webhooks are not signed, so with
+// verify_webhooks set the transaction is fetched from the API and Monzo's copy is handled instead.
+func (a *MonzoCustomisation) handleWebhookTransaction(ctx context.Context, transaction *monzorestclient.TransactionDetailsResponse) error {
+	if a.config.verifyWebhooks() {
+		verified, err := a.verifyTransaction(ctx, transaction)
+		if err != nil || verified == nil {
+			return err
+		}
+		transaction = verified
+	}
+	return a.handleTransaction(ctx, transaction)
+}
+
+// verifyTransaction returns Monzo's copy of the transaction, or nil if the webhook should be discarded.
+// Errors fetching the transaction are returned so the webhook is retried.
+func (a *MonzoCustomisation) verifyTransaction(ctx context.Context, transaction *monzorestclient.TransactionDetailsResponse) (*monzorestclient.TransactionDetailsResponse, error) {
+	account, found := a.account(transaction.AccountId)
+	if !found {
+		return nil, fmt.Errorf("account %s not found", transaction.AccountId)
+	}
+
+	fetched, err := a.client.GetTransaction(ctx, transaction.Id, account.user.accessToken())
+	if monzorestclient.IsNotFound(err) {
+		atomic.AddInt64(&a.verification.NotFound, 1)
+		log.Printf("Discarding webhook for transaction %s, Monzo has no such transaction on account %s", transaction.Id, transaction.AccountId)
+		return nil, nil
+	}
+	a.checkApiError(account.user, err)
+	if err != nil {
+		return nil, err
+	}
+
+	if fetched.AccountId != transaction.AccountId {
+		atomic.AddInt64(&a.verification.AccountMismatch, 1)
+		log.Printf("Discarding webhook for transaction %s, it claimed account %s but is on %s", transaction.Id, transaction.AccountId, fetched.AccountId)
+		return nil, nil
+	}
+	if fetched.Amount != transaction.Amount || fetched.Currency != transaction.Currency {
+		atomic.AddInt64(&a.verification.ContentMismatch, 1)
+		log.Printf("Webhook for transaction %s claimed %d %s, Monzo has %d %s", transaction.Id, transaction.Amount, transaction.Currency, fetched.Amount, fetched.Currency)
+	}
+
+	atomic.AddInt64(&a.verification.Verified, 1)
+	return fetched, nil
+}
+
+func (a *MonzoCustomisation) verificationHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(a.VerificationStats())
+}
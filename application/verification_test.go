@@ -0,0 +1,115 @@
+package application
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/tmilner/monzo-customisation/adapters/monzorestclient"
+)
+
+// fakeTransactionClient serves GetTransaction from a fixed set of transactions, anything else is a 404.
+type fakeTransactionClient struct {
+	MonzoClient
+	transactions map[string]monzorestclient.TransactionDetailsResponse
+	err          error
+}
+
+func (f *fakeTransactionClient) GetTransaction(ctx context.Context, transactionId string, authToken string) (*monzorestclient.TransactionDetailsResponse, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	transaction, found := f.transactions[transactionId]
+	if !found {
+		return nil, &monzorestclient.APIError{StatusCode: http.StatusNotFound}
+	}
+	return &transaction, nil
+}
+
+func TestMonzoCustomisation_handleWebhookTransaction(t *testing.T) {
+	created := time.Now()
+	monzo := map[string]monzorestclient.TransactionDetailsResponse{
+		"tx_1": {Id: "tx_1", AccountId: "acc_1", Amount: -250, Currency: "GBP", Created: created},
+		"tx_2": {Id: "tx_2", AccountId: "acc_2", Amount: -250, Currency: "GBP", Created: created},
+	}
+
+	tests := []struct {
+		name        string
+		verify      string
+		posted      monzorestclient.TransactionDetailsResponse
+		err         error
+		wantErr     bool
+		wantHandled int64
+		wantStats   VerificationStats
+	}{
+		{
+			name:        "Trusted without verification",
+			posted:      monzorestclient.TransactionDetailsResponse{Id: "tx_forged", AccountId: "acc_1", Amount: -999, Created: created},
+			wantHandled: -999,
+		},
+		{
+			name:        "Verified",
+			verify:      "true",
+			posted:      monzorestclient.TransactionDetailsResponse{Id: "tx_1", AccountId: "acc_1", Amount: -250, Currency: "GBP", Created: created},
+			wantHandled: -250,
+			wantStats:   VerificationStats{Verified: 1},
+		},
+		{
+			name:        "Monzo's copy is handled when the content differs",
+			verify:      "true",
+			posted:      monzorestclient.TransactionDetailsResponse{Id: "tx_1", AccountId: "acc_1", Amount: -999, Currency: "GBP", Created: created},
+			wantHandled: -250,
+			wantStats:   VerificationStats{Verified: 1, ContentMismatch: 1},
+		},
+		{
+			name:      "Unknown transaction is discarded",
+			verify:    "true",
+			posted:    monzorestclient.TransactionDetailsResponse{Id: "tx_forged", AccountId: "acc_1", Amount: -999, Created: created},
+			wantStats: VerificationStats{NotFound: 1},
+		},
+		{
+			name:      "Transaction on another account is discarded",
+			verify:    "true",
+			posted:    monzorestclient.TransactionDetailsResponse{Id: "tx_2", AccountId: "acc_1", Amount: -250, Currency: "GBP", Created: created},
+			wantStats: VerificationStats{AccountMismatch: 1},
+		},
+		{
+			name:    "Failing to fetch is retried",
+			verify:  "true",
+			posted:  monzorestclient.TransactionDetailsResponse{Id: "tx_1", AccountId: "acc_1", Amount: -250, Currency: "GBP", Created: created},
+			err:     errors.New("connection reset"),
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			user := &User{id: "user_1", auth: &Auth{AccessToken: "token"}}
+			account := &Account{id: "acc_1", type_: "uk_retail", user: user}
+			user.accounts = []*Account{account}
+
+			client := &fakeTransactionClient{transactions: monzo, err: tt.err}
+			a := CreateMonzoCustomisation(client, &Config{VerifyWebhooks: tt.verify}, &RuleSet{}, nil, nil)
+			a.executor.start()
+			defer a.executor.stop()
+			a.addUser(user)
+
+			err := a.handleWebhookTransaction(context.Background(), &tt.posted)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("handleWebhookTransaction() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			var handled int64
+			if daily, found := account.dailyInfo.Load(timeToDate(created)); found {
+				handled = daily.(DailyInfo).total
+			}
+			if handled != tt.wantHandled {
+				t.Errorf("Daily total = %d, want %d", handled, tt.wantHandled)
+			}
+			if got := a.VerificationStats(); got != tt.wantStats {
+				t.Errorf("VerificationStats() = %+v, want %+v", got, tt.wantStats)
+			}
+		})
+	}
+}
@@ -0,0 +1,267 @@
+package application
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/tmilner/monzo-customisation/adapters/ledger"
+)
+
+const (
+	webhookWorkers     = 4
+	webhookMaxAttempts = 8
+	webhookRetryMin    = 5 * time.Second
+	webhookRetryMax    = 10 * time.Minute
+)
+
+// WebhookQueue durably holds webhook bodies between the handler accepting them and a worker processing them.
+type WebhookQueue interface {
+	Enqueue(accountId string, body []byte, received time.Time) (*ledger.QueuedEvent, error)
+	Pending() ([]*ledger.QueuedEvent, error)
+	SaveQueued(event *ledger.QueuedEvent) error
+	Complete(id uint64) error
+	DeadLetter(event *ledger.QueuedEvent) error
+	DeadLetters() ([]*ledger.QueuedEvent, error)
+	Requeue(id uint64) error
+	DeleteDeadLetter(id uint64) error
+}
+
+// webhookWorkerPool processes queued webhooks in the background. Every account belongs to exactly one
+// worker, so an account's events are processed one at a time in the order they were received. A failed
+// event is retried with backoff and holds up later events for its account until it succeeds or, after
+// maxAttempts, is dead lettered.
+type webhookWorkerPool struct {
+	queue       WebhookQueue
+	process     func(ctx context.Context, event *ledger.QueuedEvent) error
+	now         func() time.Time
+	retryMin    time.Duration
+	retryMax    time.Duration
+	maxAttempts int
+	wakes       []chan struct{}
+	stop        chan struct{}
+	stopOnce    sync.Once
+	done        sync.WaitGroup
+}
+
+func createWebhookWorkerPool(queue WebhookQueue, process func(ctx context.Context, event *ledger.QueuedEvent) error, now func() time.Time, workers int) *webhookWorkerPool {
+	pool := &webhookWorkerPool{
+		queue:       queue,
+		process:     process,
+		now:         now,
+		retryMin:    webhookRetryMin,
+		retryMax:    webhookRetryMax,
+		maxAttempts: webhookMaxAttempts,
+		wakes:       make([]chan struct{}, workers),
+		stop:        make(chan struct{}),
+	}
+	for i := range pool.wakes {
+		pool.wakes[i] = make(chan struct{}, 1)
+	}
+	return pool
+}
+
+// start runs the workers, each begins with whatever was left in the queue by the last run.
+// Events are processed with ctx, cancelling it abandons the events in progress for a later attempt.
+func (p *webhookWorkerPool) start(ctx context.Context) {
+	for i := range p.wakes {
+		p.done.Add(1)
+		go p.run(ctx, i)
+	}
+}
+
+// stopAll stops the workers once they finish the event they are processing.
+// Anything still queued stays in the queue for the next run.
+func (p *webhookWorkerPool) stopAll() {
+	p.stopOnce.Do(func() { close(p.stop) })
+	p.done.Wait()
+}
+
+// wake tells the worker for the account that there is a new event.
+func (p *webhookWorkerPool) wake(accountId string) {
+	select {
+	case p.wakes[p.worker(accountId)] <- struct{}{}:
+	default:
+	}
+}
+
+func (p *webhookWorkerPool) wakeAll() {
+	for i := range p.wakes {
+		select {
+		case p.wakes[i] <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (p *webhookWorkerPool) worker(accountId string) int {
+	return shardFor(accountId, len(p.wakes))
+}
+
+func (p *webhookWorkerPool) run(ctx context.Context, worker int) {
+	defer p.done.Done()
+
+	for {
+		next := p.processPending(ctx, worker)
+
+		var retry <-chan time.Time
+		var timer *time.Timer
+		if !next.IsZero() {
+			timer = time.NewTimer(next.Sub(p.now()))
+			retry = timer.C
+		}
+
+		select {
+		case <-p.stop:
+			return
+		case <-p.wakes[worker]:
+		case <-retry:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+// processPending works through the worker's queued events, returning when the earliest held back retry
+// is due, or zero if nothing is waiting.
+func (p *webhookWorkerPool) processPending(ctx context.Context, worker int) time.Time {
+	events, err := p.queue.Pending()
+	if err != nil {
+		log.Printf("Unable to read the webhook queue: %+v", err)
+		return p.now().Add(p.retryMin)
+	}
+
+	var next time.Time
+	blocked := map[string]bool{}
+	holdBack := func(accountId string, until time.Time) {
+		blocked[accountId] = true
+		if next.IsZero() || until.Before(next) {
+			next = until
+		}
+	}
+
+	for _, event := range events {
+		if p.worker(event.AccountId) != worker || blocked[event.AccountId] {
+			continue
+		}
+		select {
+		case <-p.stop:
+			return time.Time{}
+		default:
+		}
+
+		if event.NextAttempt.After(p.now()) {
+			holdBack(event.AccountId, event.NextAttempt)
+			continue
+		}
+
+		if err := p.process(ctx, event); err != nil {
+			if retryAt, retrying := p.failed(event, err); retrying {
+				holdBack(event.AccountId, retryAt)
+			}
+			continue
+		}
+		if err := p.queue.Complete(event.Id); err != nil {
+			log.Printf("Unable to remove webhook %d from the queue: %+v", event.Id, err)
+			holdBack(event.AccountId, p.now().Add(p.retryMin))
+		}
+	}
+	return next
+}
+
+// failed records a failed attempt, returning when to retry or false once the event has been dead lettered.
+func (p *webhookWorkerPool) failed(event *ledger.QueuedEvent, err error) (time.Time, bool) {
+	event.Attempts++
+	event.LastError = err.Error()
+
+	if event.Attempts >= p.maxAttempts {
+		log.Printf("Dead lettering webhook %d for account %s after %d attempts: %+v", event.Id, event.AccountId, event.Attempts, err)
+		if err := p.queue.DeadLetter(event); err != nil {
+			log.Printf("Unable to dead letter webhook %d: %+v", event.Id, err)
+			return p.now().Add(p.retryMax), true
+		}
+		return time.Time{}, false
+	}
+
+	delay := retryDelay(event.Attempts-1, p.retryMin, p.retryMax)
+	log.Printf("Error processing webhook %d for account %s (attempt %d), retrying in %v: %+v", event.Id, event.AccountId, event.Attempts, delay, err)
+	event.NextAttempt = p.now().Add(delay)
+	if err := p.queue.SaveQueued(event); err != nil {
+		log.Printf("Unable to save retry state of webhook %d: %+v", event.Id, err)
+	}
+	return event.NextAttempt, true
+}
+
+// WithWebhookQueue makes the webhook handler queue events for background processing rather than
+// handling them before it responds.
+func (a *MonzoCustomisation) WithWebhookQueue(queue WebhookQueue) *MonzoCustomisation {
+	a.queue = queue
+	a.workers = createWebhookWorkerPool(queue, a.processQueuedEvent, a.now, webhookWorkers)
+	return a
+}
+
+func (a *MonzoCustomisation) processQueuedEvent(ctx context.Context, event *ledger.QueuedEvent) error {
+	var webhook WebhookResponse
+	if err := json.Unmarshal(event.Body, &webhook); err != nil {
+		return err
+	}
+	if !isHandledWebhook(&webhook) {
+		return nil
+	}
+	return a.handleWebhookTransaction(ctx, &webhook.Data)
+}
+
+func (a *MonzoCustomisation) deadLettersHandler(w http.ResponseWriter, r *http.Request) {
+	if a.queue == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	deadLetters, err := a.queue.DeadLetters()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(deadLetters)
+}
+
+func (a *MonzoCustomisation) retryDeadLetterHandler(w http.ResponseWriter, r *http.Request) {
+	a.deadLetterAction(w, r, func(id uint64) error {
+		if err := a.queue.Requeue(id); err != nil {
+			return err
+		}
+		a.workers.wakeAll()
+		return nil
+	})
+}
+
+func (a *MonzoCustomisation) deleteDeadLetterHandler(w http.ResponseWriter, r *http.Request) {
+	a.deadLetterAction(w, r, func(id uint64) error {
+		return a.queue.DeleteDeadLetter(id)
+	})
+}
+
+func (a *MonzoCustomisation) deadLetterAction(w http.ResponseWriter, r *http.Request, action func(id uint64) error) {
+	id, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 64)
+	if err != nil || a.queue == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	if err = action(id); err == ledger.ErrEventNotFound {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
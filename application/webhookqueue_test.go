@@ -0,0 +1,241 @@
+package application
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tmilner/monzo-customisation/adapters/ledger"
+	"github.com/tmilner/monzo-customisation/adapters/monzorestclient"
+)
+
+type memoryQueue struct {
+	lock        sync.Mutex
+	sequence    uint64
+	pending     map[uint64]ledger.QueuedEvent
+	deadLetters map[uint64]ledger.QueuedEvent
+}
+
+func createMemoryQueue() *memoryQueue {
+	return &memoryQueue{pending: map[uint64]ledger.QueuedEvent{}, deadLetters: map[uint64]ledger.QueuedEvent{}}
+}
+
+func (q *memoryQueue) Enqueue(accountId string, body []byte, received time.Time) (*ledger.QueuedEvent, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.sequence++
+	event := ledger.QueuedEvent{Id: q.sequence, AccountId: accountId, Body: body, Received: received}
+	q.pending[event.Id] = event
+	return &event, nil
+}
+
+func (q *memoryQueue) Pending() ([]*ledger.QueuedEvent, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return sortedEvents(q.pending), nil
+}
+
+func (q *memoryQueue) SaveQueued(event *ledger.QueuedEvent) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.pending[event.Id] = *event
+	return nil
+}
+
+func (q *memoryQueue) Complete(id uint64) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	delete(q.pending, id)
+	return nil
+}
+
+func (q *memoryQueue) DeadLetter(event *ledger.QueuedEvent) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	delete(q.pending, event.Id)
+	q.deadLetters[event.Id] = *event
+	return nil
+}
+
+func (q *memoryQueue) DeadLetters() ([]*ledger.QueuedEvent, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return sortedEvents(q.deadLetters), nil
+}
+
+func (q *memoryQueue) Requeue(id uint64) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	event, found := q.deadLetters[id]
+	if !found {
+		return ledger.ErrEventNotFound
+	}
+	delete(q.deadLetters, id)
+	event.Attempts = 0
+	event.NextAttempt = time.Time{}
+	q.pending[id] = event
+	return nil
+}
+
+func (q *memoryQueue) DeleteDeadLetter(id uint64) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if _, found := q.deadLetters[id]; !found {
+		return ledger.ErrEventNotFound
+	}
+	delete(q.deadLetters, id)
+	return nil
+}
+
+func sortedEvents(events map[uint64]ledger.QueuedEvent) []*ledger.QueuedEvent {
+	result := make([]*ledger.QueuedEvent, 0, len(events))
+	for _, event := range events {
+		copied := event
+		result = append(result, &copied)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Id < result[j].Id })
+	return result
+}
+
+func waitFor(t *testing.T, description string, condition func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", description)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestWebhookWorkerPool(t *testing.T) {
+	queue := createMemoryQueue()
+	for _, accountId := range []string{"acc_1", "acc_2", "acc_1", "acc_3", "acc_2"} {
+		_, _ = queue.Enqueue(accountId, nil, time.Now())
+	}
+
+	var lock sync.Mutex
+	processed := map[string][]uint64{}
+	failures := map[uint64]int{1: 2, 4: 10}
+	pool := createWebhookWorkerPool(queue, func(ctx context.Context, event *ledger.QueuedEvent) error {
+		lock.Lock()
+		defer lock.Unlock()
+		if failures[event.Id] > 0 {
+			failures[event.Id]--
+			return errors.New("monzo unavailable")
+		}
+		processed[event.AccountId] = append(processed[event.AccountId], event.Id)
+		return nil
+	}, time.Now, 2)
+	pool.retryMin = time.Millisecond
+	pool.retryMax = 5 * time.Millisecond
+	pool.maxAttempts = 3
+	pool.start(context.Background())
+	defer pool.stopAll()
+
+	waitFor(t, "the queue to empty", func() bool {
+		pending, _ := queue.Pending()
+		return len(pending) == 0
+	})
+
+	lock.Lock()
+	defer lock.Unlock()
+	want := map[string][]uint64{"acc_1": {1, 3}, "acc_2": {2, 5}}
+	if fmt.Sprint(processed) != fmt.Sprint(want) {
+		t.Errorf("Processed events = %v, want %v", processed, want)
+	}
+	deadLetters, _ := queue.DeadLetters()
+	if len(deadLetters) != 1 || deadLetters[0].Id != 4 || deadLetters[0].Attempts != 3 || deadLetters[0].LastError != "monzo unavailable" {
+		t.Errorf("DeadLetters() = %+v, want event 4 after 3 attempts", deadLetters)
+	}
+}
+
+func TestMonzoCustomisation_webhookQueue(t *testing.T) {
+	user := &User{id: "user_1", auth: &Auth{AccessToken: "token"}}
+	account := &Account{id: "acc_1", type_: "uk_retail", user: user}
+	user.accounts = []*Account{account}
+
+	queue := createMemoryQueue()
+	a := CreateMonzoCustomisation(&fakeFeedClient{}, &Config{AdminToken: "admin"}, &RuleSet{}, nil, nil).WithWebhookQueue(queue)
+	a.users[user.id] = user
+	a.accounts[account.id] = account
+	a.workers.maxAttempts = 1
+	a.executor.start()
+	a.workers.start(context.Background())
+	defer a.workers.stopAll()
+
+	created := time.Now()
+	for _, transaction := range []monzorestclient.TransactionDetailsResponse{
+		{Id: "tx_1", AccountId: "acc_1", Amount: -300, Created: created},
+		{Id: "tx_2", AccountId: "acc_unknown", Amount: -200, Created: created},
+	} {
+		w := httptest.NewRecorder()
+		a.ServeHTTP(w, httptest.NewRequest("POST", webhookPath(t, a, transaction.AccountId), webhookBody(transaction)))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Webhook status = %d, want %d", w.Code, http.StatusOK)
+		}
+	}
+
+	waitFor(t, "tx_1 to be handled", func() bool {
+		_, found := account.processedTransactions.Load("tx_1")
+		return found
+	})
+	if _, found := account.dailyInfo.Load(timeToDate(created)); !found {
+		t.Error("Queued transaction was not counted towards the daily total")
+	}
+
+	admin := func(method string, path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(method, path, nil)
+		r.Header.Set("Authorization", "Bearer admin")
+		a.ServeHTTP(w, r)
+		return w
+	}
+
+	var deadLetters []*ledger.QueuedEvent
+	waitFor(t, "the unknown account's event to be dead lettered", func() bool {
+		deadLetters = nil
+		_ = json.Unmarshal(admin("GET", "/admin/dead_letters").Body.Bytes(), &deadLetters)
+		return len(deadLetters) == 1
+	})
+	if deadLetters[0].AccountId != "acc_unknown" || !strings.Contains(deadLetters[0].LastError, "not found") {
+		t.Errorf("Dead letters = %+v", deadLetters[0])
+	}
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		wantStatus int
+	}{
+		{"Retry", "POST", fmt.Sprintf("/admin/dead_letters/%d/retry", deadLetters[0].Id), http.StatusNoContent},
+		{"Retry a missing dead letter", "POST", "/admin/dead_letters/99/retry", http.StatusNotFound},
+		{"Delete a missing dead letter", "DELETE", "/admin/dead_letters/99", http.StatusNotFound},
+		{"Bad ID", "DELETE", "/admin/dead_letters/abc", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if w := admin(tt.method, tt.path); w.Code != tt.wantStatus {
+				t.Errorf("%s %s status = %d, want %d", tt.method, tt.path, w.Code, tt.wantStatus)
+			}
+		})
+	}
+
+	waitFor(t, "the retried event to be dead lettered again", func() bool {
+		deadLetters, _ := queue.DeadLetters()
+		return len(deadLetters) == 1
+	})
+	if w := admin("DELETE", fmt.Sprintf("/admin/dead_letters/%d", deadLetters[0].Id)); w.Code != http.StatusNoContent {
+		t.Errorf("Delete status = %d, want %d", w.Code, http.StatusNoContent)
+	}
+	if remaining, _ := queue.DeadLetters(); len(remaining) != 0 {
+		t.Errorf("DeadLetters() after delete = %+v", remaining)
+	}
+}
@@ -0,0 +1,322 @@
+package application
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/tmilner/monzo-customisation/adapters/monzorestclient"
+)
+
+// maxWebhookBody is far larger than any webhook Monzo sends.
+const maxWebhookBody = 64 << 10
+
+// WebhookTokenStore keeps the secret token in each account's webhook URL, so the URLs survive restarts.
+type WebhookTokenStore interface {
+	WebhookToken(accountId string) (string, error)
+	SaveWebhookToken(accountId string, token string) error
+}
+
+type webhookAccountKey struct{}
+
+// WithWebhookTokens saves webhook tokens in the store, without one accounts get new webhook URLs on every start.
+func (a *MonzoCustomisation) WithWebhookTokens(store WebhookTokenStore) *MonzoCustomisation {
+	a.webhookTokenStore = store
+	return a
+}
+
+func createWebhookToken() (string, error) {
+	token := make([]byte, 32)
+	if _, err := rand.Read(token); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(token), nil
+}
+
+// loadWebhookToken gives the account the token saved for it, or a new one if it has never had one.
+func (a *MonzoCustomisation) loadWebhookToken(accountId string) error {
+	if a.webhookToken(accountId) != "" {
+		return nil
+	}
+
+	var token string
+	var err error
+	if a.webhookTokenStore != nil {
+		if token, err = a.webhookTokenStore.WebhookToken(accountId); err != nil {
+			return err
+		}
+	}
+	if token == "" {
+		if token, err = createWebhookToken(); err != nil {
+			return err
+		}
+		if a.webhookTokenStore != nil {
+			if err = a.webhookTokenStore.SaveWebhookToken(accountId, token); err != nil {
+				return err
+			}
+		}
+	}
+
+	a.directory.Lock()
+	defer a.directory.Unlock()
+	if len(a.webhookTokens[accountId]) == 0 {
+		a.webhookTokens[accountId] = []string{token}
+	}
+	return nil
+}
+
+// rotateWebhookToken gives the account a new webhook token. The old token is still accepted until the
+// account's webhooks have been reconciled, which moves Monzo over to the new URL.
+func (a *MonzoCustomisation) rotateWebhookToken(accountId string) error {
+	token, err := createWebhookToken()
+	if err != nil {
+		return err
+	}
+	if a.webhookTokenStore != nil {
+		if err = a.webhookTokenStore.SaveWebhookToken(accountId, token); err != nil {
+			return err
+		}
+	}
+
+	a.directory.Lock()
+	defer a.directory.Unlock()
+	a.webhookTokens[accountId] = append([]string{token}, a.webhookTokens[accountId]...)
+	return nil
+}
+
+// retireWebhookTokens stops accepting every token but the account's current one.
+func (a *MonzoCustomisation) retireWebhookTokens(accountId string) {
+	a.directory.Lock()
+	defer a.directory.Unlock()
+	if tokens := a.webhookTokens[accountId]; len(tokens) > 1 {
+		a.webhookTokens[accountId] = tokens[:1]
+	}
+}
+
+// webhookToken returns the token Monzo should be using for the account.
+func (a *MonzoCustomisation) webhookToken(accountId string) string {
+	a.directory.RLock()
+	defer a.directory.RUnlock()
+	if tokens := a.webhookTokens[accountId]; len(tokens) > 0 {
+		return tokens[0]
+	}
+	return ""
+}
+
+// webhookTokenAccount returns the account the token was issued for. Every token is compared in constant
+// time, so how long it takes gives nothing away about the tokens.
+func (a *MonzoCustomisation) webhookTokenAccount(token string) (string, bool) {
+	a.directory.RLock()
+	defer a.directory.RUnlock()
+
+	accountId, found := "", false
+	for id, tokens := range a.webhookTokens {
+		for _, accepted := range tokens {
+			if subtle.ConstantTimeCompare([]byte(accepted), []byte(token)) == 1 {
+				accountId, found = id, true
+			}
+		}
+	}
+	return accountId, found
+}
+
+// webhookUrl is WebhookURI with the account's token as the last path segment.
+func (a *MonzoCustomisation) webhookUrl(accountId string) string {
+	return strings.TrimSuffix(a.config.WebhookURI, "/") + "/" + a.webhookToken(accountId)
+}
+
+// webhookAuthHandler only lets webhooks through that were posted to a webhook URL with a token this
+// service issued, from an allowed IP and within the size limit. The account the token belongs to is put
+// in the request's context for webhookHandler to check against the transaction.
+func (a *MonzoCustomisation) webhookAuthHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !a.webhookIpAllowed(r) {
+			log.Printf("Rejected webhook from %s, not in the webhook allowlist", a.webhookIp(r))
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+
+		accountId, found := a.webhookTokenAccount(mux.Vars(r)["token"])
+		if !found {
+			log.Printf("Rejected webhook from %s with an unknown token", a.webhookIp(r))
+			http.NotFound(w, r)
+			return
+		}
+
+		if r.ContentLength > maxWebhookBody {
+			http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, maxWebhookBody)
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), webhookAccountKey{}, accountId)))
+	})
+}
+
+// webhookIp is the caller's IP, taken from WebhookIpHeader when the service is behind a proxy.
+func (a *MonzoCustomisation) webhookIp(r *http.Request) string {
+	if a.config.WebhookIpHeader != "" {
+		// Proxies append to the header, so the last address is the one the proxy saw.
+		forwarded := strings.Split(r.Header.Get(a.config.WebhookIpHeader), ",")
+		return strings.TrimSpace(forwarded[len(forwarded)-1])
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// createWebhookAllowlist parses the allowlist once. Validate rejects a malformed value so serve never starts
+// with one, anything else constructed with it rejects every webhook rather than allowing them all.
+func createWebhookAllowlist(value string) []*net.IPNet {
+	if strings.TrimSpace(value) == "" {
+		return nil
+	}
+	allowlist, err := parseIpAllowlist(value)
+	if err != nil {
+		log.Printf("Rejecting every webhook, webhook_allowed_ips is not valid: %v", err)
+		return []*net.IPNet{}
+	}
+	return allowlist
+}
+
+func (a *MonzoCustomisation) webhookIpAllowed(r *http.Request) bool {
+	if a.webhookAllowlist == nil {
+		return true
+	}
+
+	ip := net.ParseIP(a.webhookIp(r))
+	for _, network := range a.webhookAllowlist {
+		if ip != nil && network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseIpAllowlist parses a comma separated list of IPs and CIDR ranges, a single IP is a range of one.
+func parseIpAllowlist(value string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0)
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		cidr := entry
+		if ip := net.ParseIP(entry); ip != nil && ip.To4() != nil {
+			cidr += "/32"
+		} else if ip != nil {
+			cidr += "/128"
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not an IP or CIDR range", entry)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// rotateWebhookHandler gives the account a new webhook token and moves its webhook to the new URL in the
+// background, as the Monzo calls can take longer than a request is allowed.
+func (a *MonzoCustomisation) rotateWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	account, found := a.account(mux.Vars(r)["accountId"])
+	if !found {
+		http.NotFound(w, r)
+		return
+	}
+	if err := a.rotateWebhookToken(account.id); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	go func() {
+		if err := a.reconcileWebhooks(a.jobs, account); err != nil {
+			log.Printf("Error moving account %s to its new webhook URL: %+v", account.id, err)
+		}
+	}()
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// reconcileUserWebhooks reconciles the webhooks of each of the user's open accounts.
+func (a *MonzoCustomisation) reconcileUserWebhooks(ctx context.Context, userId string) {
+	user, found := a.activeUser(userId)
+	if !found {
+		return
+	}
+
+	for _, account := range user.accounts {
+		if account.closed {
+			continue
+		}
+		if err := a.reconcileWebhooks(ctx, account); err != nil {
+			log.Printf("Error reconciling webhooks for account %s: %+v", account.id, err)
+		}
+	}
+}
+
+// reconcileWebhooks leaves the account with exactly one webhook, pointing at its webhook URL. Every other
+// webhook on the account, whether a duplicate from an earlier authentication, left behind by an old
+// hostname or using a rotated token, is deleted, so the account's webhooks must all belong to this
+// deployment. The new webhook is registered before the old ones are deleted so no events are missed.
+func (a *MonzoCustomisation) reconcileWebhooks(ctx context.Context, account *Account) error {
+	if a.config.WebhookURI == "" {
+		log.Printf("No webhook_uri set, leaving the webhooks on account %s alone", account.id)
+		return nil
+	}
+	if err := a.loadWebhookToken(account.id); err != nil {
+		return fmt.Errorf("unable to load webhook token: %v", err)
+	}
+
+	token := account.user.accessToken()
+	webhooks, err := a.client.ListWebhooks(ctx, account.id, token)
+	a.checkApiError(account.user, err)
+	if err != nil {
+		return err
+	}
+
+	url := a.webhookUrl(account.id)
+	stale := make([]monzorestclient.Webhook, 0)
+	registered := false
+	for _, webhook := range webhooks.Webhooks {
+		if webhook.Url == url && !registered {
+			registered = true
+		} else {
+			stale = append(stale, webhook)
+		}
+	}
+
+	if !registered {
+		err := a.client.RegisterWebhook(ctx, account.id, token, url)
+		a.checkApiError(account.user, err)
+		if err != nil {
+			return err
+		}
+	}
+
+	var failed error
+	for _, webhook := range stale {
+		log.Printf("Deleting webhook %s on account %s", webhook.Id, account.id)
+		err := a.client.DeleteWebhook(ctx, webhook.Id, token)
+		if err != nil && !monzorestclient.IsNotFound(err) {
+			a.checkApiError(account.user, err)
+			failed = errors.New("unable to delete every stale webhook")
+			log.Printf("Error deleting webhook %s on account %s: %+v", webhook.Id, account.id, err)
+		}
+	}
+	if failed != nil {
+		return failed
+	}
+
+	a.retireWebhookTokens(account.id)
+	return nil
+}
@@ -0,0 +1,272 @@
+package application
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/tmilner/monzo-customisation/adapters/monzorestclient"
+	"github.com/tmilner/monzo-customisation/adapters/monzorestclient/monzotest"
+)
+
+// webhookPath gives the account a webhook token and returns the path Monzo would post its webhooks to.
+func webhookPath(t *testing.T, a *MonzoCustomisation, accountId string) string {
+	if err := a.loadWebhookToken(accountId); err != nil {
+		t.Fatal(err)
+	}
+	return "/webhook/" + a.webhookToken(accountId)
+}
+
+func createWebhookTestServer(t *testing.T) (*monzotest.Server, *monzorestclient.MonzoRestClient, string, func()) {
+	fake := monzotest.CreateServer("client", "secret")
+	fake.AddAccount("user_1", "acc_1", "uk_retail", 10000)
+	api := httptest.NewServer(fake)
+	client := monzorestclient.CreateMonzoRestClient(api.URL+"/", &http.Client{})
+	return fake, client, fake.IssueToken("user_1").AccessToken, api.Close
+}
+
+func webhookUrls(fake *monzotest.Server, accountId string) []string {
+	urls := make([]string, 0)
+	for _, webhook := range fake.Webhooks(accountId) {
+		urls = append(urls, webhook.Url)
+	}
+	return urls
+}
+
+func TestMonzoCustomisation_reconcileWebhooks(t *testing.T) {
+	// current stands for the account's webhook URL, which includes its token.
+	const current = "current"
+
+	tests := []struct {
+		name       string
+		webhookUri string
+		existing   []string
+		want       []string
+	}{
+		{"Registers when there are none", "https://monzo.example.com/webhook", nil, []string{current}},
+		{"Leaves a single current webhook alone", "https://monzo.example.com/webhook", []string{current}, []string{current}},
+		{"Removes duplicates from re-authenticating", "https://monzo.example.com/webhook", []string{current, current, current}, []string{current}},
+		{"Replaces webhooks without a token", "https://monzo.example.com/webhook", []string{"https://monzo.example.com/webhook"}, []string{current}},
+		{"Replaces webhooks for an old hostname", "https://monzo.example.com/webhook", []string{"https://old.example.com/webhook"}, []string{current}},
+		{"Removes stale webhooks beside the current one", "https://monzo.example.com/webhook", []string{"https://old.example.com/webhook", current, "http://localhost:8080/webhook"}, []string{current}},
+		{"Does nothing without a webhook URI", "", []string{"https://old.example.com/webhook"}, []string{"https://old.example.com/webhook"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake, client, token, cleanup := createWebhookTestServer(t)
+			defer cleanup()
+
+			a := CreateMonzoCustomisation(client, &Config{WebhookURI: tt.webhookUri}, &RuleSet{}, nil, nil)
+			account := &Account{id: "acc_1", user: &User{id: "user_1", auth: &Auth{AccessToken: token}}}
+			if err := a.loadWebhookToken(account.id); err != nil {
+				t.Fatal(err)
+			}
+			resolve := func(uri string) string {
+				if uri == current {
+					return a.webhookUrl(account.id)
+				}
+				return uri
+			}
+			for _, uri := range tt.existing {
+				if err := client.RegisterWebhook(context.Background(), "acc_1", token, resolve(uri)); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if err := a.reconcileWebhooks(context.Background(), account); err != nil {
+				t.Fatalf("reconcileWebhooks() error = %v", err)
+			}
+			// Reconciling again changes nothing.
+			if err := a.reconcileWebhooks(context.Background(), account); err != nil {
+				t.Fatalf("reconcileWebhooks() again error = %v", err)
+			}
+
+			got := webhookUrls(fake, "acc_1")
+			if len(got) != len(tt.want) || (len(got) == 1 && got[0] != resolve(tt.want[0])) {
+				t.Errorf("Webhooks after reconciling = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMonzoCustomisation_rotateWebhookToken(t *testing.T) {
+	fake, client, token, cleanup := createWebhookTestServer(t)
+	defer cleanup()
+
+	a := CreateMonzoCustomisation(client, &Config{WebhookURI: "https://monzo.example.com/webhook"}, &RuleSet{}, nil, nil)
+	account := &Account{id: "acc_1", user: &User{id: "user_1", auth: &Auth{AccessToken: token}}}
+	if err := a.reconcileWebhooks(context.Background(), account); err != nil {
+		t.Fatal(err)
+	}
+	old := a.webhookToken("acc_1")
+
+	if err := a.rotateWebhookToken("acc_1"); err != nil {
+		t.Fatalf("rotateWebhookToken() error = %v", err)
+	}
+	rotated := a.webhookToken("acc_1")
+	if rotated == old {
+		t.Fatal("rotateWebhookToken() kept the same token")
+	}
+	if accountId, found := a.webhookTokenAccount(old); !found || accountId != "acc_1" {
+		t.Error("Old token rejected before Monzo has moved to the new URL")
+	}
+
+	if err := a.reconcileWebhooks(context.Background(), account); err != nil {
+		t.Fatal(err)
+	}
+	if got := webhookUrls(fake, "acc_1"); len(got) != 1 || !strings.HasSuffix(got[0], "/"+rotated) {
+		t.Errorf("Webhooks after rotating = %v, want only the new URL", got)
+	}
+	if _, found := a.webhookTokenAccount(old); found {
+		t.Error("Old token still accepted after the old webhook was deleted")
+	}
+}
+
+func TestMonzoCustomisation_webhookAuthHandler(t *testing.T) {
+	body := func(accountId string) *bytes.Reader {
+		return webhookBody(monzorestclient.TransactionDetailsResponse{Id: "tx_1", AccountId: accountId})
+	}
+
+	tests := []struct {
+		name       string
+		config     Config
+		path       func(a *MonzoCustomisation) string
+		body       *bytes.Reader
+		header     string
+		wantStatus int
+	}{
+		{
+			name:       "Current token",
+			path:       func(a *MonzoCustomisation) string { return "/webhook/" + a.webhookToken("acc_1") },
+			body:       body("acc_1"),
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "No token",
+			path:       func(a *MonzoCustomisation) string { return "/webhook" },
+			body:       body("acc_1"),
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:       "Unknown token",
+			path:       func(a *MonzoCustomisation) string { return "/webhook/guessed" },
+			body:       body("acc_1"),
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:       "Transaction on another account",
+			path:       func(a *MonzoCustomisation) string { return "/webhook/" + a.webhookToken("acc_2") },
+			body:       body("acc_1"),
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "Too large",
+			path:       func(a *MonzoCustomisation) string { return "/webhook/" + a.webhookToken("acc_1") },
+			body:       bytes.NewReader(make([]byte, maxWebhookBody+1)),
+			wantStatus: http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:       "Allowed IP",
+			config:     Config{WebhookAllowedIps: "10.0.0.1, 192.0.2.0/24"},
+			path:       func(a *MonzoCustomisation) string { return "/webhook/" + a.webhookToken("acc_1") },
+			body:       body("acc_1"),
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "IP not allowed",
+			config:     Config{WebhookAllowedIps: "10.0.0.1"},
+			path:       func(a *MonzoCustomisation) string { return "/webhook/" + a.webhookToken("acc_1") },
+			body:       body("acc_1"),
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "Malformed allowlist",
+			config:     Config{WebhookAllowedIps: "not-an-ip"},
+			path:       func(a *MonzoCustomisation) string { return "/webhook/" + a.webhookToken("acc_1") },
+			body:       body("acc_1"),
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "IP from a proxy header",
+			config:     Config{WebhookAllowedIps: "10.0.0.1", WebhookIpHeader: "X-Forwarded-For"},
+			path:       func(a *MonzoCustomisation) string { return "/webhook/" + a.webhookToken("acc_1") },
+			body:       body("acc_1"),
+			header:     "198.51.100.7, 10.0.0.1",
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "Spoofed proxy header",
+			config:     Config{WebhookAllowedIps: "10.0.0.1", WebhookIpHeader: "X-Forwarded-For"},
+			path:       func(a *MonzoCustomisation) string { return "/webhook/" + a.webhookToken("acc_1") },
+			body:       body("acc_1"),
+			header:     "10.0.0.1, 198.51.100.7",
+			wantStatus: http.StatusForbidden,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := tt.config
+			a := CreateMonzoCustomisation(&fakeFeedClient{}, &config, &RuleSet{}, nil, nil)
+			for _, accountId := range []string{"acc_1", "acc_2"} {
+				if err := a.loadWebhookToken(accountId); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("POST", tt.path(a), tt.body)
+			if tt.header != "" {
+				r.Header.Set("X-Forwarded-For", tt.header)
+			}
+			a.ServeHTTP(w, r)
+			if w.Code != tt.wantStatus {
+				t.Errorf("Webhook status = %d, want %d", w.Code, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestMonzoCustomisation_webhookHandler_eventTypes(t *testing.T) {
+	for _, queued := range []bool{false, true} {
+		t.Run(fmt.Sprintf("Queued %v", queued), func(t *testing.T) {
+			user := &User{id: "user_1", auth: &Auth{AccessToken: "token"}}
+			account := &Account{id: "acc_1", type_: "uk_retail", user: user}
+			user.accounts = []*Account{account}
+
+			a := CreateMonzoCustomisation(&fakeFeedClient{}, &Config{}, &RuleSet{}, nil, nil)
+			a.executor.start()
+			defer a.executor.stop()
+			if queued {
+				a.WithWebhookQueue(createMemoryQueue())
+				a.workers.start(context.Background())
+				defer a.workers.stopAll()
+			}
+			a.addUser(user)
+
+			for _, webhook := range []WebhookResponse{
+				{TransactionType: "transaction.updated", Data: monzorestclient.TransactionDetailsResponse{Id: "tx_updated", AccountId: "acc_1", Amount: -300}},
+				{TransactionType: transactionCreated, Data: monzorestclient.TransactionDetailsResponse{Id: "tx_created", AccountId: "acc_1", Amount: -200}},
+			} {
+				body, _ := json.Marshal(webhook)
+				w := httptest.NewRecorder()
+				a.ServeHTTP(w, httptest.NewRequest("POST", webhookPath(t, a, "acc_1"), bytes.NewReader(body)))
+				if w.Code != http.StatusOK {
+					t.Fatalf("Webhook status = %d, want %d", w.Code, http.StatusOK)
+				}
+			}
+
+			waitFor(t, "the created transaction to be handled", func() bool {
+				_, found := account.processedTransactions.Load("tx_created")
+				return found
+			})
+			if _, found := account.processedTransactions.Load("tx_updated"); found {
+				t.Error("transaction.updated webhook was handled as a new transaction")
+			}
+		})
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/tmilner/monzo-customisation/adapters/monzorestclient"
+	"github.com/tmilner/monzo-customisation/adapters/tokenstore"
+	"github.com/tmilner/monzo-customisation/application"
+	"github.com/twinj/uuid"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// authCommand runs the OAuth flow against a temporary server on localhost and saves the resulting token,
+// so a user can be added without exposing the webhook server. The redirect URI must be registered with
+// the Monzo OAuth client.
+func authCommand(ctx context.Context, config *application.Config, args []string) error {
+	flags := flag.NewFlagSet("auth", flag.ExitOnError)
+	listen := flags.String("listen", "localhost:8080", "address for the temporary server")
+	redirect := flags.String("redirect", "", "redirect URI registered with Monzo, defaults to http://<listen>/auth_return")
+	timeout := flags.Duration("timeout", 5*time.Minute, "how long to wait for the user to authorise")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if config.ClientId == "" || config.ClientSecret == "" {
+		return errors.New("client_id and client_secret must be set to authorise")
+	}
+
+	redirectUri := *redirect
+	if redirectUri == "" {
+		redirectUri = "http://" + *listen + "/auth_return"
+	}
+	state := uuid.NewV4().String()
+
+	query := url.Values{}
+	query.Set("client_id", config.ClientId)
+	query.Set("redirect_uri", redirectUri)
+	query.Set("response_type", "code")
+	query.Set("state", state)
+	authUrl := strings.TrimSuffix(config.MonzoAuthUrl, "/") + "/?" + query.Encode()
+
+	tokens, err := openTokenStore(config)
+	if err != nil {
+		return err
+	}
+	client := createClient(config)
+
+	result := make(chan error, 1)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, authUrl, http.StatusSeeOther)
+	})
+	mux.HandleFunc("/auth_return", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("state") != state {
+			http.Error(w, "State does not match, start again.", http.StatusBadRequest)
+			return
+		}
+
+		token, err := exchangeCode(r.Context(), client, config, r.URL.Query().Get("code"), redirectUri, tokens)
+		if err != nil {
+			http.Error(w, "Unable to authorise: "+err.Error(), http.StatusBadGateway)
+			result <- err
+			return
+		}
+
+		_, _ = io.WriteString(w, "Authorised, you can close this window.")
+		log.Printf("Saved token for user %s", token.UserId)
+		result <- nil
+	})
+
+	listener, err := net.Listen("tcp", *listen)
+	if err != nil {
+		return err
+	}
+	server := &http.Server{Handler: mux}
+	go func() { _ = server.Serve(listener) }()
+	defer server.Shutdown(context.Background())
+
+	fmt.Printf("Open this URL to authorise:\n\n  %s\n\nthen approve access in the Monzo app.\n", authUrl)
+
+	select {
+	case err = <-result:
+		return err
+	case <-time.After(*timeout):
+		return errors.New("timed out waiting for authorisation")
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func exchangeCode(ctx context.Context, client *monzorestclient.MonzoRestClient, config *application.Config, code string, redirectUri string, tokens application.TokenStore) (*tokenstore.Token, error) {
+	res, err := client.Authenticate(ctx, code, config.ClientId, config.ClientSecret, redirectUri)
+	if err != nil {
+		return nil, err
+	}
+
+	token := tokenstore.Token(*application.AuthFromResponse(res, time.Now()))
+	if err = tokens.Save(&token); err != nil {
+		return nil, err
+	}
+	return &token, nil
+}
+
+// userToken loads the token for userId, or the only user in the store when userId is empty.
+func userToken(tokens application.TokenStore, userId string) (*tokenstore.Token, error) {
+	var token *tokenstore.Token
+	if userId != "" {
+		loaded, err := tokens.Load(userId)
+		if err != nil {
+			return nil, fmt.Errorf("user %s: %v", userId, err)
+		}
+		token = loaded
+	} else {
+		all, err := tokens.LoadAll()
+		if err != nil {
+			return nil, err
+		}
+		switch len(all) {
+		case 0:
+			return nil, errors.New("no users in the token store, run auth first")
+		case 1:
+			token = all[0]
+		default:
+			return nil, fmt.Errorf("%d users in the token store, choose one with -user", len(all))
+		}
+	}
+	return token, checkToken(token)
+}
+
+// checkToken makes sure the stored access token can still be used. Commands never refresh it themselves:
+// Monzo's refresh tokens are single use, so refreshing here would break the token held by a running server.
+func checkToken(token *tokenstore.Token) error {
+	if token.NeedsReauth {
+		return fmt.Errorf("user %s needs to sign in again, run auth", token.UserId)
+	}
+	if !token.ExpiresAt.IsZero() && !time.Now().Before(token.ExpiresAt) {
+		return fmt.Errorf("access token for user %s has expired, it is refreshed while serve is running or run auth again", token.UserId)
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+// Command fakemonzo serves the in-memory Monzo API from monzotest for local development.
+//
+// Point monzo_api_url at http://<listen>/, monzo_token_url at http://<listen>/oauth2/token and
+// monzo_auth_url at http://<listen>/auth. Transactions, and the webhooks for them, can be created by
+// posting a transaction as JSON to /_fake/transactions, e.g.
+//
+//	curl -d '{"account_id":"acc_demo","amount":-350,"description":"Coffee"}' localhost:8000/_fake/transactions
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/tmilner/monzo-customisation/adapters/monzorestclient"
+	"github.com/tmilner/monzo-customisation/adapters/monzorestclient/monzotest"
+)
+
+func main() {
+	log.SetPrefix("[FAKE MONZO]")
+
+	listen := flag.String("listen", "localhost:8000", "address to serve the fake API on")
+	clientId := flag.String("client-id", "client", "OAuth client ID the fake accepts")
+	clientSecret := flag.String("client-secret", "secret", "OAuth client secret the fake accepts")
+	seed := flag.Bool("seed", true, "create a demo user with an account, a pot and some transactions")
+	flag.Parse()
+
+	fake := monzotest.CreateServer(*clientId, *clientSecret)
+	if *seed {
+		seedDemo(fake)
+	}
+
+	log.Printf("Serving the fake Monzo API on http://%s/", *listen)
+	log.Fatalln(http.ListenAndServe(*listen, fake))
+}
+
+func seedDemo(fake *monzotest.Server) {
+	fake.AddAccount("user_demo", "acc_demo", "uk_retail", 250000)
+	_ = fake.AddPot("acc_demo", "pot_demo", "Savings", 100000)
+
+	yesterday := time.Now().AddDate(0, 0, -1)
+	for _, transaction := range []monzorestclient.TransactionDetailsResponse{
+		{Amount: -350, Description: "PRET A MANGER", Category: "eating_out", Scheme: "mastercard", Merchant: monzorestclient.MerchantResponse{Id: "merch_pret", Name: "Pret A Manger"}},
+		{Amount: -4599, Description: "TESCO STORES", Category: "groceries", Scheme: "mastercard", Merchant: monzorestclient.MerchantResponse{Id: "merch_tesco", Name: "Tesco"}},
+		{Amount: -1299, Description: "EXAMPLE MOBILE LTD", Category: "bills", Scheme: "bacs"},
+	} {
+		transaction.AccountId = "acc_demo"
+		transaction.Created = yesterday
+		_, _ = fake.CreateTransaction(transaction)
+	}
+	log.Println("Seeded user_demo with account acc_demo and pot pot_demo")
+}
@@ -0,0 +1,597 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/tmilner/monzo-customisation/adapters/ledger"
+	"github.com/tmilner/monzo-customisation/adapters/monzorestclient"
+	"github.com/tmilner/monzo-customisation/adapters/tokenstore"
+	"github.com/tmilner/monzo-customisation/application"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// session is what the query commands need to talk to Monzo on behalf of one user.
+type session struct {
+	config *application.Config
+	client *monzorestclient.MonzoRestClient
+	token  *tokenstore.Token
+}
+
+func openSession(ctx context.Context, config *application.Config, userId string) (*session, error) {
+	tokens, err := openTokenStore(config)
+	if err != nil {
+		return nil, err
+	}
+	client := createClient(config)
+	token, err := userToken(tokens, userId)
+	if err != nil {
+		return nil, err
+	}
+	return &session{config: config, client: client, token: token}, nil
+}
+
+// accountIds is the account given on the command line, or every open account the user has.
+func (s *session) accountIds(ctx context.Context, accountId string) ([]string, error) {
+	if accountId != "" {
+		return []string{accountId}, nil
+	}
+	accounts, err := s.client.ListAccounts(ctx, s.token.AccessToken)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, 0, len(accounts.Accounts))
+	for _, account := range accounts.Accounts {
+		if !account.Closed {
+			ids = append(ids, account.Id)
+		}
+	}
+	return ids, nil
+}
+
+func accountsCommand(ctx context.Context, config *application.Config, args []string) error {
+	flags := flag.NewFlagSet("accounts", flag.ExitOnError)
+	userId := flags.String("user", "", "user ID, needed when the token store has more than one user")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	s, err := openSession(ctx, config, *userId)
+	if err != nil {
+		return err
+	}
+	accounts, err := s.client.ListAccounts(ctx, s.token.AccessToken)
+	if err != nil {
+		return err
+	}
+
+	table := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(table, "ID\tTYPE\tDESCRIPTION\tSORT CODE\tACCOUNT\tCLOSED")
+	for _, account := range accounts.Accounts {
+		fmt.Fprintf(table, "%s\t%s\t%s\t%s\t%s\t%v\n", account.Id, account.Type, account.Description, account.SortCode, account.AccountNumber, account.Closed)
+	}
+	return table.Flush()
+}
+
+func potsCommand(ctx context.Context, config *application.Config, args []string) error {
+	flags := flag.NewFlagSet("pots", flag.ExitOnError)
+	userId := flags.String("user", "", "user ID, needed when the token store has more than one user")
+	deleted := flags.Bool("deleted", false, "include deleted pots")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	s, err := openSession(ctx, config, *userId)
+	if err != nil {
+		return err
+	}
+	pots, err := s.client.GetPots(ctx, s.token.AccessToken)
+	if err != nil {
+		return err
+	}
+
+	table := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(table, "ID\tNAME\tBALANCE")
+	for _, pot := range pots.Pots {
+		if pot.Deleted && !*deleted {
+			continue
+		}
+		fmt.Fprintf(table, "%s\t%s\t%s\n", pot.Id, pot.Name, formatAmount(pot.Balance))
+	}
+	return table.Flush()
+}
+
+func balanceCommand(ctx context.Context, config *application.Config, args []string) error {
+	flags := flag.NewFlagSet("balance", flag.ExitOnError)
+	userId := flags.String("user", "", "user ID, needed when the token store has more than one user")
+	accountId := flags.String("account", "", "account ID, defaults to every open account")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	s, err := openSession(ctx, config, *userId)
+	if err != nil {
+		return err
+	}
+	accountIds, err := s.accountIds(ctx, *accountId)
+	if err != nil {
+		return err
+	}
+
+	table := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(table, "ACCOUNT\tBALANCE\tWITH POTS\tSPENT TODAY")
+	for _, id := range accountIds {
+		balance, err := s.client.GetBalance(ctx, id, s.token.AccessToken)
+		if err != nil {
+			return fmt.Errorf("balance for %s: %v", id, err)
+		}
+		fmt.Fprintf(table, "%s\t%s\t%s\t%s\n", id, formatAmount(balance.Balance), formatAmount(balance.TotalBalance), formatAmount(balance.SpendToday))
+	}
+	return table.Flush()
+}
+
+// transactionFilter narrows a list of transactions down, every field that is set has to match.
+type transactionFilter struct {
+	search   string
+	category string
+	kind     string
+	min      int64
+	max      int64
+	hasMin   bool
+	hasMax   bool
+}
+
+func (f *transactionFilter) matches(transaction *monzorestclient.TransactionDetailsResponse) bool {
+	if f.category != "" && !strings.EqualFold(f.category, transaction.Category) {
+		return false
+	}
+	if f.kind != "" && f.kind != string(application.ClassifyTransaction(transaction)) {
+		return false
+	}
+	if f.hasMin && transaction.Amount < f.min {
+		return false
+	}
+	if f.hasMax && transaction.Amount > f.max {
+		return false
+	}
+	if f.search != "" {
+		search := strings.ToLower(f.search)
+		found := false
+		for _, field := range []string{transaction.Description, transaction.Merchant.Name, transaction.Notes} {
+			if strings.Contains(strings.ToLower(field), search) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// transactionQuery is the set of flags shared by the transactions and export commands.
+type transactionQuery struct {
+	userId    *string
+	accountId *string
+	source    *string
+	since     *string
+	before    *string
+	search    *string
+	category  *string
+	kind      *string
+	min       *string
+	max       *string
+}
+
+func addTransactionFlags(flags *flag.FlagSet, defaultSource string) *transactionQuery {
+	return &transactionQuery{
+		userId:    flags.String("user", "", "user ID, needed when the token store has more than one user"),
+		accountId: flags.String("account", "", "account ID, defaults to every open account"),
+		source:    flags.String("source", defaultSource, "where to read transactions from: api or ledger, the ledger can't be read while serve is running"),
+		since:     flags.String("since", "", "only transactions on or after this date (2006-01-02 or RFC3339)"),
+		before:    flags.String("before", "", "only transactions before this date (2006-01-02 or RFC3339)"),
+		search:    flags.String("search", "", "text to look for in the description, merchant or notes"),
+		category:  flags.String("category", "", "Monzo category, e.g. groceries"),
+		kind:      flags.String("kind", "", "transaction kind, e.g. card_spend or pot_transfer"),
+		min:       flags.String("min", "", "smallest amount in pounds, spending is negative"),
+		max:       flags.String("max", "", "largest amount in pounds, spending is negative"),
+	}
+}
+
+// run fetches the matching transactions, oldest first for each account.
+func (q *transactionQuery) run(ctx context.Context, config *application.Config) ([]*monzorestclient.TransactionDetailsResponse, error) {
+	since, err := parseDate(*q.since)
+	if err != nil {
+		return nil, fmt.Errorf("-since: %v", err)
+	}
+	before, err := parseDate(*q.before)
+	if err != nil {
+		return nil, fmt.Errorf("-before: %v", err)
+	}
+
+	filter := &transactionFilter{search: *q.search, category: *q.category, kind: *q.kind}
+	if *q.min != "" {
+		if filter.min, err = parseAmount(*q.min); err != nil {
+			return nil, fmt.Errorf("-min: %v", err)
+		}
+		filter.hasMin = true
+	}
+	if *q.max != "" {
+		if filter.max, err = parseAmount(*q.max); err != nil {
+			return nil, fmt.Errorf("-max: %v", err)
+		}
+		filter.hasMax = true
+	}
+
+	s, err := openSession(ctx, config, *q.userId)
+	if err != nil {
+		return nil, err
+	}
+	accountIds, err := s.accountIds(ctx, *q.accountId)
+	if err != nil {
+		return nil, err
+	}
+
+	var list func(accountId string) ([]*monzorestclient.TransactionDetailsResponse, error)
+	switch *q.source {
+	case "api":
+		list = func(accountId string) ([]*monzorestclient.TransactionDetailsResponse, error) {
+			query := monzorestclient.TransactionsQuery{Before: before}
+			if !since.IsZero() {
+				query.Since = since.UTC().Format(time.RFC3339)
+			}
+			it := s.client.IterateTransactions(ctx, accountId, func() string { return s.token.AccessToken }, query)
+			result := make([]*monzorestclient.TransactionDetailsResponse, 0)
+			for it.Next() {
+				result = append(result, it.Transaction())
+			}
+			return result, it.Err()
+		}
+	case "ledger":
+		transactions, err := ledger.CreateLedger(config.LedgerPath)
+		if err != nil {
+			return nil, fmt.Errorf("unable to open transaction ledger: %v", err)
+		}
+		defer transactions.Close()
+		list = func(accountId string) ([]*monzorestclient.TransactionDetailsResponse, error) {
+			return transactions.Query(accountId, since, before)
+		}
+	default:
+		return nil, fmt.Errorf("unknown source %q, use api or ledger", *q.source)
+	}
+
+	result := make([]*monzorestclient.TransactionDetailsResponse, 0)
+	for _, accountId := range accountIds {
+		transactions, err := list(accountId)
+		if err != nil {
+			return nil, fmt.Errorf("transactions for %s: %v", accountId, err)
+		}
+		for _, transaction := range transactions {
+			if filter.matches(transaction) {
+				result = append(result, transaction)
+			}
+		}
+	}
+	return result, nil
+}
+
+func transactionsCommand(ctx context.Context, config *application.Config, args []string) error {
+	flags := flag.NewFlagSet("transactions", flag.ExitOnError)
+	query := addTransactionFlags(flags, "api")
+	asJson := flags.Bool("json", false, "print JSON rather than a table")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	transactions, err := query.run(ctx, config)
+	if err != nil {
+		return err
+	}
+	if *asJson {
+		return writeJson(os.Stdout, transactions)
+	}
+
+	table := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(table, "CREATED\tID\tAMOUNT\tKIND\tCATEGORY\tDESCRIPTION")
+	for _, transaction := range transactions {
+		fmt.Fprintf(table, "%s\t%s\t%s\t%s\t%s\t%s\n",
+			transaction.Created.Local().Format("2006-01-02 15:04"),
+			transaction.Id,
+			formatAmount(transaction.Amount),
+			application.ClassifyTransaction(transaction),
+			transaction.Category,
+			transaction.Description)
+	}
+	return table.Flush()
+}
+
+func exportCommand(ctx context.Context, config *application.Config, args []string) error {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	query := addTransactionFlags(flags, "api")
+	format := flags.String("format", "csv", "csv or json")
+	out := flags.String("out", "", "file to write, defaults to standard output")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *format != "csv" && *format != "json" {
+		return fmt.Errorf("unknown format %q, use csv or json", *format)
+	}
+
+	transactions, err := query.run(ctx, config)
+	if err != nil {
+		return err
+	}
+
+	var w io.Writer = os.Stdout
+	if *out != "" {
+		file, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		w = file
+	}
+
+	if *format == "json" {
+		err = writeJson(w, transactions)
+	} else {
+		err = writeCsv(w, transactions)
+	}
+	if err == nil && *out != "" {
+		log.Printf("Exported %d transactions to %s", len(transactions), *out)
+	}
+	return err
+}
+
+func writeJson(w io.Writer, transactions []*monzorestclient.TransactionDetailsResponse) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(transactions)
+}
+
+func writeCsv(w io.Writer, transactions []*monzorestclient.TransactionDetailsResponse) error {
+	writer := csv.NewWriter(w)
+	_ = writer.Write([]string{"id", "account_id", "created", "settled", "amount", "currency", "kind", "category", "description", "merchant", "notes", "decline_reason"})
+	for _, transaction := range transactions {
+		_ = writer.Write([]string{
+			transaction.Id,
+			transaction.AccountId,
+			transaction.Created.UTC().Format(time.RFC3339),
+			transaction.Settled,
+			strconv.FormatInt(transaction.Amount, 10),
+			transaction.Currency,
+			string(application.ClassifyTransaction(transaction)),
+			transaction.Category,
+			transaction.Description,
+			transaction.Merchant.Name,
+			transaction.Notes,
+			transaction.DeclineReason,
+		})
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// replayCommand reads recorded webhook payloads from the named files, or standard input, and handles them as
+// if Monzo had just sent them. With -dry-run, the default, nothing is changed in Monzo.
+func replayCommand(ctx context.Context, config *application.Config, args []string) error {
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", true, "log feed items, annotations and pot transfers instead of making them")
+	record := flags.Bool("ledger", false, "record replayed transactions in the ledger, which stops them being actioned again")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	webhooks := make([]*application.WebhookResponse, 0)
+	readFrom := func(r io.Reader, name string) error {
+		read, err := application.ReadWebhooks(r)
+		if err != nil {
+			return fmt.Errorf("reading %s: %v", name, err)
+		}
+		webhooks = append(webhooks, read...)
+		return nil
+	}
+	if flags.NArg() == 0 {
+		if err := readFrom(os.Stdin, "standard input"); err != nil {
+			return err
+		}
+	}
+	for _, path := range flags.Args() {
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		err = readFrom(file, path)
+		_ = file.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	rules, err := loadRules(config)
+	if err != nil {
+		return err
+	}
+	if config.RoundUpsFile != "" {
+		if config.RoundUps, err = application.LoadRoundUps(config.RoundUpsFile); err != nil {
+			return fmt.Errorf("unable to load round ups: %v", err)
+		}
+	}
+	if config.BudgetsFile != "" {
+		if config.Budgets, err = application.LoadBudgets(config.BudgetsFile); err != nil {
+			return fmt.Errorf("unable to load budgets: %v", err)
+		}
+	}
+
+	tokens, err := openTokenStore(config)
+	if err != nil {
+		return err
+	}
+	stored, err := tokens.LoadAll()
+	if err != nil {
+		return err
+	}
+	// Only users with a usable token are loaded, so one user's expired token doesn't stop the others'
+	// webhooks being replayed. Webhooks for a skipped user's accounts are logged as not found.
+	usable := make([]*tokenstore.Token, 0, len(stored))
+	for _, token := range stored {
+		if err = checkToken(token); err != nil {
+			log.Printf("Skipping user %s: %v", token.UserId, err)
+			continue
+		}
+		usable = append(usable, token)
+	}
+	if len(usable) == 0 {
+		return errors.New("no users in the token store have a usable token, run auth first")
+	}
+
+	var client application.MonzoClient = createClient(config)
+	if *dryRun {
+		client = dryRunClient{client}
+	}
+
+	var transactions application.TransactionLedger
+	if *record {
+		opened, err := ledger.CreateLedger(config.LedgerPath)
+		if err != nil {
+			return fmt.Errorf("unable to open transaction ledger: %v", err)
+		}
+		defer opened.Close()
+		transactions = opened
+	}
+
+	handled, err := application.Replay(ctx, client, config, rules, replayTokens{tokens, usable}, transactions, webhooks)
+	if err != nil {
+		return err
+	}
+	log.Printf("Replayed %d of %d webhooks", handled, len(webhooks))
+	return nil
+}
+
+// replayTokens limits the token store to the users being replayed.
+type replayTokens struct {
+	application.TokenStore
+	tokens []*tokenstore.Token
+}
+
+func (r replayTokens) LoadAll() ([]*tokenstore.Token, error) {
+	return r.tokens, nil
+}
+
+// dryRunClient reads from Monzo as normal but only logs the changes it is asked to make.
+type dryRunClient struct {
+	application.MonzoClient
+}
+
+func (d dryRunClient) UpdateTransaction(ctx context.Context, transactionId string, authToken string, metadata map[string]string) (*monzorestclient.TransactionDetailsResponse, error) {
+	log.Printf("[dry run] Would update transaction %s with %v", transactionId, metadata)
+	return &monzorestclient.TransactionDetailsResponse{Id: transactionId, Notes: metadata["notes"]}, nil
+}
+
+func (d dryRunClient) DepositIntoPot(ctx context.Context, potId string, sourceAccountId string, amount int64, dedupeId string, authToken string) (*monzorestclient.PotResponse, error) {
+	log.Printf("[dry run] Would deposit %s into pot %s from %s", formatAmount(amount), potId, sourceAccountId)
+	return &monzorestclient.PotResponse{Id: potId}, nil
+}
+
+func (d dryRunClient) WithdrawFromPot(ctx context.Context, potId string, destinationAccountId string, amount int64, dedupeId string, authToken string) (*monzorestclient.PotResponse, error) {
+	log.Printf("[dry run] Would withdraw %s from pot %s into %s", formatAmount(amount), potId, destinationAccountId)
+	return &monzorestclient.PotResponse{Id: potId}, nil
+}
+
+func (d dryRunClient) CreateFeedItem(ctx context.Context, item *monzorestclient.FeedItem, authToken string) error {
+	log.Printf("[dry run] Would create feed item on %s: %+v", item.AccountId, item.Params)
+	return nil
+}
+
+func (d dryRunClient) RegisterWebhook(ctx context.Context, accountId string, authToken string, url string) error {
+	log.Printf("[dry run] Would register webhook %s on %s", url, accountId)
+	return nil
+}
+
+func (d dryRunClient) DeleteWebhook(ctx context.Context, webhookId string, authToken string) error {
+	log.Printf("[dry run] Would delete webhook %s", webhookId)
+	return nil
+}
+
+// deadLettersCommand lists the webhooks that failed too many times to process, and can put one back on the
+// queue or discard it. It opens the ledger itself, so use the admin API instead while the server is running.
+func deadLettersCommand(ctx context.Context, config *application.Config, args []string) error {
+	flags := flag.NewFlagSet("dead-letters", flag.ExitOnError)
+	retry := flags.Uint64("retry", 0, "put the dead letter with this ID back on the queue for the next serve")
+	remove := flags.Uint64("delete", 0, "discard the dead letter with this ID")
+	asJson := flags.Bool("json", false, "print the dead letters, with their bodies, as JSON")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	queue, err := ledger.CreateLedger(config.LedgerPath)
+	if err != nil {
+		return fmt.Errorf("unable to open transaction ledger: %v", err)
+	}
+	defer queue.Close()
+
+	switch {
+	case *retry != 0:
+		return queue.Requeue(*retry)
+	case *remove != 0:
+		return queue.DeleteDeadLetter(*remove)
+	}
+
+	deadLetters, err := queue.DeadLetters()
+	if err != nil {
+		return err
+	}
+	if *asJson {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(deadLetters)
+	}
+
+	table := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(table, "ID\tACCOUNT\tRECEIVED\tATTEMPTS\tLAST ERROR")
+	for _, event := range deadLetters {
+		fmt.Fprintf(table, "%d\t%s\t%s\t%d\t%s\n", event.Id, event.AccountId, event.Received.Local().Format("2006-01-02 15:04"), event.Attempts, event.LastError)
+	}
+	return table.Flush()
+}
+
+func formatAmount(pence int64) string {
+	sign := ""
+	if pence < 0 {
+		sign = "-"
+		pence = -pence
+	}
+	return fmt.Sprintf("%s£%d.%02d", sign, pence/100, pence%100)
+}
+
+// parseAmount reads pounds, as typed on the command line, into pence.
+func parseAmount(value string) (int64, error) {
+	pounds, err := strconv.ParseFloat(strings.TrimPrefix(value, "£"), 64)
+	if err != nil {
+		return 0, errors.New("amount must be a number of pounds, e.g. -12.50")
+	}
+	if pounds < 0 {
+		return int64(pounds*100 - 0.5), nil
+	}
+	return int64(pounds*100 + 0.5), nil
+}
+
+func parseDate(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", value, time.Local); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
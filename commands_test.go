@@ -0,0 +1,90 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/tmilner/monzo-customisation/adapters/monzorestclient"
+)
+
+func Test_parseAmount(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		want    int64
+		wantErr bool
+	}{
+		{"Whole pounds", "12", 1200, false},
+		{"Pounds and pence", "12.50", 1250, false},
+		{"Spending", "-12.50", -1250, false},
+		{"Pound sign", "£3.99", 399, false},
+		{"Rounds half pennies up", "0.125", 13, false},
+		{"Rounds half pennies of spending down", "-0.125", -13, false},
+		{"Not a number", "ten", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseAmount(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseAmount() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("parseAmount() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_formatAmount(t *testing.T) {
+	tests := []struct {
+		name  string
+		pence int64
+		want  string
+	}{
+		{"Zero", 0, "£0.00"},
+		{"Pence", 5, "£0.05"},
+		{"Pounds and pence", 1250, "£12.50"},
+		{"Spending", -1250, "-£12.50"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := formatAmount(tt.pence); got != tt.want {
+				t.Errorf("formatAmount() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_transactionFilter_matches(t *testing.T) {
+	transaction := &monzorestclient.TransactionDetailsResponse{
+		Amount:      -350,
+		Category:    "eating_out",
+		Description: "PRET A MANGER",
+		Notes:       "#coffee",
+		Merchant:    monzorestclient.MerchantResponse{Name: "Pret A Manger"},
+	}
+
+	tests := []struct {
+		name   string
+		filter transactionFilter
+		want   bool
+	}{
+		{"Empty filter", transactionFilter{}, true},
+		{"Category ignores case", transactionFilter{category: "Eating_Out"}, true},
+		{"Other category", transactionFilter{category: "groceries"}, false},
+		{"Search the merchant", transactionFilter{search: "manger"}, true},
+		{"Search the notes", transactionFilter{search: "#COFFEE"}, true},
+		{"Search with no match", transactionFilter{search: "tesco"}, false},
+		{"Within the amounts", transactionFilter{min: -500, hasMin: true, max: -100, hasMax: true}, true},
+		{"Below the minimum", transactionFilter{min: -300, hasMin: true}, false},
+		{"Above the maximum", transactionFilter{max: -400, hasMax: true}, false},
+		{"Zero maximum", transactionFilter{max: 0, hasMax: true}, true},
+		{"Every field must match", transactionFilter{category: "eating_out", search: "tesco"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.filter.matches(transaction); got != tt.want {
+				t.Errorf("transactionFilter.matches() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,13 @@
+module github.com/tmilner/monzo-customisation
+
+go 1.22
+
+require (
+	github.com/gorilla/mux v1.8.1
+	github.com/justinas/alice v1.2.0
+	github.com/twinj/uuid v1.0.0
+	go.etcd.io/bbolt v1.3.11
+	gopkg.in/yaml.v2 v2.4.0
+)
+
+require golang.org/x/sys v0.30.0 // indirect
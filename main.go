@@ -1,31 +1,211 @@
 package main
 
 import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/tmilner/monzo-customisation/adapters/ledger"
 	"github.com/tmilner/monzo-customisation/adapters/monzorestclient"
+	"github.com/tmilner/monzo-customisation/adapters/tokenstore"
 	"github.com/tmilner/monzo-customisation/application"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	_ "time/tzdata"
 )
 
+const usage = `Usage: monzo-customisation [-config file] [-print-config] <command> [flags]
+
+Commands:
+  serve         run the webhook server (the default)
+  auth          authorise a user through a browser on localhost and save their token
+  accounts      list the user's accounts
+  pots          list the user's pots
+  balance       show account balances
+  transactions  list and search transactions
+  export        write transactions out as CSV or JSON
+  replay        feed recorded webhooks through the transaction handling
+  dead-letters  list, retry or discard webhooks that could not be processed
+  rekey         re-encrypt the token store with the current key
+
+Run monzo-customisation <command> -h for the flags of each command.
+`
+
+var commands = map[string]func(ctx context.Context, config *application.Config, args []string) error{
+	"serve":        serve,
+	"auth":         authCommand,
+	"accounts":     accountsCommand,
+	"pots":         potsCommand,
+	"balance":      balanceCommand,
+	"transactions": transactionsCommand,
+	"export":       exportCommand,
+	"replay":       replayCommand,
+	"dead-letters": deadLettersCommand,
+	"rekey":        rekeyCommand,
+}
+
 func main() {
 	log.SetPrefix("[MONZO]")
 
+	configFile := flag.String("config", os.Getenv("CONFIG_FILE"), "YAML config file, environment variables override its values")
+	printConfig := flag.Bool("print-config", false, "print the effective config with secrets redacted and exit")
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage+"\nGlobal flags:\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	config, err := application.LoadConfig(*configFile, os.Getenv)
+	if err != nil {
+		log.Fatalln("Unable to load config", err)
+	}
+
+	if *printConfig {
+		fmt.Print(config)
+		return
+	}
+
+	name := "serve"
+	args := flag.Args()
+	if len(args) > 0 {
+		name, args = args[0], args[1:]
+	}
+
+	command, found := commands[name]
+	if !found {
+		flag.Usage()
+		os.Exit(2)
+	}
+	// Interrupting cancels whatever the command is waiting on, serve drains first.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	err = command(ctx, config, args)
+	stop()
+	if err != nil {
+		log.Fatalln(err)
+	}
+}
+
+func serve(ctx context.Context, config *application.Config, args []string) error {
+	if err := flag.NewFlagSet("serve", flag.ExitOnError).Parse(args); err != nil {
+		return err
+	}
+	if err := config.Validate(); err != nil {
+		return err
+	}
+
 	log.Println("Starting! [2] ")
 
-	if len(os.Args) != 4 {
-		log.Fatalln("Not enough arguments supplied")
+	rules, err := loadRules(config)
+	if err != nil {
+		return err
+	}
+
+	if config.RoundUpsFile != "" {
+		if config.RoundUps, err = application.LoadRoundUps(config.RoundUpsFile); err != nil {
+			return fmt.Errorf("unable to load round ups: %v", err)
+		}
+	}
+
+	if config.BudgetsFile != "" {
+		if config.Budgets, err = application.LoadBudgets(config.BudgetsFile); err != nil {
+			return fmt.Errorf("unable to load budgets: %v", err)
+		}
 	}
 
-	config := &application.Config{
-		ClientId:     os.Args[1],
-		ClientSecret: os.Args[2],
-		URI:          os.Args[3],
-		RedirectUri:  os.Args[3] + "/auth_return",
-		WebhookURI:   os.Args[3] + "/webhook",
+	tokens, err := openTokenStore(config)
+	if err != nil {
+		return err
 	}
 
-	client := monzorestclient.CreateMonzoRestClient("https://api.monzo.com/", &http.Client{})
+	transactions, err := ledger.CreateLedger(config.LedgerPath)
+	if err != nil {
+		return fmt.Errorf("unable to open transaction ledger: %v", err)
+	}
+	defer transactions.Close()
 
-	_ = application.CreateMonzoCustomisation(client, config)
+	return application.CreateMonzoCustomisation(createClient(config), config, rules, tokens, transactions).
+		WithWebhookQueue(transactions).
+		WithWebhookTokens(transactions).
+		Run(ctx)
+}
+
+// rekeyCommand re-encrypts the token store with the first key in the keyring.
+// Tokens written with any other key in the keyring, or stored unencrypted, are read and rewritten.
+func rekeyCommand(ctx context.Context, config *application.Config, args []string) error {
+	if err := flag.NewFlagSet("rekey", flag.ExitOnError).Parse(args); err != nil {
+		return err
+	}
+
+	keyring, err := loadKeyring(config)
+	if err != nil {
+		return fmt.Errorf("unable to load token encryption keys: %v", err)
+	}
+	if keyring == nil {
+		return fmt.Errorf("token_keys, TOKEN_KEYS or TOKEN_KEYS_FILE must be set to rekey the token store")
+	}
+
+	fileStore, err := tokenstore.CreateFileTokenStore(config.TokenStorePath)
+	if err != nil {
+		return fmt.Errorf("unable to open token store: %v", err)
+	}
+
+	count, err := tokenstore.CreateEncryptedTokenStore(fileStore, keyring).Rekey()
+	if err != nil {
+		return fmt.Errorf("rekey failed after %d tokens: %v", count, err)
+	}
+	log.Printf("Re-encrypted %d tokens with key %s", count, keyring.CurrentKeyId())
+	return nil
+}
+
+func createClient(config *application.Config) *monzorestclient.MonzoRestClient {
+	return monzorestclient.CreateMonzoRestClient(config.MonzoApiUrl, &http.Client{}).
+		WithTokenUrl(config.MonzoTokenUrl).
+		WithRateLimit(monzorestclient.DefaultRateLimit, monzorestclient.DefaultRateBurst)
+}
+
+func loadRules(config *application.Config) (*application.RuleSet, error) {
+	location, err := config.Location()
+	if err != nil {
+		return nil, fmt.Errorf("unable to load timezone: %v", err)
+	}
+
+	rules, err := application.CreateRuleSet(nil)
+	if config.RulesFile != "" {
+		rules, err = application.LoadRules(config.RulesFile)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to load rules: %v", err)
+	}
+
+	if rules.Len() == 0 {
+		log.Println("No rules loaded, transactions will not be tagged. Set rules_file or RULES_FILE, rules.example.json has the Boris Bikes and coffee rules")
+	}
+	return rules.WithLocation(location), nil
+}
+
+func openTokenStore(config *application.Config) (application.TokenStore, error) {
+	keyring, err := loadKeyring(config)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load token encryption keys: %v", err)
+	}
+
+	fileStore, err := tokenstore.CreateFileTokenStore(config.TokenStorePath)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open token store: %v", err)
+	}
+
+	if keyring == nil {
+		log.Println("No token_keys, TOKEN_KEYS or TOKEN_KEYS_FILE set, tokens will be stored unencrypted")
+		return fileStore, nil
+	}
+	return tokenstore.CreateEncryptedTokenStore(fileStore, keyring), nil
+}
+
+func loadKeyring(config *application.Config) (*tokenstore.Keyring, error) {
+	if config.TokenKeys == "" {
+		return nil, nil
+	}
+	return tokenstore.ParseKeyring(config.TokenKeys)
 }